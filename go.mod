@@ -1,6 +1,6 @@
 module github.com/asstart/go-receipts
 
-go 1.17
+go 1.18
 
 require (
 	github.com/go-playground/locales v0.14.0
@@ -0,0 +1,92 @@
+package mongodb
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Fixed-size arrays
+//
+// Problem description:
+// [3]int of allTypesData is stored as a BSON array and decoded as primitive.A in map[string]interface{}.
+// Typed fields are decoded by the driver, but the length of the stored array isn't checked the same way:
+// a longer array fails with "more elements returned in array than can fit inside [3]float64",
+// a shorter one silently keeps the old values of the tail elements.
+//
+// WithArrays replaces the driver decoder for Go arrays and applies the length policy:
+//
+// - ArrayStrict: the stored array should have exactly the same length, *ArrayLengthError otherwise
+// - ArrayTruncateOrPad: extra elements are dropped, missing ones are set to zero values
+//
+// Errors are wrapped by the driver with the field path, so errors.As can be used
+// to get both the *ArrayLengthError and bsoncodec.DecodeError with the keys:
+//
+// error decoding key coords: can't decode array of 4 elements into [3]float64
+//
+// Arrays are decoded back from interface{} positions only with FidelityMap,
+// there's no information about the Go type in the stored array.
+
+// ArrayLengthPolicy defines what to do when the stored array length differs from the Go array length
+type ArrayLengthPolicy int
+
+const (
+	ArrayStrict ArrayLengthPolicy = iota
+	ArrayTruncateOrPad
+)
+
+// ArrayLengthError is returned by ArrayStrict policy
+type ArrayLengthError struct {
+	Type   reflect.Type
+	Stored int
+}
+
+func (e *ArrayLengthError) Error() string {
+	return fmt.Sprintf("can't decode array of %d elements into %v", e.Stored, e.Type)
+}
+
+// WithArrays decodes Go arrays with policy
+func WithArrays(policy ArrayLengthPolicy) RegistryOption {
+	return func(c *registryConfig) {
+		c.kindDecoders[reflect.Array] = &arrayDecoder{policy: policy}
+	}
+}
+
+// arraySliceCodec decodes elements of the stored array,
+// it reads arrays and binary data (for byte arrays) and wraps element errors with their indexes
+var arraySliceCodec = bsoncodec.NewSliceCodec()
+
+type arrayDecoder struct {
+	policy ArrayLengthPolicy
+}
+
+func (ad *arrayDecoder) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Kind() != reflect.Array {
+		return bsoncodec.ValueDecoderError{Name: "ArrayDecodeValue", Kinds: []reflect.Kind{reflect.Array}, Received: val}
+	}
+
+	switch vr.Type() {
+	case bsontype.Null:
+		val.Set(reflect.Zero(val.Type()))
+		return vr.ReadNull()
+	case bsontype.Undefined:
+		val.Set(reflect.Zero(val.Type()))
+		return vr.ReadUndefined()
+	}
+
+	elems := reflect.New(reflect.SliceOf(val.Type().Elem())).Elem()
+	if err := arraySliceCodec.DecodeValue(dc, vr, elems); err != nil {
+		return err
+	}
+
+	if elems.Len() != val.Len() && ad.policy == ArrayStrict {
+		return &ArrayLengthError{Type: val.Type(), Stored: elems.Len()}
+	}
+
+	val.Set(reflect.Zero(val.Type()))
+	reflect.Copy(val, elems)
+	return nil
+}
@@ -0,0 +1,98 @@
+package mongodb_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type point struct {
+	Coords [3]float64 `bson:"coords"`
+	Hash   [4]byte    `bson:"hash"`
+}
+
+func TestArrayPolicies(t *testing.T) {
+	tt := []struct {
+		name     string
+		policy   mongodb.ArrayLengthPolicy
+		stored   bson.A
+		expected [3]float64
+		isErr    bool
+	}{
+		{"strict same length", mongodb.ArrayStrict, bson.A{1.0, 2.0, 3.0}, [3]float64{1, 2, 3}, false},
+		{"strict longer", mongodb.ArrayStrict, bson.A{1.0, 2.0, 3.0, 4.0}, [3]float64{9, 9, 9}, true},
+		{"strict shorter", mongodb.ArrayStrict, bson.A{1.0}, [3]float64{9, 9, 9}, true},
+		{"truncate", mongodb.ArrayTruncateOrPad, bson.A{1.0, 2.0, 3.0, 4.0}, [3]float64{1, 2, 3}, false},
+		{"pad", mongodb.ArrayTruncateOrPad, bson.A{1.0}, [3]float64{1, 0, 0}, false},
+		{"integers", mongodb.ArrayStrict, bson.A{1, int64(2), 3.0}, [3]float64{1, 2, 3}, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				raw, err := bson.Marshal(bson.M{"coords": tc.stored})
+				assert.Nil(t, err)
+
+				res := point{Coords: [3]float64{9, 9, 9}}
+				err = bson.UnmarshalWithRegistry(mongodb.NewRegistry(mongodb.WithArrays(tc.policy)), raw, &res)
+				assert.Equal(t, tc.isErr, err != nil, err)
+				assert.Equal(t, tc.expected, res.Coords)
+			},
+		)
+	}
+}
+
+func TestArrayLengthErrorPath(t *testing.T) {
+	raw, err := bson.Marshal(bson.M{"coords": bson.A{1.0, 2.0, 3.0, 4.0}})
+	assert.Nil(t, err)
+
+	var res point
+	err = bson.UnmarshalWithRegistry(mongodb.NewRegistry(mongodb.WithArrays(mongodb.ArrayStrict)), raw, &res)
+
+	var lengthErr *mongodb.ArrayLengthError
+	assert.True(t, errors.As(err, &lengthErr))
+	assert.Equal(t, 4, lengthErr.Stored)
+
+	var decodeErr *bsoncodec.DecodeError
+	assert.True(t, errors.As(err, &decodeErr))
+	assert.Equal(t, []string{"coords"}, decodeErr.Keys())
+	assert.Contains(t, err.Error(), "coords")
+}
+
+func TestArrayElementErrorPath(t *testing.T) {
+	raw, err := bson.Marshal(bson.M{"coords": bson.A{1.0, "two", 3.0}})
+	assert.Nil(t, err)
+
+	var res point
+	err = bson.UnmarshalWithRegistry(mongodb.NewRegistry(mongodb.WithArrays(mongodb.ArrayStrict)), raw, &res)
+
+	var decodeErr *bsoncodec.DecodeError
+	assert.True(t, errors.As(err, &decodeErr))
+	assert.Equal(t, []string{"coords", "1"}, decodeErr.Keys())
+}
+
+func TestByteArray(t *testing.T) {
+	reg := mongodb.NewRegistry(mongodb.WithArrays(mongodb.ArrayStrict))
+	written := point{Coords: [3]float64{1, 2, 3}, Hash: [4]byte{1, 2, 3, 4}}
+
+	raw, err := bson.MarshalWithRegistry(reg, written)
+	assert.Nil(t, err)
+	assert.Equal(t, bsontype.Binary, bson.Raw(raw).Lookup("hash").Type)
+
+	var res point
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.Nil(t, err)
+	assert.Equal(t, written, res)
+
+	raw, err = bson.Marshal(bson.M{"hash": primitive.Binary{Data: []byte{1, 2}}})
+	assert.Nil(t, err)
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,366 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Typed accessors for decoded documents
+//
+// Problem description:
+// a value of map[string]interface{} can have different Go types depending on the registry:
+// a date is primitive.DateTime with the default registry and time.Time with customRegistry,
+// a number is int32, int64 or float64 depending on how it was written, and so on.
+// So every consumer has to know all the variants:
+//
+// createdAt, ok := nestedCstm.Data["createdAt"].(time.Time)
+//
+// Bag wraps the map and coerces values to the requested type:
+//
+// createdAt, err := mongodb.Bag(nestedCstm.Data).Time("createdAt")
+// n, err := mongodb.Bag(nestedCstm.Data).Int64("map[string]interface - primitive.1")
+//
+// Keys can be dotted paths through nested documents (maps, primitive.D, etc.) and arrays (by index).
+// A key containing dots is found as well, the whole key is tried before splitting it.
+// Missing keys return ErrKeyNotFound, values which can't be converted return *BagTypeError.
+// Bag can be used as a field type too, nested documents are decoded as Bag then.
+
+// ErrKeyNotFound is returned by Bag accessors if there's no value for the key
+var ErrKeyNotFound = errors.New("key not found")
+
+// BagTypeError is returned by Bag accessors if the value can't be converted to the requested type
+type BagTypeError struct {
+	Key   string
+	Type  string
+	Value interface{}
+}
+
+func (e *BagTypeError) Error() string {
+	return fmt.Sprintf("can't convert %v (%T) of %v to %v", e.Value, e.Value, e.Key, e.Type)
+}
+
+// Bag is a decoded document with typed accessors
+type Bag map[string]interface{}
+
+// Get returns the value for the key or dotted path
+func (b Bag) Get(key string) (interface{}, bool) {
+	return lookupPath(map[string]interface{}(b), key)
+}
+
+// Time returns time.Time for time.Time, *time.Time, primitive.DateTime, primitive.Timestamp
+// and RFC 3339 strings
+func (b Bag) Time(key string) (time.Time, error) {
+	v, err := b.value(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if t, ok := toTime(v, time.RFC3339Nano); ok {
+		return t, nil
+	}
+	return time.Time{}, &BagTypeError{Key: key, Type: "time.Time", Value: v}
+}
+
+// Int64 returns int64 for all integer types, floats and Decimal128 without fraction and numeric strings
+func (b Bag) Int64(key string) (int64, error) {
+	v, err := b.value(key)
+	if err != nil {
+		return 0, err
+	}
+	if i, ok := toInt64(v); ok {
+		return i, nil
+	}
+	return 0, &BagTypeError{Key: key, Type: "int64", Value: v}
+}
+
+// Float returns float64 for all numeric types and numeric strings
+func (b Bag) Float(key string) (float64, error) {
+	v, err := b.value(key)
+	if err != nil {
+		return 0, err
+	}
+	if f, ok := toFloat64(v); ok {
+		return f, nil
+	}
+	return 0, &BagTypeError{Key: key, Type: "float64", Value: v}
+}
+
+// Decimal returns Decimal for all numeric types and numeric strings,
+// floats are converted using their shortest representation
+func (b Bag) Decimal(key string) (Decimal, error) {
+	v, err := b.value(key)
+	if err != nil {
+		return Decimal{}, err
+	}
+	if d, ok := toDecimal(v); ok {
+		return d, nil
+	}
+	return Decimal{}, &BagTypeError{Key: key, Type: "Decimal", Value: v}
+}
+
+// Bool returns bool values
+func (b Bag) Bool(key string) (bool, error) {
+	v, err := b.value(key)
+	if err != nil {
+		return false, err
+	}
+	if res, ok := v.(bool); ok {
+		return res, nil
+	}
+	return false, &BagTypeError{Key: key, Type: "bool", Value: v}
+}
+
+// String returns strings, symbols and ObjectIDs as hex
+func (b Bag) String(key string) (string, error) {
+	v, err := b.value(key)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := toString(v); ok {
+		return s, nil
+	}
+	return "", &BagTypeError{Key: key, Type: "string", Value: v}
+}
+
+// Strings returns arrays of values accepted by String
+func (b Bag) Strings(key string) ([]string, error) {
+	v, err := b.value(key)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := v.([]string); ok {
+		return s, nil
+	}
+
+	arr, ok := toSlice(v)
+	if !ok {
+		return nil, &BagTypeError{Key: key, Type: "[]string", Value: v}
+	}
+	res := make([]string, 0, len(arr))
+	for i, e := range arr {
+		s, ok := toString(e)
+		if !ok {
+			return nil, &BagTypeError{Key: fmt.Sprintf("%v.%d", key, i), Type: "string", Value: e}
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// Bag returns nested documents: maps, primitive.M, primitive.D, FidelityMap
+func (b Bag) Bag(key string) (Bag, error) {
+	v, err := b.value(key)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := toMap(v); ok {
+		return Bag(m), nil
+	}
+	return nil, &BagTypeError{Key: key, Type: "Bag", Value: v}
+}
+
+func (b Bag) value(key string) (interface{}, error) {
+	v, ok := b.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("%v: %w", key, ErrKeyNotFound)
+	}
+	return v, nil
+}
+
+// lookupPath finds the value for path in a document or an array,
+// the whole path is tried as a key first, then it's split by dots from left to right
+func lookupPath(v interface{}, path string) (interface{}, bool) {
+	if res, ok := lookupKey(v, path); ok {
+		return res, true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+		next, ok := lookupKey(v, path[:i])
+		if !ok {
+			continue
+		}
+		if res, ok := lookupPath(next, path[i+1:]); ok {
+			return res, true
+		}
+	}
+	return nil, false
+}
+
+func lookupKey(v interface{}, key string) (interface{}, bool) {
+	if m, ok := toMap(v); ok {
+		res, ok := m[key]
+		return res, ok
+	}
+	if arr, ok := toSlice(v); ok {
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(arr) {
+			return nil, false
+		}
+		return arr[i], true
+	}
+	return nil, false
+}
+
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case Bag:
+		return m, true
+	case primitive.M:
+		return m, true
+	case FidelityMap:
+		return m, true
+	case primitive.D:
+		return m.Map(), true
+	}
+	return nil, false
+}
+
+// toTime converts time values and strings in the layout to time.Time
+func toTime(v interface{}, layout string) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case *time.Time:
+		if t != nil {
+			return *t, true
+		}
+	case primitive.DateTime:
+		return t.Time().UTC(), true
+	case primitive.Timestamp:
+		return time.Unix(int64(t.T), 0).UTC(), true
+	case string:
+		if res, err := time.Parse(layout, t); err == nil {
+			return res, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func toSlice(v interface{}) ([]interface{}, bool) {
+	switch s := v.(type) {
+	case []interface{}:
+		return s, true
+	case primitive.A:
+		return s, true
+	}
+	return nil, false
+}
+
+func toString(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case primitive.Symbol:
+		return string(s), true
+	case primitive.ObjectID:
+		return s.Hex(), true
+	}
+	return "", false
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := rv.Uint()
+		return int64(u), u <= math.MaxInt64
+	}
+
+	f, ok := toBigFloat(v)
+	if !ok || !f.IsInt() {
+		return 0, false
+	}
+	i, acc := f.Int64()
+	return i, acc == big.Exact
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+
+	f, ok := toBigFloat(v)
+	if !ok {
+		return 0, false
+	}
+	res, _ := f.Float64()
+	return res, true
+}
+
+func toDecimal(v interface{}) (Decimal, bool) {
+	var (
+		res Decimal
+		err error
+	)
+	switch n := v.(type) {
+	case Decimal:
+		return n, true
+	case *big.Rat:
+		if n == nil {
+			return Decimal{}, false
+		}
+		res, err = DecimalFromRat(n)
+	case float32:
+		res, err = decimalFromFloat(float64(n), 32)
+	case float64:
+		res, err = decimalFromFloat(n, 64)
+	default:
+		f, ok := toBigFloat(v)
+		if !ok {
+			return Decimal{}, false
+		}
+		res, err = ParseDecimal(f.Text('g', -1))
+	}
+	return res, err == nil
+}
+
+// toBigFloat converts numbers of any type and numeric strings to *big.Float
+func toBigFloat(v interface{}) (*big.Float, bool) {
+	var s string
+	switch n := v.(type) {
+	case *big.Float:
+		return n, n != nil && !n.IsInf()
+	case primitive.Decimal128:
+		s = n.String()
+	case Decimal:
+		s = n.String()
+	case string:
+		s = n
+	default:
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return new(big.Float).SetInt64(rv.Int()), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return new(big.Float).SetUint64(rv.Uint()), true
+		case reflect.Float32, reflect.Float64:
+			f := rv.Float()
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, false
+			}
+			return big.NewFloat(f), true
+		}
+		return nil, false
+	}
+
+	f, _, err := new(big.Float).SetPrec(decimalPrec).Parse(s, 10)
+	if err != nil || f.IsInf() {
+		return nil, false
+	}
+	return f, true
+}
@@ -0,0 +1,151 @@
+package mongodb_test
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBagAccessors(t *testing.T) {
+	createdAt := time.Date(2022, 11, 1, 10, 20, 30, 0, time.UTC)
+	dec, _ := primitive.ParseDecimal128("42")
+	data := map[string]interface{}{
+		"createdAt":  createdAt,
+		"int32":      int32(1),
+		"int64":      int64(2),
+		"float":      2.5,
+		"decimal":    dec,
+		"string":     "some string",
+		"tags":       []string{"a", "b"},
+		"nested":     map[string]interface{}{"count": 3, "deeper": map[string]interface{}{"ok": true}},
+		"dotted.key": "dotted",
+		"points":     []interface{}{map[string]interface{}{"x": 1}},
+	}
+	raw, err := bson.Marshal(mongodb.CustomNestedMapStruct{ID: "bag", Data: data})
+	assert.Nil(t, err)
+
+	registries := map[string][]mongodb.RegistryOption{
+		"default":              nil,
+		"custom":               {mongodb.WithDateTimeAsTime(), mongodb.WithArrayAsSlice(), mongodb.WithDocumentAsMap()},
+		"decimal as string":    {mongodb.WithDecimal128AsString()},
+		"decimal as big float": {mongodb.WithDecimal128AsBigFloat(), mongodb.WithIntegersAsInt()},
+	}
+
+	for name, opts := range registries {
+		t.Run(
+			name,
+			func(t *testing.T) {
+				var res mongodb.CustomNestedMapStruct
+				err := bson.UnmarshalWithRegistry(mongodb.NewRegistry(opts...), raw, &res)
+				assert.Nil(t, err)
+				bag := mongodb.Bag(res.Data)
+
+				ts, err := bag.Time("createdAt")
+				assert.Nil(t, err)
+				assert.True(t, createdAt.Equal(ts))
+
+				i, err := bag.Int64("int32")
+				assert.Nil(t, err)
+				assert.Equal(t, int64(1), i)
+
+				i, err = bag.Int64("decimal")
+				assert.Nil(t, err)
+				assert.Equal(t, int64(42), i)
+
+				f, err := bag.Float("int64")
+				assert.Nil(t, err)
+				assert.Equal(t, 2.0, f)
+
+				f, err = bag.Float("float")
+				assert.Nil(t, err)
+				assert.Equal(t, 2.5, f)
+
+				s, err := bag.String("string")
+				assert.Nil(t, err)
+				assert.Equal(t, "some string", s)
+
+				tags, err := bag.Strings("tags")
+				assert.Nil(t, err)
+				assert.Equal(t, []string{"a", "b"}, tags)
+
+				i, err = bag.Int64("nested.count")
+				assert.Nil(t, err)
+				assert.Equal(t, int64(3), i)
+
+				ok, err := bag.Bool("nested.deeper.ok")
+				assert.Nil(t, err)
+				assert.True(t, ok)
+
+				nested, err := bag.Bag("nested")
+				assert.Nil(t, err)
+				_, err = nested.Bag("deeper")
+				assert.Nil(t, err)
+
+				s, err = bag.String("dotted.key")
+				assert.Nil(t, err)
+				assert.Equal(t, "dotted", s)
+
+				i, err = bag.Int64("points.0.x")
+				assert.Nil(t, err)
+				assert.Equal(t, int64(1), i)
+			},
+		)
+	}
+}
+
+func TestBagErrors(t *testing.T) {
+	bag := mongodb.Bag{
+		"float":  2.5,
+		"string": "abc",
+		"big":    new(big.Float).SetFloat64(1e300),
+		"tags":   []interface{}{"a", 1},
+	}
+
+	_, err := bag.Int64("missing")
+	assert.True(t, errors.Is(err, mongodb.ErrKeyNotFound))
+
+	tt := []struct {
+		name string
+		get  func() error
+	}{
+		{"fraction to int", func() error { _, err := bag.Int64("float"); return err }},
+		{"too big for int", func() error { _, err := bag.Int64("big"); return err }},
+		{"string to float", func() error { _, err := bag.Float("string"); return err }},
+		{"string to time", func() error { _, err := bag.Time("string"); return err }},
+		{"number to string", func() error { _, err := bag.String("float"); return err }},
+		{"mixed strings", func() error { _, err := bag.Strings("tags"); return err }},
+		{"scalar to bag", func() error { _, err := bag.Bag("string"); return err }},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				var typeErr *mongodb.BagTypeError
+				assert.True(t, errors.As(tc.get(), &typeErr))
+			},
+		)
+	}
+}
+
+func TestBagField(t *testing.T) {
+	type bagDoc struct {
+		Data mongodb.Bag `bson:"data"`
+	}
+	raw, err := bson.Marshal(bson.M{"data": bson.M{"nested": bson.M{"n": 1}}})
+	assert.Nil(t, err)
+
+	var res bagDoc
+	assert.Nil(t, bson.Unmarshal(raw, &res))
+	assert.IsType(t, mongodb.Bag{}, res.Data["nested"])
+
+	n, err := res.Data.Int64("nested.n")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
@@ -0,0 +1,519 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Bulk loading
+//
+// Problem description:
+// every document in decoding.go is written with its own InsertOne,
+// which is a network round trip per document: fine for examples, too slow
+// for nightly imports of millions of CustomNestedMapStruct documents.
+//
+// BulkLoader groups documents into batches and writes every batch with a single BulkWrite:
+//
+// l := mongodb.NewBulkLoader(c, mongodb.WithBulkBatch(1000, 8<<20), mongodb.WithUnordered())
+// for _, doc := range docs {
+// 		if err := l.Add(ctx, doc); err != nil {
+// 			break
+// 		}
+// }
+// res, err := l.Close(ctx)
+//
+// LoadChannel and LoadIterator do the same for a channel and for an iterator like JSONReader:
+//
+// res, err := mongodb.LoadIterator(ctx, c, mongodb.NewJSONReader(f), mongodb.WithUpsertBy("id"))
+//
+// Documents are encoded with customRegistry when they're added, a batch is written
+// when it has the configured number of documents or adding the next one would exceed
+// the configured size. A document larger than the BSON limit (16MB) fails without being sent.
+// Documents without _id get an ObjectID, so failures can be reported with IDs.
+//
+// WithUpsertBy switches from inserts to upserts: documents are matched by the key fields,
+// fields of existing documents are set, missing documents are inserted.
+//
+// Writes are ordered by default: the first failed document stops loading,
+// Add and Close return the failure and the rest of the documents aren't written.
+// WithUnordered writes all documents it can, failures are collected in BulkResult.Failures.
+// Errors which aren't about particular documents (network, context, write concern) are returned as is.
+//
+// Collections which aren't BulkWriter get documents one by one with InsertOne or UpdateOne.
+// Stats and WithBulkProgress report the throughput while loading.
+
+// MaxBSONSize is the maximum size of a BSON document accepted by the server
+const MaxBSONSize = 16 * 1024 * 1024
+
+// default limits of a batch
+const (
+	DefaultBulkBatchDocs  = 1000
+	DefaultBulkBatchBytes = MaxBSONSize
+)
+
+var (
+	// ErrDocumentTooLarge is the failure of documents larger than MaxBSONSize
+	ErrDocumentTooLarge = errors.New("document is larger than the BSON size limit")
+	// ErrBulkAborted is returned by ordered loaders after a failed document
+	ErrBulkAborted = errors.New("bulk load stopped after a failed document")
+	// ErrBulkClosed is returned by Add after Close
+	ErrBulkClosed = errors.New("bulk loader is closed")
+)
+
+// BulkFailure is a document which wasn't written
+type BulkFailure struct {
+	// Index is the position of the document in the input, starting from 0
+	Index int64
+	// ID is the _id of the document, nil if the document couldn't be encoded
+	ID  interface{}
+	Err error
+}
+
+func (f BulkFailure) Error() string {
+	if f.ID == nil {
+		return fmt.Sprintf("document %d: %v", f.Index, f.Err)
+	}
+	return fmt.Sprintf("document %d (_id %v): %v", f.Index, f.ID, f.Err)
+}
+
+func (f BulkFailure) Unwrap() error {
+	return f.Err
+}
+
+// BulkStats are counters of a BulkLoader
+type BulkStats struct {
+	// Docs is the number of added documents
+	Docs     int64
+	Inserted int64
+	// Upserted is the number of documents inserted by upserts
+	Upserted int64
+	// Matched is the number of existing documents matched by upserts
+	Matched int64
+	Failed  int64
+	Batches int64
+	// Bytes is the size of written batches
+	Bytes int64
+	// Elapsed is the time from the first added document to the last written batch
+	Elapsed time.Duration
+}
+
+// DocsPerSecond returns the number of written documents per second
+func (s BulkStats) DocsPerSecond() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Inserted+s.Upserted+s.Matched) / s.Elapsed.Seconds()
+}
+
+// BytesPerSecond returns the number of written bytes per second
+func (s BulkStats) BytesPerSecond() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+func (s BulkStats) String() string {
+	return fmt.Sprintf("%d docs, %d inserted, %d upserted, %d matched, %d failed in %d batches, %.0f docs/s, %.0f bytes/s",
+		s.Docs, s.Inserted, s.Upserted, s.Matched, s.Failed, s.Batches, s.DocsPerSecond(), s.BytesPerSecond())
+}
+
+// BulkResult is the result of a completed load
+type BulkResult struct {
+	BulkStats
+	Failures []BulkFailure
+}
+
+// BulkOption configures BulkLoader
+type BulkOption func(*bulkConfig)
+
+type bulkConfig struct {
+	registry  *bsoncodec.Registry
+	maxDocs   int
+	maxBytes  int
+	unordered bool
+	upsertBy  []string
+	progress  func(BulkStats)
+}
+
+// WithBulkBatch sets the maximum number of documents and the maximum size of a batch,
+// sizes larger than MaxBSONSize are reduced to it
+func WithBulkBatch(docs, bytes int) BulkOption {
+	return func(c *bulkConfig) {
+		c.maxDocs = docs
+		c.maxBytes = bytes
+	}
+}
+
+// WithUnordered keeps writing after failed documents
+func WithUnordered() BulkOption {
+	return func(c *bulkConfig) {
+		c.unordered = true
+	}
+}
+
+// WithUpsertBy upserts documents matching them by the key fields instead of inserting them
+func WithUpsertBy(keys ...string) BulkOption {
+	return func(c *bulkConfig) {
+		c.upsertBy = keys
+	}
+}
+
+// WithBulkRegistry sets the registry used to encode documents
+func WithBulkRegistry(reg *bsoncodec.Registry) BulkOption {
+	return func(c *bulkConfig) {
+		c.registry = reg
+	}
+}
+
+// WithBulkProgress calls f with the stats after every batch
+func WithBulkProgress(f func(BulkStats)) BulkOption {
+	return func(c *bulkConfig) {
+		c.progress = f
+	}
+}
+
+type bulkDoc struct {
+	index int64
+	id    interface{}
+	model mongo.WriteModel
+	size  int
+}
+
+// BulkLoader writes documents in batches, Add and Close shouldn't be called concurrently,
+// Stats can be called from any goroutine
+type BulkLoader struct {
+	coll  Collection
+	cfg   bulkConfig
+	batch []bulkDoc
+	bytes int
+	next  int64
+	err   error
+	done  bool
+
+	mu       sync.Mutex
+	stats    BulkStats
+	failures []BulkFailure
+	started  time.Time
+}
+
+func NewBulkLoader(c Collection, opts ...BulkOption) *BulkLoader {
+	cfg := bulkConfig{
+		registry: customRegistry(),
+		maxDocs:  DefaultBulkBatchDocs,
+		maxBytes: DefaultBulkBatchBytes,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.maxDocs <= 0 {
+		cfg.maxDocs = DefaultBulkBatchDocs
+	}
+	if cfg.maxBytes <= 0 || cfg.maxBytes > MaxBSONSize {
+		cfg.maxBytes = MaxBSONSize
+	}
+	return &BulkLoader{coll: c, cfg: cfg}
+}
+
+// Add encodes doc and writes the batch if it's full.
+// It returns errors which stop loading: ErrBulkAborted for ordered loaders
+// after a failure, errors of the collection and the context
+func (l *BulkLoader) Add(ctx context.Context, doc interface{}) error {
+	if l.done {
+		return ErrBulkClosed
+	}
+	if l.err != nil {
+		return l.err
+	}
+
+	l.mu.Lock()
+	if l.started.IsZero() {
+		l.started = time.Now()
+	}
+	l.stats.Docs++
+	l.mu.Unlock()
+
+	index := l.next
+	l.next++
+	bd, err := l.encode(index, doc)
+	if err != nil {
+		// documents added before the failed one are written by ordered loaders as well
+		if !l.cfg.unordered {
+			if err := l.Flush(ctx); err != nil {
+				return err
+			}
+		}
+		l.fail(BulkFailure{Index: index, ID: bd.id, Err: err})
+		return l.err
+	}
+
+	if len(l.batch) > 0 && l.bytes+bd.size > l.cfg.maxBytes {
+		if err = l.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	l.batch = append(l.batch, bd)
+	l.bytes += bd.size
+	if len(l.batch) >= l.cfg.maxDocs {
+		return l.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush writes the current batch
+func (l *BulkLoader) Flush(ctx context.Context) error {
+	if l.err != nil {
+		return l.err
+	}
+	if len(l.batch) == 0 {
+		return nil
+	}
+
+	batch, size := l.batch, l.bytes
+	l.batch, l.bytes = nil, 0
+
+	var err error
+	if bw, ok := l.coll.(BulkWriter); ok {
+		err = l.writeBulk(ctx, bw, batch)
+	} else {
+		err = l.writeOneByOne(ctx, batch)
+	}
+	if err != nil && l.err == nil {
+		l.err = err
+	}
+
+	l.mu.Lock()
+	l.stats.Batches++
+	l.stats.Bytes += int64(size)
+	l.stats.Elapsed = time.Since(l.started)
+	stats := l.stats
+	l.mu.Unlock()
+
+	if l.cfg.progress != nil {
+		l.cfg.progress(stats)
+	}
+	return l.err
+}
+
+// Close writes the last batch and returns the result, the collection isn't closed.
+// Ordered loaders return ErrBulkAborted if a document failed
+func (l *BulkLoader) Close(ctx context.Context) (BulkResult, error) {
+	var err error
+	if !l.done {
+		err = l.Flush(ctx)
+		l.done = true
+	}
+	if err == nil {
+		err = l.err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return BulkResult{BulkStats: l.stats, Failures: append([]BulkFailure(nil), l.failures...)}, err
+}
+
+// Stats returns the current counters
+func (l *BulkLoader) Stats() BulkStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+func (l *BulkLoader) encode(index int64, doc interface{}) (bulkDoc, error) {
+	data, err := bson.MarshalWithRegistry(l.cfg.registry, doc)
+	if err != nil {
+		return bulkDoc{}, err
+	}
+	raw := bson.Raw(data)
+
+	bd := bulkDoc{index: index}
+	if len(l.cfg.upsertBy) == 0 {
+		if raw, err = ensureID(raw); err != nil {
+			return bulkDoc{}, err
+		}
+		bd.id = decodeID(raw.Lookup("_id"))
+		bd.model = mongo.NewInsertOneModel().SetDocument(raw)
+	} else {
+		if idVal, err := raw.LookupErr("_id"); err == nil {
+			bd.id = decodeID(idVal)
+		}
+		if bd.model, err = upsertModel(raw, l.cfg.upsertBy); err != nil {
+			return bd, err
+		}
+	}
+
+	bd.size = len(raw)
+	if bd.size > MaxBSONSize {
+		return bd, fmt.Errorf("%w: %d bytes", ErrDocumentTooLarge, bd.size)
+	}
+	return bd, nil
+}
+
+// ensureID prepends ObjectID to documents without _id the same way as the driver does
+func ensureID(doc bson.Raw) (bson.Raw, error) {
+	if _, err := doc.LookupErr("_id"); err == nil {
+		return doc, nil
+	}
+	idx, withID := bsoncore.AppendDocumentStart(nil)
+	withID = bsoncore.AppendObjectIDElement(withID, "_id", primitive.NewObjectID())
+	withID = append(withID, doc[4:len(doc)-1]...)
+	withID, err := bsoncore.AppendDocumentEnd(withID, idx)
+	return bson.Raw(withID), err
+}
+
+// upsertModel matches the document by keys and sets all its fields except _id
+func upsertModel(doc bson.Raw, keys []string) (mongo.WriteModel, error) {
+	filter := bson.D{}
+	for _, key := range keys {
+		v, err := doc.LookupErr(strings.Split(key, ".")...)
+		if err != nil {
+			return nil, fmt.Errorf("upsert key %v is missing", key)
+		}
+		filter = append(filter, bson.E{Key: key, Value: v})
+	}
+
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	set := bson.D{}
+	for _, e := range elems {
+		if e.Key() != "_id" {
+			set = append(set, bson.E{Key: e.Key(), Value: e.Value()})
+		}
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(filter).
+		SetUpdate(bson.D{{Key: "$set", Value: set}}).
+		SetUpsert(true), nil
+}
+
+func (l *BulkLoader) writeBulk(ctx context.Context, bw BulkWriter, batch []bulkDoc) error {
+	models := make([]mongo.WriteModel, 0, len(batch))
+	for _, bd := range batch {
+		models = append(models, bd.model)
+	}
+
+	res, err := bw.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(!l.cfg.unordered))
+	if res != nil {
+		l.count(res.InsertedCount, res.UpsertedCount, res.MatchedCount)
+	}
+	if err == nil {
+		return nil
+	}
+
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) == 0 || bwe.WriteConcernError != nil {
+		return err
+	}
+	for _, we := range bwe.WriteErrors {
+		bd := batch[we.Index]
+		l.fail(BulkFailure{Index: bd.index, ID: bd.id, Err: we.WriteError})
+	}
+	return l.err
+}
+
+func (l *BulkLoader) writeOneByOne(ctx context.Context, batch []bulkDoc) error {
+	for _, bd := range batch {
+		var err error
+		switch m := bd.model.(type) {
+		case *mongo.InsertOneModel:
+			if _, err = l.coll.InsertOne(ctx, m.Document); err == nil {
+				l.count(1, 0, 0)
+			}
+		case *mongo.UpdateOneModel:
+			var res *mongo.UpdateResult
+			if res, err = l.coll.UpdateOne(ctx, m.Filter, m.Update, options.Update().SetUpsert(true)); err == nil {
+				l.count(0, res.UpsertedCount, res.MatchedCount)
+			}
+		}
+
+		var we mongo.WriteException
+		switch {
+		case err == nil:
+			continue
+		case errors.As(err, &we) && len(we.WriteErrors) > 0 && we.WriteConcernError == nil:
+			l.fail(BulkFailure{Index: bd.index, ID: bd.id, Err: we.WriteErrors[0]})
+		default:
+			return err
+		}
+		if l.err != nil {
+			return l.err
+		}
+	}
+	return nil
+}
+
+func (l *BulkLoader) count(inserted, upserted, matched int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.Inserted += inserted
+	l.stats.Upserted += upserted
+	l.stats.Matched += matched
+}
+
+// fail records the failure and stops ordered loaders
+func (l *BulkLoader) fail(f BulkFailure) {
+	l.mu.Lock()
+	l.stats.Failed++
+	l.failures = append(l.failures, f)
+	l.mu.Unlock()
+
+	if !l.cfg.unordered && l.err == nil {
+		l.err = fmt.Errorf("%w: %v", ErrBulkAborted, f)
+	}
+}
+
+// LoadChannel writes documents from ch until it's closed
+func LoadChannel[T any](ctx context.Context, c Collection, ch <-chan T, opts ...BulkOption) (BulkResult, error) {
+	l := NewBulkLoader(c, opts...)
+	for {
+		select {
+		case doc, ok := <-ch:
+			if !ok {
+				return l.Close(ctx)
+			}
+			if err := l.Add(ctx, doc); err != nil {
+				res, _ := l.Close(ctx)
+				return res, err
+			}
+		case <-ctx.Done():
+			res, _ := l.Close(ctx)
+			return res, ctx.Err()
+		}
+	}
+}
+
+// DocumentIterator iterates over raw documents, JSONReader implements it
+type DocumentIterator interface {
+	Next() bool
+	Raw() bson.Raw
+	Err() error
+}
+
+// LoadIterator writes all documents of it
+func LoadIterator(ctx context.Context, c Collection, it DocumentIterator, opts ...BulkOption) (BulkResult, error) {
+	l := NewBulkLoader(c, opts...)
+	for it.Next() {
+		if err := l.Add(ctx, it.Raw()); err != nil {
+			res, _ := l.Close(ctx)
+			return res, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		res, _ := l.Close(ctx)
+		return res, err
+	}
+	return l.Close(ctx)
+}
@@ -0,0 +1,227 @@
+package mongodb_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// oneByOne hides BulkWrite of the wrapped collection
+type oneByOne struct {
+	mongodb.Collection
+}
+
+func nestedDocs(n int) []mongodb.CustomNestedMapStruct {
+	docs := make([]mongodb.CustomNestedMapStruct, 0, n)
+	for i := 0; i < n; i++ {
+		docs = append(docs, mongodb.CustomNestedMapStruct{
+			ID:   strconv.Itoa(i),
+			Data: map[string]interface{}{"n": int64(i), "createdAt": time.Now()},
+		})
+	}
+	return docs
+}
+
+func TestBulkLoaderBatches(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	var progress []int64
+	l := mongodb.NewBulkLoader(c, mongodb.WithBulkBatch(10, 0), mongodb.WithBulkProgress(func(s mongodb.BulkStats) {
+		progress = append(progress, s.Inserted)
+	}))
+	for _, doc := range nestedDocs(25) {
+		assert.Nil(t, l.Add(ctx, doc))
+	}
+	assert.Equal(t, int64(20), l.Stats().Inserted)
+
+	res, err := l.Close(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(25), res.Docs)
+	assert.Equal(t, int64(25), res.Inserted)
+	assert.Equal(t, int64(3), res.Batches)
+	assert.Empty(t, res.Failures)
+	assert.Equal(t, []int64{10, 20, 25}, progress)
+	assert.Equal(t, 3, c.Calls(mongotest.OpBulkWrite))
+	assert.Len(t, c.Docs(), 25)
+
+	assert.ErrorIs(t, l.Add(ctx, nestedDocs(1)[0]), mongodb.ErrBulkClosed)
+}
+
+func TestBulkLoaderBatchBytes(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	doc := bson.D{{Key: "payload", Value: strings.Repeat("x", 1000)}}
+	size := len(mustMarshal(t, append(bson.D{{Key: "_id", Value: "0"}}, doc...)))
+
+	l := mongodb.NewBulkLoader(c, mongodb.WithBulkBatch(100, 2*size+size/2))
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, l.Add(ctx, append(bson.D{{Key: "_id", Value: strconv.Itoa(i)}}, doc...)))
+	}
+	res, err := l.Close(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), res.Inserted)
+	assert.Equal(t, int64(3), res.Batches)
+	assert.Equal(t, int64(5*size), res.Bytes)
+}
+
+func mustMarshal(t *testing.T, v interface{}) bson.Raw {
+	data, err := bson.Marshal(v)
+	assert.Nil(t, err)
+	return data
+}
+
+func TestBulkLoaderFailures(t *testing.T) {
+	ctx := context.Background()
+
+	tt := []struct {
+		name      string
+		coll      func(c *mongotest.Collection) mongodb.Collection
+		unordered bool
+		inserted  int64
+	}{
+		{"ordered", func(c *mongotest.Collection) mongodb.Collection { return c }, false, 3},
+		{"unordered", func(c *mongotest.Collection) mongodb.Collection { return c }, true, 5},
+		{"ordered one by one", func(c *mongotest.Collection) mongodb.Collection { return oneByOne{c} }, false, 3},
+		{"unordered one by one", func(c *mongotest.Collection) mongodb.Collection { return oneByOne{c} }, true, 5},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				c := mongotest.NewCollection()
+				_, err := c.InsertOne(ctx, bson.D{{Key: "_id", Value: "3"}})
+				assert.Nil(t, err)
+
+				opts := []mongodb.BulkOption{mongodb.WithBulkBatch(4, 0)}
+				if tc.unordered {
+					opts = append(opts, mongodb.WithUnordered())
+				}
+				l := mongodb.NewBulkLoader(tc.coll(c), opts...)
+				for i := 0; i < 6; i++ {
+					if err = l.Add(ctx, bson.D{{Key: "_id", Value: strconv.Itoa(i)}}); err != nil {
+						break
+					}
+				}
+				res, closeErr := l.Close(ctx)
+
+				assert.Equal(t, tc.inserted, res.Inserted)
+				assert.Len(t, res.Failures, 1)
+				assert.Equal(t, int64(3), res.Failures[0].Index)
+				assert.Equal(t, "3", res.Failures[0].ID)
+				if tc.unordered {
+					assert.Nil(t, err)
+					assert.Nil(t, closeErr)
+				} else {
+					assert.ErrorIs(t, err, mongodb.ErrBulkAborted)
+					assert.ErrorIs(t, closeErr, mongodb.ErrBulkAborted)
+				}
+				assert.Len(t, c.Docs(), int(tc.inserted)+1)
+			},
+		)
+	}
+}
+
+func TestBulkLoaderOrderedEncodeFailure(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	// the third document has no upsert key, the first two are in the same batch before it
+	l := mongodb.NewBulkLoader(c, mongodb.WithBulkBatch(10, 0), mongodb.WithUpsertBy("id"))
+	assert.Nil(t, l.Add(ctx, bson.D{{Key: "id", Value: 1}}))
+	assert.Nil(t, l.Add(ctx, bson.D{{Key: "id", Value: 2}}))
+	assert.ErrorIs(t, l.Add(ctx, bson.D{{Key: "x", Value: 3}}), mongodb.ErrBulkAborted)
+	assert.ErrorIs(t, l.Add(ctx, bson.D{{Key: "id", Value: 4}}), mongodb.ErrBulkAborted)
+
+	res, err := l.Close(ctx)
+	assert.ErrorIs(t, err, mongodb.ErrBulkAborted)
+	assert.Equal(t, int64(2), res.Upserted)
+	assert.Len(t, res.Failures, 1)
+	assert.Equal(t, int64(2), res.Failures[0].Index)
+	assert.Len(t, c.Docs(), 2)
+}
+
+func TestBulkLoaderDocumentTooLarge(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	l := mongodb.NewBulkLoader(c, mongodb.WithUnordered())
+	assert.Nil(t, l.Add(ctx, bson.D{{Key: "_id", Value: "big"}, {Key: "payload", Value: strings.Repeat("x", mongodb.MaxBSONSize)}}))
+	assert.Nil(t, l.Add(ctx, bson.D{{Key: "_id", Value: "small"}}))
+
+	res, err := l.Close(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Inserted)
+	assert.Len(t, res.Failures, 1)
+	assert.ErrorIs(t, res.Failures[0], mongodb.ErrDocumentTooLarge)
+	assert.Equal(t, "big", res.Failures[0].ID)
+}
+
+func TestBulkLoaderUpsert(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection(mongotest.WithRegistry(mongodb.NewRegistry(mongodb.WithDateTimeAsTime())))
+
+	_, err := c.InsertOne(ctx, bson.D{{Key: "id", Value: "1"}, {Key: "date", Value: time.Unix(0, 0)}})
+	assert.Nil(t, err)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ch := make(chan mongodb.CustomFlatStructure, 3)
+	ch <- mongodb.CustomFlatStructure{ID: "1", Date: now}
+	ch <- mongodb.CustomFlatStructure{ID: "2", Date: now}
+	close(ch)
+
+	res, err := mongodb.LoadChannel(ctx, c, ch, mongodb.WithUpsertBy("id"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Matched)
+	assert.Equal(t, int64(1), res.Upserted)
+	assert.Len(t, c.Docs(), 2)
+
+	var doc mongodb.CustomFlatStructure
+	assert.Nil(t, c.FindOne(ctx, mongodb.Eq("id", "1")).Decode(&doc))
+	assert.Equal(t, now, doc.Date.UTC())
+
+	// documents without the key fail
+	res, err = mongodb.LoadChannel(ctx, c, closedChannel(bson.D{{Key: "date", Value: now}}), mongodb.WithUpsertBy("id"))
+	assert.ErrorIs(t, err, mongodb.ErrBulkAborted)
+	assert.Len(t, res.Failures, 1)
+}
+
+func closedChannel(docs ...bson.D) <-chan bson.D {
+	ch := make(chan bson.D, len(docs))
+	for _, d := range docs {
+		ch <- d
+	}
+	close(ch)
+	return ch
+}
+
+func TestLoadIterator(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	input := `{"id": "1", "n": {"$numberLong": "1"}}
+{"id": "2", "n": {"$numberLong": "2"}}
+{"id": "3", "n": {"$numberLong": "3"}}`
+
+	res, err := mongodb.LoadIterator(ctx, c, mongodb.NewJSONReader(strings.NewReader(input)), mongodb.WithBulkBatch(2, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), res.Inserted)
+	assert.Equal(t, int64(2), res.Batches)
+
+	// generated _id goes first like with the driver
+	for _, d := range c.Docs() {
+		assert.Equal(t, "_id", d.Index(0).Key())
+	}
+
+	_, err = mongodb.LoadIterator(ctx, c, mongodb.NewJSONReader(strings.NewReader(`{"id": `)))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,194 @@
+// mongo-dump exports documents of a collection to Extended JSON and imports them back,
+// documents are copied as raw BSON without decoding them into Go types.
+//
+// mongo-dump export -uri mongodb://localhost:27017 -db test -coll test_decoding -file fixtures.json -canonical
+// mongo-dump import -uri mongodb://localhost:27017 -db test -coll test_decoding -file fixtures.json
+// mongo-dump validate -uri mongodb://localhost:27017 -db test -coll test_decoding
+//
+// validate reads documents of the collection (matching -filter) and reports fields which would change
+// their BSON types if the documents were exported as relaxed (or canonical with -canonical) Extended JSON
+// and imported back. It has to read the source BSON: documents read from an exported file
+// have already lost their original types.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type config struct {
+	uri, db, coll string
+	file          string
+	filter        string
+	canonical     bool
+	array         bool
+	timeout       time.Duration
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var cfg config
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	fs.StringVar(&cfg.uri, "uri", "", "connection string of the mongodb instance")
+	fs.StringVar(&cfg.db, "db", "", "database name")
+	fs.StringVar(&cfg.coll, "coll", "", "collection name")
+	fs.StringVar(&cfg.file, "file", "-", "Extended JSON file, - for stdin/stdout")
+	fs.StringVar(&cfg.filter, "filter", "{}", "filter of exported or validated documents in Extended JSON")
+	fs.BoolVar(&cfg.canonical, "canonical", false, "write canonical Extended JSON instead of relaxed")
+	fs.BoolVar(&cfg.array, "array", false, "write documents as a JSON array instead of one per line")
+	fs.DurationVar(&cfg.timeout, "timeout", 10*time.Minute, "timeout of export and import")
+	_ = fs.Parse(os.Args[2:])
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(cfg)
+	case "import":
+		err = load(cfg)
+	case "validate":
+		err = validate(cfg)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mongo-dump export|import|validate [flags], run mongo-dump <command> -h for flags")
+}
+
+func (cfg config) jsonOptions() []mongodb.JSONOption {
+	var opts []mongodb.JSONOption
+	if cfg.canonical {
+		opts = append(opts, mongodb.WithCanonicalJSON())
+	}
+	if cfg.array {
+		opts = append(opts, mongodb.WithJSONArray())
+	}
+	return opts
+}
+
+func withCollection(cfg config, f func(ctx context.Context, c mongodb.Collection) error) error {
+	if cfg.uri == "" || cfg.db == "" || cfg.coll == "" {
+		return fmt.Errorf("-uri, -db and -coll should be set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+
+	clients := mongodb.NewClientManager()
+	defer clients.Close(context.Background())
+
+	client, err := clients.Client(ctx, cfg.uri)
+	if err != nil {
+		return err
+	}
+	return f(ctx, client.Database(cfg.db).Collection(cfg.coll))
+}
+
+func (cfg config) parseFilter() (bson.Raw, error) {
+	var filter bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(cfg.filter), false, &filter); err != nil {
+		return nil, fmt.Errorf("can't parse filter: %w", err)
+	}
+	return filter, nil
+}
+
+func export(cfg config) error {
+	filter, err := cfg.parseFilter()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if cfg.file != "-" {
+		f, err := os.Create(cfg.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return withCollection(cfg, func(ctx context.Context, c mongodb.Collection) error {
+		n, err := mongodb.ExportJSON(ctx, c, filter, w, cfg.jsonOptions()...)
+		fmt.Fprintf(os.Stderr, "exported %d documents\n", n)
+		return err
+	})
+}
+
+func load(cfg config) error {
+	r, closeFile, err := open(cfg.file)
+	if err != nil {
+		return err
+	}
+	defer closeFile()
+
+	return withCollection(cfg, func(ctx context.Context, c mongodb.Collection) error {
+		n, err := mongodb.ImportJSON(ctx, c, r, cfg.jsonOptions()...)
+		fmt.Fprintf(os.Stderr, "imported %d documents\n", n)
+		return err
+	})
+}
+
+func validate(cfg config) error {
+	filter, err := cfg.parseFilter()
+	if err != nil {
+		return err
+	}
+
+	return withCollection(cfg, func(ctx context.Context, c mongodb.Collection) error {
+		cur, err := c.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+
+		changed := 0
+		for i := 0; cur.Next(ctx); i++ {
+			changes, err := mongodb.JSONRoundTrip(cur.Current, cfg.jsonOptions()...)
+			if err != nil {
+				return fmt.Errorf("document %d: %w", i, err)
+			}
+			for _, c := range changes {
+				fmt.Printf("document %d (_id %v): %v\n", i, cur.Current.Lookup("_id"), c)
+			}
+			if len(changes) > 0 {
+				changed++
+			}
+		}
+		if err = cur.Err(); err != nil {
+			return err
+		}
+		if changed > 0 {
+			return fmt.Errorf("%d documents change types on round trip", changed)
+		}
+		return nil
+	})
+}
+
+func open(file string) (io.Reader, func(), error) {
+	if file == "-" {
+		return os.Stdin, func() {}, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
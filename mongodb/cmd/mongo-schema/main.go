@@ -0,0 +1,151 @@
+// mongo-schema infers the schema of documents from a collection or a dump file
+// and suggests Go structs for them.
+//
+// mongo-schema -uri mongodb://localhost:27017 -db test -coll test_decoding -n 1000
+// mongo-schema -file dump/test/test_decoding.bson -name Data
+// mongoexport ... | mongo-schema -file - -format json -json
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func main() {
+	var (
+		uri     = flag.String("uri", "", "connection string of the mongodb instance")
+		db      = flag.String("db", "", "database name")
+		coll    = flag.String("coll", "", "collection name")
+		n       = flag.Int64("n", 100, "number of documents to sample")
+		file    = flag.String("file", "", "dump file to read instead of a collection, - for stdin")
+		format  = flag.String("format", "", "dump format: json or bson, detected by the file extension by default")
+		name    = flag.String("name", "Document", "name of the suggested Go struct")
+		asJSON  = flag.Bool("json", false, "print the schema as JSON instead of a table and Go structs")
+		timeout = flag.Duration("timeout", time.Minute, "timeout of sampling a collection")
+	)
+	flag.Parse()
+
+	if err := run(*uri, *db, *coll, *n, *file, *format, *name, *asJSON, *timeout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(uri, db, coll string, n int64, file, format, name string, asJSON bool, timeout time.Duration) error {
+	var (
+		schema *mongodb.Schema
+		err    error
+	)
+	switch {
+	case file != "":
+		schema, err = fromFile(file, format, n)
+	case uri != "" && db != "" && coll != "":
+		schema, err = fromCollection(uri, db, coll, n, timeout)
+	default:
+		flag.Usage()
+		return fmt.Errorf("either -file or -uri, -db and -coll should be set")
+	}
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return schema.WriteJSON(os.Stdout)
+	}
+
+	if err = schema.WriteTable(os.Stdout); err != nil {
+		return err
+	}
+	src, err := schema.GoStruct(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n%v", src)
+	return nil
+}
+
+func fromCollection(uri, db, coll string, n int64, timeout time.Duration) (*mongodb.Schema, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	clients := mongodb.NewClientManager()
+	defer clients.Close(context.Background())
+
+	client, err := clients.Client(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	return mongodb.SampleSchema(ctx, client.Database(db).Collection(coll), n)
+}
+
+func fromFile(file, format string, n int64) (*mongodb.Schema, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if format == "" {
+		format = "json"
+		if filepath.Ext(file) == ".bson" {
+			format = "bson"
+		}
+	}
+
+	// next returns io.EOF after the last document,
+	// documents are read one by one, so only n of them are read from large dumps
+	var next func() (bson.Raw, error)
+	switch format {
+	case "json":
+		jr := mongodb.NewJSONReader(r)
+		next = func() (bson.Raw, error) {
+			if jr.Next() {
+				return jr.Raw(), nil
+			}
+			if err := jr.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+	case "bson":
+		read := 0
+		next = func() (bson.Raw, error) {
+			doc, err := bson.NewFromIOReader(r)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("can't read document %d: %w", read, err)
+			}
+			read++
+			return doc, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %v, expected json or bson", format)
+	}
+
+	schema := &mongodb.Schema{}
+	for read := int64(0); n <= 0 || read < n; read++ {
+		doc, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = schema.Add(doc); err != nil {
+			return nil, err
+		}
+	}
+	return schema, nil
+}
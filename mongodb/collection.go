@@ -0,0 +1,56 @@
+package mongodb
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection abstraction
+//
+// All helpers of this package depend on the narrow Collection interface
+// instead of *mongo.Collection. It keeps the driver signatures and result types,
+// so *mongo.Collection is the adapter for the real driver itself and can be passed as is:
+//
+// c := client.Database(db).Collection(coll)
+// repo := mongodb.NewRepository[mongodb.CustomFlatStructure](c)
+//
+// Any other implementation works the same way: the in-memory collection from mongotest,
+// mocks, or decorators wrapping another Collection to add logging, metrics, retries, etc.
+// *mongo.SingleResult and *mongo.Cursor for non-driver implementations can be created
+// with mongo.NewSingleResultFromDocument and mongo.NewCursorFromDocuments.
+
+// Collection is the subset of *mongo.Collection used by the helpers of this package
+type Collection interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+}
+
+// DocumentCounter is implemented by collections which can count documents on the server side,
+// helpers fall back to iterating Find results if a Collection doesn't implement it
+type DocumentCounter interface {
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+}
+
+// Aggregator is implemented by collections which can run aggregation pipelines,
+// helpers use it for server side operations like $sample when it's available
+type Aggregator interface {
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+}
+
+// BulkWriter is implemented by collections which can send several writes in a single request,
+// helpers fall back to writing documents one by one if a Collection doesn't implement it
+type BulkWriter interface {
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+}
+
+var (
+	_ Collection      = (*mongo.Collection)(nil)
+	_ DocumentCounter = (*mongo.Collection)(nil)
+	_ Aggregator      = (*mongo.Collection)(nil)
+	_ BulkWriter      = (*mongo.Collection)(nil)
+)
@@ -0,0 +1,225 @@
+package mongodb
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Complex numbers
+//
+// Problem description:
+// the driver has no codec for complex64 and complex128, so "complex64" and "complex128"
+// of allTypesData can't be encoded at all.
+//
+// WithComplex stores complex numbers as documents:
+//
+// {"_kind": "complex128", "re": 1.0, "im": 1.0}
+//
+// the _kind field allows to decode them back into complex64/complex128 in interface{} positions (see KindKey).
+// WithComplexAsArray stores them as [re, im], which is more compact,
+// but such values can be decoded only into typed complex fields, interface{} gets an array.
+// The decoder accepts both representations.
+
+// _kind values of documents written by WithComplex
+const (
+	Complex64Kind  = "complex64"
+	Complex128Kind = "complex128"
+)
+
+var (
+	tComplex64  = reflect.TypeOf(complex64(0))
+	tComplex128 = reflect.TypeOf(complex128(0))
+)
+
+// WithComplex encodes complex numbers as {"_kind": ..., "re": ..., "im": ...}
+func WithComplex() RegistryOption {
+	return func(c *registryConfig) {
+		registerComplexCodec(c, &complexCodec{})
+		c.kinds[Complex64Kind] = tComplex64
+		c.kinds[Complex128Kind] = tComplex128
+	}
+}
+
+// WithComplexAsArray encodes complex numbers as [re, im]
+func WithComplexAsArray() RegistryOption {
+	return func(c *registryConfig) {
+		registerComplexCodec(c, &complexCodec{asArray: true})
+	}
+}
+
+func registerComplexCodec(c *registryConfig, cc *complexCodec) {
+	for _, k := range []reflect.Kind{reflect.Complex64, reflect.Complex128} {
+		c.kindEncoders[k] = cc
+		c.kindDecoders[k] = cc
+	}
+}
+
+type complexCodec struct {
+	asArray bool
+}
+
+func (cc *complexCodec) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || (val.Kind() != reflect.Complex64 && val.Kind() != reflect.Complex128) {
+		return bsoncodec.ValueEncoderError{Name: "ComplexEncodeValue", Kinds: []reflect.Kind{reflect.Complex64, reflect.Complex128}, Received: val}
+	}
+	v := val.Complex()
+
+	if cc.asArray {
+		aw, err := vw.WriteArray()
+		if err != nil {
+			return err
+		}
+		for _, f := range []float64{real(v), imag(v)} {
+			evw, err := aw.WriteArrayElement()
+			if err != nil {
+				return err
+			}
+			if err = evw.WriteDouble(f); err != nil {
+				return err
+			}
+		}
+		return aw.WriteArrayEnd()
+	}
+
+	kind := Complex128Kind
+	if val.Kind() == reflect.Complex64 {
+		kind = Complex64Kind
+	}
+
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+	ew, err := dw.WriteDocumentElement(KindKey)
+	if err != nil {
+		return err
+	}
+	if err = ew.WriteString(kind); err != nil {
+		return err
+	}
+	if ew, err = dw.WriteDocumentElement("re"); err != nil {
+		return err
+	}
+	if err = ew.WriteDouble(real(v)); err != nil {
+		return err
+	}
+	if ew, err = dw.WriteDocumentElement("im"); err != nil {
+		return err
+	}
+	if err = ew.WriteDouble(imag(v)); err != nil {
+		return err
+	}
+	return dw.WriteDocumentEnd()
+}
+
+func (cc *complexCodec) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || (val.Kind() != reflect.Complex64 && val.Kind() != reflect.Complex128) {
+		return bsoncodec.ValueDecoderError{Name: "ComplexDecodeValue", Kinds: []reflect.Kind{reflect.Complex64, reflect.Complex128}, Received: val}
+	}
+
+	var (
+		v   complex128
+		err error
+	)
+	switch vt := vr.Type(); vt {
+	case bsontype.EmbeddedDocument:
+		v, err = decodeComplexDocument(vr)
+	case bsontype.Array:
+		v, err = decodeComplexArray(vr)
+	case bsontype.Null:
+		err = vr.ReadNull()
+	case bsontype.Undefined:
+		err = vr.ReadUndefined()
+	default:
+		return fmt.Errorf("cannot decode %v into a %v", vt, val.Type())
+	}
+	if err != nil {
+		return err
+	}
+
+	if val.OverflowComplex(v) {
+		return fmt.Errorf("%v overflows %v", v, val.Type())
+	}
+	val.SetComplex(v)
+	return nil
+}
+
+func decodeComplexDocument(vr bsonrw.ValueReader) (complex128, error) {
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return 0, err
+	}
+
+	var re, im float64
+	for {
+		key, evr, err := dr.ReadElement()
+		if err == bsonrw.ErrEOD {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch key {
+		case "re":
+			if re, err = readFloat(evr); err != nil {
+				return 0, fmt.Errorf("can't decode complex re: %w", err)
+			}
+		case "im":
+			if im, err = readFloat(evr); err != nil {
+				return 0, fmt.Errorf("can't decode complex im: %w", err)
+			}
+		default:
+			if err = evr.Skip(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return complex(re, im), nil
+}
+
+func decodeComplexArray(vr bsonrw.ValueReader) (complex128, error) {
+	ar, err := vr.ReadArray()
+	if err != nil {
+		return 0, err
+	}
+
+	var parts []float64
+	for {
+		evr, err := ar.ReadValue()
+		if err == bsonrw.ErrEOA {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(parts) == 2 {
+			return 0, fmt.Errorf("cannot decode an array with more than 2 elements into a complex number")
+		}
+
+		f, err := readFloat(evr)
+		if err != nil {
+			return 0, fmt.Errorf("can't decode complex part %d: %w", len(parts), err)
+		}
+		parts = append(parts, f)
+	}
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("cannot decode an array with %d elements into a complex number", len(parts))
+	}
+	return complex(parts[0], parts[1]), nil
+}
+
+func readFloat(vr bsonrw.ValueReader) (float64, error) {
+	if vr.Type() == bsontype.Double {
+		return vr.ReadDouble()
+	}
+	i, err := readInteger(vr)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number, got %v", vr.Type())
+	}
+	return float64(i), nil
+}
@@ -0,0 +1,97 @@
+package mongodb_test
+
+import (
+	"testing"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+type signal struct {
+	Sample   complex128 `bson:"sample"`
+	Sample64 complex64  `bson:"sample64"`
+}
+
+func TestComplexRoundTrip(t *testing.T) {
+	tt := []struct {
+		name     string
+		opt      mongodb.RegistryOption
+		bsonType bsontype.Type
+	}{
+		{"document", mongodb.WithComplex(), bsontype.EmbeddedDocument},
+		{"array", mongodb.WithComplexAsArray(), bsontype.Array},
+	}
+
+	written := signal{Sample: complex(1.5, -2), Sample64: complex(3, 0.25)}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				reg := mongodb.NewRegistry(tc.opt)
+
+				raw, err := bson.MarshalWithRegistry(reg, written)
+				assert.Nil(t, err)
+				assert.Equal(t, tc.bsonType, bson.Raw(raw).Lookup("sample").Type)
+
+				var res signal
+				err = bson.UnmarshalWithRegistry(reg, raw, &res)
+				assert.Nil(t, err)
+				assert.Equal(t, written, res)
+			},
+		)
+	}
+}
+
+func TestComplexDecoding(t *testing.T) {
+	tt := []struct {
+		name     string
+		stored   interface{}
+		expected complex128
+		isErr    bool
+	}{
+		{"document", bson.M{"re": 1, "im": 2.5}, complex(1, 2.5), false},
+		{"document without im", bson.M{"re": 1}, complex(1, 0), false},
+		{"array", bson.A{1.5, int64(2)}, complex(1.5, 2), false},
+		{"short array", bson.A{1.5}, 0, true},
+		{"long array", bson.A{1, 2, 3}, 0, true},
+		{"not a number", bson.A{"1", 2}, 0, true},
+		{"string", "1+2i", 0, true},
+	}
+
+	reg := mongodb.NewRegistry(mongodb.WithComplex())
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				raw, err := bson.Marshal(bson.M{"sample": tc.stored})
+				assert.Nil(t, err)
+
+				var res signal
+				err = bson.UnmarshalWithRegistry(reg, raw, &res)
+				assert.Equal(t, tc.isErr, err != nil, err)
+				assert.Equal(t, tc.expected, res.Sample)
+			},
+		)
+	}
+}
+
+func TestComplexInMap(t *testing.T) {
+	reg := mongodb.NewRegistry(mongodb.WithComplex())
+	data := map[string]interface{}{
+		"complex64":  complex64(complex(1, 1)),
+		"complex128": complex(2, -1),
+		"nested":     map[string]interface{}{"complex128": complex(0, 1)},
+	}
+
+	raw, err := bson.MarshalWithRegistry(reg, mongodb.CustomNestedMapStruct{ID: "complex", Data: data})
+	assert.Nil(t, err)
+
+	var res mongodb.CustomNestedMapStruct
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.Nil(t, err)
+	assert.Equal(t, data, res.Data)
+}
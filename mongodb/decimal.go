@@ -0,0 +1,310 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Decimal numbers
+//
+// Problem description:
+// float32(1.4) put to Data comes back as 1.399999976158142 float64 (look at insertNestedAllTypes),
+// and float64 can't keep prices exactly either: 0.1 + 0.2 != 0.3.
+// primitive.Decimal128 keeps the value, but has no arithmetic and no conversions.
+//
+// WithDecimal maps Decimal to BSON Decimal128 and back, Decimal128 values in interface{}
+// (Data maps included) are decoded as Decimal, *big.Rat fields are stored as Decimal128 as well:
+//
+// reg := mongodb.NewRegistry(mongodb.WithDecimal())
+// doc := mongodb.CustomNestedMapStruct{ID: "1", Data: map[string]interface{}{"price": mongodb.NewDecimal(1999, -2)}}
+//
+// Decimal keeps the exponent, so 19.90 stays 19.90.
+// Decimal fields accept doubles and integers as well, doubles are converted
+// using their shortest representation: 19.99 -> 19.99, not 19.989999999999998.
+//
+// WithFloat32Shortest fixes float32 values without changing the types:
+// float32(1.4) is stored as the double 1.4 instead of 1.399999976158142,
+// and such doubles can be decoded back into float32 fields.
+
+// ErrDecimalRange is returned if a number can't be represented as Decimal128
+var ErrDecimalRange = errors.New("number is out of decimal128 range")
+
+var (
+	tDecimal = reflect.TypeOf(Decimal{})
+	tBigRat  = reflect.TypeOf(&big.Rat{})
+)
+
+// Decimal is an exact decimal number coef * 10^exp, the zero value is 0
+type Decimal struct {
+	coef *big.Int
+	exp  int
+}
+
+// NewDecimal returns coef * 10^exp: NewDecimal(1999, -2) is 19.99
+func NewDecimal(coef int64, exp int) Decimal {
+	return Decimal{coef: big.NewInt(coef), exp: exp}
+}
+
+// ParseDecimal parses decimal strings like "19.99", "-1.5E+3"
+func ParseDecimal(s string) (Decimal, error) {
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		return Decimal{}, err
+	}
+	return DecimalFromDecimal128(d)
+}
+
+// DecimalFromDecimal128 converts d to Decimal, NaN and infinity return an error
+func DecimalFromDecimal128(d primitive.Decimal128) (Decimal, error) {
+	coef, exp, err := d.BigInt()
+	if err != nil {
+		return Decimal{}, fmt.Errorf("can't convert %v to Decimal: %w", d, err)
+	}
+	return Decimal{coef: coef, exp: exp}, nil
+}
+
+// DecimalFromRat converts r to Decimal if it's a finite decimal fraction, 1/4 is 0.25, 1/3 returns an error
+func DecimalFromRat(r *big.Rat) (Decimal, error) {
+	denom := new(big.Int).Set(r.Denom())
+	twos := removeFactor(denom, 2)
+	fives := removeFactor(denom, 5)
+	if denom.Cmp(big.NewInt(1)) != 0 {
+		return Decimal{}, fmt.Errorf("%v is not a finite decimal fraction", r.RatString())
+	}
+
+	exp := twos
+	if fives > exp {
+		exp = fives
+	}
+	coef := new(big.Int).Mul(r.Num(), pow10(exp))
+	coef.Quo(coef, r.Denom())
+	return Decimal{coef: coef, exp: -exp}, nil
+}
+
+// removeFactor divides n by f while it's divisible and returns the number of divisions
+func removeFactor(n *big.Int, f int64) int {
+	bf := big.NewInt(f)
+	var q, m big.Int
+	cnt := 0
+	for {
+		q.QuoRem(n, bf, &m)
+		if m.Sign() != 0 {
+			return cnt
+		}
+		n.Set(&q)
+		cnt++
+	}
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// decimalFromFloat converts f using its shortest representation
+func decimalFromFloat(f float64, bitSize int) (Decimal, error) {
+	return ParseDecimal(strconv.FormatFloat(f, 'g', -1, bitSize))
+}
+
+func (d Decimal) coefficient() *big.Int {
+	if d.coef == nil {
+		return new(big.Int)
+	}
+	return d.coef
+}
+
+// Rat returns the exact value of d
+func (d Decimal) Rat() *big.Rat {
+	r := new(big.Rat).SetInt(d.coefficient())
+	if d.exp >= 0 {
+		return r.Mul(r, new(big.Rat).SetInt(pow10(d.exp)))
+	}
+	return r.Quo(r, new(big.Rat).SetInt(pow10(-d.exp)))
+}
+
+// Cmp compares d and o by value: 19.9 and 19.90 are equal
+func (d Decimal) Cmp(o Decimal) int {
+	return d.Rat().Cmp(o.Rat())
+}
+
+// Decimal128 converts d to primitive.Decimal128
+func (d Decimal) Decimal128() (primitive.Decimal128, error) {
+	res, ok := primitive.ParseDecimal128FromBigInt(d.coefficient(), d.exp)
+	if !ok {
+		return primitive.Decimal128{}, fmt.Errorf("%v: %w", d, ErrDecimalRange)
+	}
+	return res, nil
+}
+
+// String returns d in plain notation keeping trailing zeros: "19.90", "-0.05", "1500"
+func (d Decimal) String() string {
+	s := d.coefficient().String()
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	switch {
+	case d.exp > 0:
+		s += strings.Repeat("0", d.exp)
+	case d.exp < 0:
+		n := -d.exp
+		if len(s) <= n {
+			s = strings.Repeat("0", n-len(s)+1) + s
+		}
+		s = s[:len(s)-n] + "." + s[len(s)-n:]
+	}
+
+	if neg {
+		return "-" + s
+	}
+	return s
+}
+
+// WithDecimal encodes Decimal and *big.Rat as Decimal128
+// and decodes Decimal128 found in interface{} as Decimal
+func WithDecimal() RegistryOption {
+	return func(c *registryConfig) {
+		c.typeMap[bsontype.Decimal128] = tDecimal
+		c.encoders[tDecimal] = bsoncodec.ValueEncoderFunc(decimalEncodeValue)
+		c.decoders[tDecimal] = bsoncodec.ValueDecoderFunc(decimalDecodeValue)
+		c.encoders[tBigRat] = bsoncodec.ValueEncoderFunc(bigRatEncodeValue)
+		c.decoders[tBigRat] = bsoncodec.ValueDecoderFunc(bigRatDecodeValue)
+	}
+}
+
+// WithFloat32Shortest encodes float32 values as doubles parsed from their shortest representation
+func WithFloat32Shortest() RegistryOption {
+	return func(c *registryConfig) {
+		c.kindEncoders[reflect.Float32] = bsoncodec.ValueEncoderFunc(float32EncodeValue)
+		c.kindDecoders[reflect.Float32] = bsoncodec.ValueDecoderFunc(float32DecodeValue)
+	}
+}
+
+func decimalEncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tDecimal {
+		return bsoncodec.ValueEncoderError{Name: "DecimalEncodeValue", Types: []reflect.Type{tDecimal}, Received: val}
+	}
+	d, err := val.Interface().(Decimal).Decimal128()
+	if err != nil {
+		return err
+	}
+	return vw.WriteDecimal128(d)
+}
+
+func decimalDecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tDecimal {
+		return bsoncodec.ValueDecoderError{Name: "DecimalDecodeValue", Types: []reflect.Type{tDecimal}, Received: val}
+	}
+	d, err := readDecimal(vr)
+	if err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(d))
+	return nil
+}
+
+func readDecimal(vr bsonrw.ValueReader) (Decimal, error) {
+	switch vt := vr.Type(); vt {
+	case bsontype.Decimal128:
+		d, err := vr.ReadDecimal128()
+		if err != nil {
+			return Decimal{}, err
+		}
+		return DecimalFromDecimal128(d)
+	case bsontype.Double:
+		f, err := vr.ReadDouble()
+		if err != nil {
+			return Decimal{}, err
+		}
+		return decimalFromFloat(f, 64)
+	case bsontype.Int32, bsontype.Int64:
+		i, err := readInteger(vr)
+		if err != nil {
+			return Decimal{}, err
+		}
+		return NewDecimal(i, 0), nil
+	case bsontype.String:
+		s, err := vr.ReadString()
+		if err != nil {
+			return Decimal{}, err
+		}
+		return ParseDecimal(s)
+	case bsontype.Null:
+		return Decimal{}, vr.ReadNull()
+	case bsontype.Undefined:
+		return Decimal{}, vr.ReadUndefined()
+	default:
+		return Decimal{}, fmt.Errorf("cannot decode %v into a Decimal", vt)
+	}
+}
+
+func bigRatEncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tBigRat {
+		return bsoncodec.ValueEncoderError{Name: "BigRatEncodeValue", Types: []reflect.Type{tBigRat}, Received: val}
+	}
+	if val.IsNil() {
+		return vw.WriteNull()
+	}
+	d, err := DecimalFromRat(val.Interface().(*big.Rat))
+	if err != nil {
+		return err
+	}
+	return decimalEncodeValue(ec, vw, reflect.ValueOf(d))
+}
+
+func bigRatDecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tBigRat {
+		return bsoncodec.ValueDecoderError{Name: "BigRatDecodeValue", Types: []reflect.Type{tBigRat}, Received: val}
+	}
+	if vr.Type() == bsontype.Null {
+		val.Set(reflect.Zero(tBigRat))
+		return vr.ReadNull()
+	}
+	d, err := readDecimal(vr)
+	if err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(d.Rat()))
+	return nil
+}
+
+// shortestFloat32 returns the double parsed from the shortest representation of f
+func shortestFloat32(f float32) float64 {
+	res, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	return res
+}
+
+func float32EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Kind() != reflect.Float32 {
+		return bsoncodec.ValueEncoderError{Name: "Float32EncodeValue", Kinds: []reflect.Kind{reflect.Float32}, Received: val}
+	}
+	return vw.WriteDouble(shortestFloat32(float32(val.Float())))
+}
+
+// float32DecodeValue accepts doubles written by float32EncodeValue in addition to the default rules
+func float32DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if vr.Type() != bsontype.Double {
+		return bsoncodec.DefaultValueDecoders{}.FloatDecodeValue(dc, vr, val)
+	}
+	if !val.CanSet() || val.Kind() != reflect.Float32 {
+		return bsoncodec.ValueDecoderError{Name: "Float32DecodeValue", Kinds: []reflect.Kind{reflect.Float32}, Received: val}
+	}
+
+	f, err := vr.ReadDouble()
+	if err != nil {
+		return err
+	}
+	f32 := float32(f)
+	if !dc.Truncate && float64(f32) != f && shortestFloat32(f32) != f {
+		return fmt.Errorf("%v can't be decoded into a float32 without truncation", f)
+	}
+	val.SetFloat(float64(f32))
+	return nil
+}
@@ -0,0 +1,101 @@
+package mongodb_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+type price struct {
+	Amount   mongodb.Decimal `bson:"amount"`
+	Discount *big.Rat        `bson:"discount"`
+	Rate     float32         `bson:"rate"`
+}
+
+func TestDecimalRoundTrip(t *testing.T) {
+	reg := mongodb.NewRegistry(mongodb.WithDecimal(), mongodb.WithFloat32Shortest())
+	written := price{Amount: mongodb.NewDecimal(1990, -2), Discount: big.NewRat(1, 4), Rate: 1.4}
+
+	raw, err := bson.MarshalWithRegistry(reg, written)
+	assert.Nil(t, err)
+	assert.Equal(t, bsontype.Decimal128, bson.Raw(raw).Lookup("amount").Type)
+	assert.Equal(t, bsontype.Decimal128, bson.Raw(raw).Lookup("discount").Type)
+	assert.Equal(t, 1.4, bson.Raw(raw).Lookup("rate").Double())
+
+	var res price
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.Nil(t, err)
+	assert.Equal(t, "19.90", res.Amount.String())
+	assert.Equal(t, 0, big.NewRat(1, 4).Cmp(res.Discount))
+	assert.Equal(t, float32(1.4), res.Rate)
+
+	var data map[string]interface{}
+	err = bson.UnmarshalWithRegistry(reg, raw, &data)
+	assert.Nil(t, err)
+	assert.Equal(t, written.Amount, data["amount"])
+	assert.Equal(t, 1.4, data["rate"])
+
+	_, err = bson.MarshalWithRegistry(reg, price{Discount: big.NewRat(1, 3)})
+	assert.NotNil(t, err)
+}
+
+func TestDecimalDecoding(t *testing.T) {
+	tt := []struct {
+		name     string
+		stored   interface{}
+		expected string
+		isErr    bool
+	}{
+		{"double", 19.99, "19.99", false},
+		{"int32", int32(20), "20", false},
+		{"int64", int64(-5), "-5", false},
+		{"string", "0.05", "0.05", false},
+		{"null", nil, "0", false},
+		{"not a number", "abc", "0", true},
+		{"bool", true, "0", true},
+	}
+
+	reg := mongodb.NewRegistry(mongodb.WithDecimal())
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				raw, err := bson.Marshal(bson.M{"amount": tc.stored})
+				assert.Nil(t, err)
+
+				var res price
+				err = bson.UnmarshalWithRegistry(reg, raw, &res)
+				assert.Equal(t, tc.isErr, err != nil, err)
+				assert.Equal(t, tc.expected, res.Amount.String())
+			},
+		)
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	d, err := mongodb.ParseDecimal("-1.5E+3")
+	assert.Nil(t, err)
+	assert.Equal(t, "-1500", d.String())
+	assert.Equal(t, 0, d.Cmp(mongodb.NewDecimal(-15000, -1)))
+	assert.Equal(t, "0.005", mongodb.NewDecimal(5, -3).String())
+	assert.Equal(t, 1, mongodb.NewDecimal(1, 0).Cmp(mongodb.Decimal{}))
+
+	d, err = mongodb.DecimalFromRat(big.NewRat(-3, 8))
+	assert.Nil(t, err)
+	assert.Equal(t, "-0.375", d.String())
+
+	_, err = mongodb.NewDecimal(1, 7000).Decimal128()
+	assert.ErrorIs(t, err, mongodb.ErrDecimalRange)
+
+	bag := mongodb.Bag{"price": 19.99, "count": 3, "amount": d}
+	for key, expected := range map[string]string{"price": "19.99", "count": "3", "amount": "-0.375"} {
+		res, err := bag.Decimal(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res.String())
+	}
+}
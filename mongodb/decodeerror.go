@@ -0,0 +1,194 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Field path-aware decode errors
+//
+// Problem description:
+// the driver reports only BSON keys of the failed field, and loses them
+// when an error is wrapped by a custom decoder on the way up, e.g.:
+//
+// error decoding key data.map[string]interface - with nested types.1: can't decode kind flat: error decoding key date: ...
+//
+// Unmarshal works as bson.UnmarshalWithRegistry, but returns *DecodeError
+// with the whole path in terms of Go types:
+//
+// Data."map[string]interface - with nested types".1.Date
+//
+// Struct fields are named by their Go names, map keys and array indexes are used as is,
+// keys which aren't Go identifiers are quoted.
+// Inside interface{} values Go field names are known only for documents with a _kind of the registry (see WithKind),
+// otherwise BSON keys are used.
+//
+// var decErr *mongodb.DecodeError
+// if errors.As(err, &decErr) {
+// 		log.Printf("bad document: %v, stored %v, expected %v", decErr.Path, decErr.BSONType, decErr.GoType)
+// }
+
+// DecodeError describes the field which failed to decode
+type DecodeError struct {
+	// Path to the field with Go names of struct fields
+	Path string
+	// Keys are BSON keys of the field
+	Keys []string
+	// BSONType of the stored value
+	BSONType bsontype.Type
+	// GoType is the type the value was decoded into, nil if it's unknown
+	GoType reflect.Type
+	// Err is the underlying error without the driver key wrappers
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	goType := "interface {}"
+	if e.GoType != nil {
+		goType = e.GoType.String()
+	}
+	return fmt.Sprintf("can't decode %v (%v) into %v: %v", e.Path, e.BSONType, goType, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Unmarshal decodes data into v with registry,
+// errors of nested fields are returned as *DecodeError
+func Unmarshal(registry *bsoncodec.Registry, data []byte, v interface{}) error {
+	err := bson.UnmarshalWithRegistry(registry, data, v)
+	if err == nil {
+		return nil
+	}
+
+	keys, cause := decodeErrorKeys(err)
+	if len(keys) == 0 {
+		return err
+	}
+
+	path, goType := goPath(bson.Raw(data), reflect.TypeOf(v), keys, registryKinds(registry))
+	return &DecodeError{
+		Path:     path,
+		Keys:     keys,
+		BSONType: bson.Raw(data).Lookup(keys...).Type,
+		GoType:   goType,
+		Err:      cause,
+	}
+}
+
+// decodeErrorKeys collects keys of all driver DecodeErrors in the chain,
+// a chain has more than one DecodeError when a custom decoder wraps an error of a nested value
+func decodeErrorKeys(err error) ([]string, error) {
+	var keys []string
+	for {
+		var de *bsoncodec.DecodeError
+		if !errors.As(err, &de) {
+			return keys, err
+		}
+		keys = append(keys, de.Keys()...)
+		err = de.Unwrap()
+	}
+}
+
+// registryKinds returns the kinds the registry decodes in interface{} positions, nil if it doesn't
+func registryKinds(registry *bsoncodec.Registry) map[string]reflect.Type {
+	dec, err := registry.LookupDecoder(tEmpty)
+	if err != nil {
+		return nil
+	}
+	if kd, ok := dec.(*kindDecoder); ok {
+		return kd.kinds
+	}
+	return nil
+}
+
+// goPath converts BSON keys to the path of Go names starting from t
+// and returns the Go type of the last key, documents with _kind are resolved with kinds
+func goPath(doc bson.Raw, t reflect.Type, keys []string, kinds map[string]reflect.Type) (string, reflect.Type) {
+	segments := make([]string, 0, len(keys))
+	for i, key := range keys {
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t != nil && t.Kind() == reflect.Interface {
+			if kt := kindType(doc.Lookup(keys[:i]...), kinds); kt != nil {
+				t = kt
+			}
+		}
+
+		segment := key
+		switch {
+		case t == nil:
+		case t.Kind() == reflect.Struct:
+			var f reflect.StructField
+			if f, t = structField(t, key); t != nil {
+				segment = f.Name
+			}
+		case t.Kind() == reflect.Map, t.Kind() == reflect.Slice, t.Kind() == reflect.Array:
+			t = t.Elem()
+		case t.Kind() == reflect.Interface:
+			// nested documents and arrays of interface{} have interface{} values as well
+		default:
+			t = nil
+		}
+		segments = append(segments, quoteSegment(segment))
+	}
+	return strings.Join(segments, "."), t
+}
+
+// kindType returns the type of kinds for _kind of v or nil
+func kindType(v bson.RawValue, kinds map[string]reflect.Type) reflect.Type {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil
+	}
+	name, ok := doc.Lookup(KindKey).StringValueOK()
+	if !ok {
+		return nil
+	}
+	return kinds[name]
+}
+
+// structField finds the field of t with BSON name key, fields of inline structs are searched as well
+func structField(t reflect.Type, key string) (reflect.StructField, reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tags, err := bsoncodec.DefaultStructTagParser.ParseStructTags(f)
+		if err != nil || tags.Skip {
+			continue
+		}
+		if tags.Inline && f.Type.Kind() == reflect.Struct {
+			if inner, ft := structField(f.Type, key); ft != nil {
+				return inner, ft
+			}
+			continue
+		}
+		if tags.Name == key {
+			return f, f.Type
+		}
+	}
+	return reflect.StructField{}, nil
+}
+
+func quoteSegment(s string) string {
+	if s == "" {
+		return strconv.Quote(s)
+	}
+	for _, r := range s {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
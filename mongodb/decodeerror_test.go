@@ -0,0 +1,134 @@
+package mongodb_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+type scoreboard struct {
+	Scores map[string][]int `bson:"scores"`
+}
+
+func TestUnmarshalDecodeError(t *testing.T) {
+	tt := []struct {
+		name     string
+		stored   bson.M
+		reg      []mongodb.RegistryOption
+		target   interface{}
+		path     string
+		bsonType bsontype.Type
+		goType   reflect.Type
+	}{
+		{
+			"struct field",
+			bson.M{"id": "1", "date": true},
+			nil,
+			&mongodb.CustomFlatStructure{},
+			"Date",
+			bsontype.Boolean,
+			reflect.TypeOf(time.Time{}),
+		},
+		{
+			"kind inside map",
+			bson.M{
+				"id": "1",
+				"data": bson.M{
+					"map[string]interface - with nested types": bson.M{
+						"1": bson.D{{Key: "_kind", Value: "flat"}, {Key: "id", Value: "1"}, {Key: "date", Value: true}},
+					},
+				},
+			},
+			[]mongodb.RegistryOption{mongodb.WithKind("flat", mongodb.CustomFlatStructure{})},
+			&mongodb.CustomNestedMapStruct{},
+			`Data."map[string]interface - with nested types".1.Date`,
+			bsontype.Boolean,
+			reflect.TypeOf(time.Time{}),
+		},
+		{
+			"kind which isn't enabled in the registry",
+			bson.M{
+				"id": "1",
+				"data": bson.M{
+					"1": bson.D{{Key: "_kind", Value: "flat"}, {Key: "id", Value: "1"}, {Key: "date", Value: bson.M{"_kind": "uint16", "value": "x"}}},
+				},
+			},
+			[]mongodb.RegistryOption{mongodb.WithUints(mongodb.UintAsKind)},
+			&mongodb.CustomNestedMapStruct{},
+			"Data.1.date",
+			bsontype.EmbeddedDocument,
+			reflect.TypeOf((*interface{})(nil)).Elem(),
+		},
+		{
+			"map of slices",
+			bson.M{"scores": bson.M{"x y": bson.A{1, "a"}}},
+			nil,
+			&scoreboard{},
+			`Scores."x y".1`,
+			bsontype.String,
+			reflect.TypeOf(0),
+		},
+		{
+			"array element",
+			bson.M{"coords": bson.A{1.0, "two", 3.0}},
+			[]mongodb.RegistryOption{mongodb.WithArrays(mongodb.ArrayStrict)},
+			&point{},
+			"Coords.1",
+			bsontype.String,
+			reflect.TypeOf(0.0),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				raw, err := bson.Marshal(tc.stored)
+				assert.Nil(t, err)
+
+				err = mongodb.Unmarshal(mongodb.NewRegistry(tc.reg...), raw, tc.target)
+
+				var decErr *mongodb.DecodeError
+				assert.True(t, errors.As(err, &decErr), err)
+				assert.Equal(t, tc.path, decErr.Path)
+				assert.Equal(t, tc.bsonType, decErr.BSONType)
+				assert.Equal(t, tc.goType, decErr.GoType)
+				assert.NotNil(t, decErr.Err)
+			},
+		)
+	}
+}
+
+func TestUnmarshalKeepsCause(t *testing.T) {
+	raw, err := bson.Marshal(bson.M{"coords": bson.A{1.0}})
+	assert.Nil(t, err)
+
+	err = mongodb.Unmarshal(mongodb.NewRegistry(mongodb.WithArrays(mongodb.ArrayStrict)), raw, &point{})
+
+	var lengthErr *mongodb.ArrayLengthError
+	assert.True(t, errors.As(err, &lengthErr))
+	assert.Contains(t, err.Error(), "Coords")
+}
+
+func TestRepositoryDecodeError(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+	_, err := c.InsertOne(ctx, bson.M{"id": "1", "date": "not a date"})
+	assert.Nil(t, err)
+
+	repo := mongodb.NewRepository[mongodb.CustomFlatStructure](c, mongodb.WithRepositoryRegistry(mongodb.NewRegistry()))
+	_, err = repo.FindByID(ctx, "1")
+
+	var decErr *mongodb.DecodeError
+	assert.True(t, errors.As(err, &decErr))
+	assert.Equal(t, "Date", decErr.Path)
+	assert.Equal(t, bsontype.String, decErr.BSONType)
+}
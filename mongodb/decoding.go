@@ -3,14 +3,10 @@ package mongodb
 import (
 	"context"
 	"fmt"
-	"reflect"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsoncodec"
-	"go.mongodb.org/mongo-driver/bson/bsontype"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Configure custom type mapping for map[string]interface{}
@@ -38,7 +34,7 @@ import (
 //
 // To fix this, you need to register TypeMapEntry
 //
-// Look at customRegistry
+// Look at customRegistry, and NewRegistry in registry.go for the rest of the mappings
 
 type CustomNestedMapStruct struct {
 	ID   string
@@ -46,25 +42,48 @@ type CustomNestedMapStruct struct {
 }
 
 type CustomFlatStructure struct {
+	ID   string    `mongoidx:"unique"`
+	Date time.Time `mongoidx:"ttl=720h"`
+}
+
+// FidelityNestedMapStruct is the same as CustomNestedMapStruct
+// but keeps Go types of the Data values, look at fidelity.go
+type FidelityNestedMapStruct struct {
 	ID   string
-	Date time.Time
+	Data FidelityMap
+}
+
+// defaultClients keeps connections of the Exec* functions, use CloseClients to disconnect them
+var defaultClients = NewClientManager()
+
+// CloseClients disconnects all clients opened by the Exec* functions
+func CloseClients(ctx context.Context) error {
+	return defaultClients.Close(ctx)
 }
 
 func ExecWithNestedMapDefaultMapType(conStr string, db string, coll string, id_postfix string) (CustomNestedMapStruct, error) {
-	con, err := getConnection(conStr)
+	return ExecWithNestedMapDefaultMapTypeContext(context.Background(), conStr, db, coll, id_postfix)
+}
+
+func ExecWithNestedMapDefaultMapTypeContext(ctx context.Context, conStr string, db string, coll string, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	con, err := defaultClients.Client(ctx, conStr)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
 
 	c := con.Database(db).Collection(coll)
 
+	return ExecWithNestedMapDefaultMapTypeOnCollection(ctx, c, id_postfix, opts...)
+}
+
+func ExecWithNestedMapDefaultMapTypeOnCollection(ctx context.Context, c Collection, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
 	id := fmt.Sprintf("nested_%v", id_postfix)
 
-	err = insertNested(c, id)
+	err := insertNested(ctx, c, id, opts...)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
-	res, err := readNestedDefault(c, id)
+	res, err := readNestedDefault(ctx, c, id, opts...)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
@@ -72,20 +91,28 @@ func ExecWithNestedMapDefaultMapType(conStr string, db string, coll string, id_p
 }
 
 func ExecWithNestedMapAllTypes(conStr string, db string, coll string, id_postfix string) (CustomNestedMapStruct, error) {
-	con, err := getConnection(conStr)
+	return ExecWithNestedMapAllTypesContext(context.Background(), conStr, db, coll, id_postfix)
+}
+
+func ExecWithNestedMapAllTypesContext(ctx context.Context, conStr string, db string, coll string, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	con, err := defaultClients.Client(ctx, conStr)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
 
-	id := fmt.Sprintf("rich_nested_%v", id_postfix)
-
 	c := con.Database(db).Collection(coll)
 
-	err = insertNestedAllTypes(c, id)
+	return ExecWithNestedMapAllTypesOnCollection(ctx, c, id_postfix, opts...)
+}
+
+func ExecWithNestedMapAllTypesOnCollection(ctx context.Context, c Collection, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	id := fmt.Sprintf("rich_nested_%v", id_postfix)
+
+	err := insertNestedAllTypes(ctx, c, id, opts...)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
-	res, err := readNestedDefault(c, id)
+	res, err := readNestedDefault(ctx, c, id, opts...)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
@@ -93,23 +120,65 @@ func ExecWithNestedMapAllTypes(conStr string, db string, coll string, id_postfix
 }
 
 func ExecWithNestedMapAllTypesCustomRegister(conStr string, db string, coll string, id_postfix string) (CustomNestedMapStruct, error) {
-	con, err := getConnection(conStr)
+	return ExecWithNestedMapAllTypesCustomRegisterContext(context.Background(), conStr, db, coll, id_postfix)
+}
+
+func ExecWithNestedMapAllTypesCustomRegisterContext(ctx context.Context, conStr string, db string, coll string, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	con, err := defaultClients.Client(ctx, conStr)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
 
+	c := con.Database(db).Collection(coll)
+
+	return ExecWithNestedMapAllTypesCustomRegisterOnCollection(ctx, c, id_postfix, opts...)
+}
+
+func ExecWithNestedMapAllTypesCustomRegisterOnCollection(ctx context.Context, c Collection, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
 	id := fmt.Sprintf("rich_nested_%v", id_postfix)
 
-	c := con.Database(db).Collection(coll)
+	err := insertNestedAllTypes(ctx, c, id, opts...)
+	if err != nil {
+		return CustomNestedMapStruct{}, err
+	}
+
+	reg := customRegistry()
+
+	res, err := readNestedWithCustomMapType(ctx, c, reg, id, opts...)
+	if err != nil {
+		return CustomNestedMapStruct{}, err
+	}
+	return res, nil
+}
+
+func ExecWithNestedMapCustomTypes(conStr string, db string, coll string, id_postfix string) (CustomNestedMapStruct, error) {
+	return ExecWithNestedMapCustomTypesContext(context.Background(), conStr, db, coll, id_postfix)
+}
 
-	err = insertNestedAllTypes(c, id)
+func ExecWithNestedMapCustomTypesContext(ctx context.Context, conStr string, db string, coll string, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	con, err := defaultClients.Client(ctx, conStr)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
 
+	c := con.Database(db).Collection(coll)
+
+	return ExecWithNestedMapCustomTypesOnCollection(ctx, c, id_postfix, opts...)
+}
+
+// ExecWithNestedMapCustomTypesOnCollection stores customTypesData, e.g. complex numbers,
+// so both encoding and decoding need customRegistry
+func ExecWithNestedMapCustomTypesOnCollection(ctx context.Context, c Collection, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	id := fmt.Sprintf("custom_nested_%v", id_postfix)
+
 	reg := customRegistry()
 
-	res, err := readNestedWithCustomMapType(c, reg, id)
+	err := insertNestedAllTypesWithRegistry(ctx, c, reg, id, opts...)
+	if err != nil {
+		return CustomNestedMapStruct{}, err
+	}
+
+	res, err := readNestedWithCustomMapType(ctx, c, reg, id, opts...)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
@@ -117,51 +186,134 @@ func ExecWithNestedMapAllTypesCustomRegister(conStr string, db string, coll stri
 }
 
 func ExecWithNestedMapCustomMapType(conStr string, db string, coll string, id_postfix string) (CustomNestedMapStruct, error) {
-	con, err := getConnection(conStr)
+	return ExecWithNestedMapCustomMapTypeContext(context.Background(), conStr, db, coll, id_postfix)
+}
+
+func ExecWithNestedMapCustomMapTypeContext(ctx context.Context, conStr string, db string, coll string, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	con, err := defaultClients.Client(ctx, conStr)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
 
 	c := con.Database(db).Collection(coll)
 
+	return ExecWithNestedMapCustomMapTypeOnCollection(ctx, c, id_postfix, opts...)
+}
+
+func ExecWithNestedMapCustomMapTypeOnCollection(ctx context.Context, c Collection, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
 	id := fmt.Sprintf("nested_%v", id_postfix)
 
-	err = insertNested(c, id)
+	err := insertNested(ctx, c, id, opts...)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
 
 	reg := customRegistry()
 
-	res, err := readNestedWithCustomMapType(c, reg, id)
+	res, err := readNestedWithCustomMapType(ctx, c, reg, id, opts...)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
 	return res, nil
 }
 
-func ExecWithFlat(conStr, db string, coll string, id_postfix string) (CustomFlatStructure, error) {
-	con, err := getConnection(conStr)
+func ExecWithFidelityMap(conStr string, db string, coll string, id_postfix string) (FidelityNestedMapStruct, error) {
+	return ExecWithFidelityMapContext(context.Background(), conStr, db, coll, id_postfix)
+}
+
+func ExecWithFidelityMapContext(ctx context.Context, conStr string, db string, coll string, id_postfix string, opts ...OpOption) (FidelityNestedMapStruct, error) {
+	con, err := defaultClients.Client(ctx, conStr)
+	if err != nil {
+		return FidelityNestedMapStruct{}, err
+	}
+
+	c := con.Database(db).Collection(coll)
+
+	return ExecWithFidelityMapOnCollection(ctx, c, id_postfix, opts...)
+}
+
+func ExecWithFidelityMapOnCollection(ctx context.Context, c Collection, id_postfix string, opts ...OpOption) (FidelityNestedMapStruct, error) {
+	id := fmt.Sprintf("fidelity_nested_%v", id_postfix)
+
+	reg := fidelityRegistry()
+
+	err := insertFidelityAllTypes(ctx, c, reg, id, opts...)
+	if err != nil {
+		return FidelityNestedMapStruct{}, err
+	}
+
+	res, err := readFidelity(ctx, c, reg, id, opts...)
+	if err != nil {
+		return FidelityNestedMapStruct{}, err
+	}
+	return res, nil
+}
+
+func ExecWithNestedMapKinds(conStr string, db string, coll string, id_postfix string) (CustomNestedMapStruct, error) {
+	return ExecWithNestedMapKindsContext(context.Background(), conStr, db, coll, id_postfix)
+}
+
+func ExecWithNestedMapKindsContext(ctx context.Context, conStr string, db string, coll string, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	con, err := defaultClients.Client(ctx, conStr)
+	if err != nil {
+		return CustomNestedMapStruct{}, err
+	}
+
+	c := con.Database(db).Collection(coll)
+
+	return ExecWithNestedMapKindsOnCollection(ctx, c, id_postfix, opts...)
+}
+
+func ExecWithNestedMapKindsOnCollection(ctx context.Context, c Collection, id_postfix string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	id := fmt.Sprintf("kinds_nested_%v", id_postfix)
+
+	reg := kindsRegistry()
+
+	err := insertNestedAllTypesWithRegistry(ctx, c, reg, id, opts...)
+	if err != nil {
+		return CustomNestedMapStruct{}, err
+	}
+
+	res, err := readNestedWithCustomMapType(ctx, c, reg, id, opts...)
+	if err != nil {
+		return CustomNestedMapStruct{}, err
+	}
+	return res, nil
+}
+
+func ExecWithFlat(conStr string, db string, coll string, id_postfix string) (CustomFlatStructure, error) {
+	return ExecWithFlatContext(context.Background(), conStr, db, coll, id_postfix)
+}
+
+func ExecWithFlatContext(ctx context.Context, conStr string, db string, coll string, id_postfix string, opts ...OpOption) (CustomFlatStructure, error) {
+	con, err := defaultClients.Client(ctx, conStr)
 	if err != nil {
 		return CustomFlatStructure{}, err
 	}
 
 	c := con.Database(db).Collection(coll)
 
+	return ExecWithFlatOnCollection(ctx, c, id_postfix, opts...)
+}
+
+func ExecWithFlatOnCollection(ctx context.Context, c Collection, id_postfix string, opts ...OpOption) (CustomFlatStructure, error) {
 	id := fmt.Sprintf("flat_%v", id_postfix)
 
-	err = insertFlat(c, id)
+	err := insertFlat(ctx, c, id, opts...)
 	if err != nil {
 		return CustomFlatStructure{}, err
 	}
-	res, err := readFlat(c, id)
+	res, err := readFlat(ctx, c, id, opts...)
 	if err != nil {
 		return CustomFlatStructure{}, err
 	}
 	return res, nil
 }
 
-func insertNested(c *mongo.Collection, id string) error {
+func insertNested(ctx context.Context, c Collection, id string, opts ...OpOption) error {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
+
 	doc := CustomNestedMapStruct{
 		ID: id,
 		Data: map[string]interface{}{
@@ -170,49 +322,24 @@ func insertNested(c *mongo.Collection, id string) error {
 	}
 
 	_, err := c.InsertOne(
-		context.Background(),
+		ctx,
 		doc,
 		nil,
 	)
 	return err
 }
 
-func insertNestedAllTypes(c *mongo.Collection, id string) error {
-	now := time.Now()
+func insertNestedAllTypes(ctx context.Context, c Collection, id string, opts ...OpOption) error {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
+
 	doc := CustomNestedMapStruct{
-		ID: id,
-		Data: map[string]interface{}{
-			"int8":    int8(1),
-			"int16":   int16(2),
-			"int32":   int32(3),
-			"int64":   int64(4),
-			"int":     int(5),
-			"uint8":   uint8(6),
-			"uint16":  uint16(7),
-			"uint32":  uint32(8),
-			"uint64":  uint64(9),
-			"uint":    uint(10),
-			"float32": float32(1.4),
-			"float64": float64(2.3),
-			"bool":    true,
-			// "complex64":                        complex64(complex(1, 1)),
-			// "complex128":                       complex128(complex(1, 1)),
-			"string":                           "some string",
-			"byte":                             byte(11),
-			"rune":                             rune(12),
-			"array":                            [3]int{1, 2, 3},
-			"slice":                            []int{1, 2, 3},
-			"time.Time":                        time.Now(),
-			"map[string]string":                map[string]string{"1": "11", "2": "22"},
-			"map[string]interface - primitive": map[string]interface{}{"1": 1, "2": 3.5, "3": true},
-			"struct":                           CustomFlatStructure{"1", time.Now()},
-			"map[string]interface - with nested types": map[string]interface{}{"1": CustomFlatStructure{"1", time.Now()}},
-			"time.Time pointer":                        &now,
-		},
+		ID:   id,
+		Data: allTypesData(),
 	}
 
 	_, err := c.InsertOne(
-		context.Background(),
+		ctx,
 		doc,
 		nil,
 	)
@@ -220,14 +347,61 @@ func insertNestedAllTypes(c *mongo.Collection, id string) error {
 	return err
 }
 
-func readNestedDefault(c *mongo.Collection, id string) (CustomNestedMapStruct, error) {
+// AllTypesDecodeReport shows what happens with every value of insertNestedAllTypes
+// when it's decoded with the default registry and with customRegistry
+func AllTypesDecodeReport() (*DecodeReport, error) {
+	return NewDecodeReport(customTypesData(), customRegistry())
+}
+
+// customTypesData is allTypesData with values which can be encoded only with custom registries
+func customTypesData() map[string]interface{} {
+	data := allTypesData()
+	data["complex64"] = complex64(complex(1, 1))
+	data["complex128"] = complex128(complex(1, 1))
+	data["decimal"] = NewDecimal(1999, -2)
+	return data
+}
+
+func allTypesData() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"int8":    int8(1),
+		"int16":   int16(2),
+		"int32":   int32(3),
+		"int64":   int64(4),
+		"int":     int(5),
+		"uint8":   uint8(6),
+		"uint16":  uint16(7),
+		"uint32":  uint32(8),
+		"uint64":  uint64(9),
+		"uint":    uint(10),
+		"float32": float32(1.4),
+		"float64": float64(2.3),
+		"bool":    true,
+		// complex64 and complex128 can't be encoded by the default registry, look at customTypesData
+		"string":                           "some string",
+		"byte":                             byte(11),
+		"rune":                             rune(12),
+		"array":                            [3]int{1, 2, 3},
+		"slice":                            []int{1, 2, 3},
+		"time.Time":                        time.Now(),
+		"map[string]string":                map[string]string{"1": "11", "2": "22"},
+		"map[string]interface - primitive": map[string]interface{}{"1": 1, "2": 3.5, "3": true},
+		"struct":                           CustomFlatStructure{"1", time.Now()},
+		"map[string]interface - with nested types": map[string]interface{}{"1": CustomFlatStructure{"1", time.Now()}},
+		"time.Time pointer":                        &now,
+	}
+}
+
+func readNestedDefault(ctx context.Context, c Collection, id string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
+
 	var res CustomNestedMapStruct
 
 	err := c.FindOne(
-		context.Background(),
-		primitive.M{
-			"id": id,
-		},
+		ctx,
+		Validate[CustomNestedMapStruct](Eq("id", id)),
 		nil,
 	).Decode(&res)
 
@@ -239,23 +413,110 @@ func readNestedDefault(c *mongo.Collection, id string) (CustomNestedMapStruct, e
 }
 
 func customRegistry() *bsoncodec.Registry {
-	rb := bsoncodec.NewRegistryBuilder()
+	return NewRegistry(
+		WithDateTimeAsTime(),
+		WithArrayAsSlice(),
+		WithComplex(),
+		WithDecimal(),
+	)
+}
+
+func kindsRegistry() *bsoncodec.Registry {
+	return NewRegistry(
+		WithKind("flat", CustomFlatStructure{}),
+		WithDateTimeAsTime(),
+		WithArrayAsSlice(),
+		WithComplex(),
+		WithDecimal(),
+	)
+}
+
+func insertNestedAllTypesWithRegistry(ctx context.Context, c Collection, registry *bsoncodec.Registry, id string, opts ...OpOption) error {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
 
-	bsoncodec.DefaultValueEncoders{}.RegisterDefaultEncoders(rb)
-	bsoncodec.DefaultValueDecoders{}.RegisterDefaultDecoders(rb)
+	doc := CustomNestedMapStruct{
+		ID:   id,
+		Data: customTypesData(),
+	}
 
-	rb.RegisterTypeMapEntry(bsontype.DateTime, reflect.TypeOf(time.Time{}))
-	rb.RegisterTypeMapEntry(bson.TypeArray, reflect.TypeOf([]interface{}{}))
+	raw, err := bson.MarshalWithRegistry(registry, doc)
+	if err != nil {
+		return err
+	}
 
-	return rb.Build()
+	_, err = c.InsertOne(
+		ctx,
+		bson.Raw(raw),
+		nil,
+	)
+	return err
+}
+
+func fidelityRegistry() *bsoncodec.Registry {
+	return NewRegistry(
+		WithFidelity(CustomFlatStructure{}, Decimal{}),
+		WithComplex(),
+		WithDecimal(),
+	)
+}
+
+func insertFidelityAllTypes(ctx context.Context, c Collection, registry *bsoncodec.Registry, id string, opts ...OpOption) error {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
+
+	doc := FidelityNestedMapStruct{
+		ID:   id,
+		Data: customTypesData(),
+	}
+
+	raw, err := bson.MarshalWithRegistry(registry, doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.InsertOne(
+		ctx,
+		bson.Raw(raw),
+		nil,
+	)
+	return err
 }
 
-func readNestedWithCustomMapType(c *mongo.Collection, registry *bsoncodec.Registry, id string) (CustomNestedMapStruct, error) {
+func readFidelity(ctx context.Context, c Collection, registry *bsoncodec.Registry, id string, opts ...OpOption) (FidelityNestedMapStruct, error) {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
+
 	sr := c.FindOne(
-		context.Background(),
-		primitive.M{
-			"id": id,
-		},
+		ctx,
+		Validate[FidelityNestedMapStruct](Eq("id", id)),
+		nil,
+	)
+
+	if sr.Err() != nil {
+		return FidelityNestedMapStruct{}, sr.Err()
+	}
+
+	raw, err := sr.DecodeBytes()
+	if err != nil {
+		return FidelityNestedMapStruct{}, err
+	}
+
+	var res FidelityNestedMapStruct
+	err = Unmarshal(registry, raw, &res)
+	if err != nil {
+		return FidelityNestedMapStruct{}, err
+	}
+	return res, nil
+}
+
+func readNestedWithCustomMapType(ctx context.Context, c Collection, registry *bsoncodec.Registry, id string, opts ...OpOption) (CustomNestedMapStruct, error) {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
+
+	sr := c.FindOne(
+		ctx,
+		Validate[CustomNestedMapStruct](Eq("id", id)),
 		nil,
 	)
 
@@ -269,35 +530,39 @@ func readNestedWithCustomMapType(c *mongo.Collection, registry *bsoncodec.Regist
 	}
 
 	var res CustomNestedMapStruct
-	err = bson.UnmarshalWithRegistry(registry, raw, &res)
+	err = Unmarshal(registry, raw, &res)
 	if err != nil {
 		return CustomNestedMapStruct{}, err
 	}
 	return res, nil
 }
 
-func insertFlat(c *mongo.Collection, id string) error {
+func insertFlat(ctx context.Context, c Collection, id string, opts ...OpOption) error {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
+
 	doc := CustomFlatStructure{
 		ID:   id,
 		Date: time.Now(),
 	}
 
 	_, err := c.InsertOne(
-		context.Background(),
+		ctx,
 		doc,
 		nil,
 	)
 	return err
 }
 
-func readFlat(c *mongo.Collection, id string) (CustomFlatStructure, error) {
+func readFlat(ctx context.Context, c Collection, id string, opts ...OpOption) (CustomFlatStructure, error) {
+	ctx, cancel := withOpTimeout(ctx, opts...)
+	defer cancel()
+
 	var res CustomFlatStructure
 
 	err := c.FindOne(
-		context.Background(),
-		primitive.M{
-			"id": id,
-		},
+		ctx,
+		Validate[CustomFlatStructure](Eq("id", id)),
 		nil,
 	).Decode(&res)
 
@@ -0,0 +1,68 @@
+package mongodb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Reading dumps
+//
+// Documents can be inspected offline from files:
+// - ReadBSONDump reads concatenated BSON documents, the format of mongodump .bson files
+// - ReadJSONDump reads Extended JSON written by mongoexport, one document per line or a JSON array (--jsonArray)
+//
+// Look at JSONReader in extjson.go for streaming large files
+
+// ReadBSONDump reads all BSON documents from r
+func ReadBSONDump(r io.Reader) ([]bson.Raw, error) {
+	var docs []bson.Raw
+	for {
+		doc, err := bson.NewFromIOReader(r)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read document %d: %w", len(docs), err)
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// ReadJSONDump reads all Extended JSON documents from r,
+// both canonical and relaxed formats are accepted
+func ReadJSONDump(r io.Reader) ([]bson.Raw, error) {
+	jr := NewJSONReader(r)
+	var docs []bson.Raw
+	for jr.Next() {
+		docs = append(docs, jr.Raw())
+	}
+	if err := jr.Err(); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// startsWithArray reports whether the first non-space byte of r is [
+func startsWithArray(r *bufio.Reader) (bool, error) {
+	for {
+		b, err := r.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\n', '\r':
+			if _, err = r.ReadByte(); err != nil {
+				return false, err
+			}
+		default:
+			return b[0] == '[', nil
+		}
+	}
+}
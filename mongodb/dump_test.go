@@ -0,0 +1,51 @@
+package mongodb_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestReadJSONDump(t *testing.T) {
+	tt := []struct {
+		name string
+		dump string
+	}{
+		{"lines", "{\"id\": \"1\", \"n\": {\"$numberLong\": \"2\"}}\n{\"id\": \"2\"}\n"},
+		{"array", " [{\"id\": \"1\", \"n\": {\"$numberLong\": \"2\"}}, {\"id\": \"2\"}]"},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				docs, err := mongodb.ReadJSONDump(strings.NewReader(tc.dump))
+				assert.Nil(t, err)
+				assert.Len(t, docs, 2)
+				assert.Equal(t, int64(2), docs[0].Lookup("n").Int64())
+				assert.Equal(t, "2", docs[1].Lookup("id").StringValue())
+			},
+		)
+	}
+}
+
+func TestReadBSONDump(t *testing.T) {
+	var buf bytes.Buffer
+	for _, id := range []string{"1", "2", "3"} {
+		raw, err := bson.Marshal(bson.M{"id": id})
+		assert.Nil(t, err)
+		buf.Write(raw)
+	}
+
+	docs, err := mongodb.ReadBSONDump(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Len(t, docs, 3)
+	assert.Equal(t, "3", docs[2].Lookup("id").StringValue())
+
+	_, err = mongodb.ReadBSONDump(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,334 @@
+package mongodb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Extended JSON import and export
+//
+// Problem description:
+// fixtures for CustomNestedMapStruct are hard to keep in git: BSON isn't readable,
+// and encoding/json loses the types (dates become strings, int64 becomes float64, etc.).
+//
+// JSONWriter and JSONReader stream documents in Extended JSON, one document per line
+// or as a JSON array (WithJSONArray), the same formats as mongoexport writes.
+// Go values are encoded and decoded with customRegistry unless WithJSONRegistry is set,
+// so a fixture written from CustomNestedMapStruct is read back with time.Time in Data:
+//
+// w := mongodb.NewJSONWriter(f, mongodb.WithCanonicalJSON())
+// err := w.Write(mongodb.CustomNestedMapStruct{ID: "1", Data: data})
+// err = w.Close()
+//
+// fixtures, err := mongodb.ReadJSON[mongodb.CustomNestedMapStruct](f)
+//
+// Large files are read document by document:
+//
+// r := mongodb.NewJSONReader(f)
+// for r.Next() {
+// 		var doc mongodb.CustomNestedMapStruct
+// 		err := r.Decode(&doc)
+// }
+// err := r.Err()
+//
+// ExportJSON and ImportJSON copy documents between a collection and a stream,
+// the same is available as a command: mongodb/cmd/mongo-dump
+//
+// Relaxed Extended JSON is shorter, but keeps less types: an int64 which fits into int32
+// is read back as int32, so 5 stored as int64 changes its type after export and import.
+// JSONRoundTrip reports such changes for a document before fixtures are written.
+
+// JSONOption configures JSONWriter, JSONReader and functions using them
+type JSONOption func(*jsonConfig)
+
+type jsonConfig struct {
+	registry  *bsoncodec.Registry
+	canonical bool
+	array     bool
+}
+
+func newJSONConfig(opts []JSONOption) jsonConfig {
+	cfg := jsonConfig{registry: customRegistry()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithJSONRegistry sets the registry used to encode and decode Go values
+func WithJSONRegistry(reg *bsoncodec.Registry) JSONOption {
+	return func(c *jsonConfig) {
+		c.registry = reg
+	}
+}
+
+// WithCanonicalJSON writes canonical Extended JSON instead of relaxed
+func WithCanonicalJSON() JSONOption {
+	return func(c *jsonConfig) {
+		c.canonical = true
+	}
+}
+
+// WithJSONArray writes documents as a JSON array instead of one document per line
+func WithJSONArray() JSONOption {
+	return func(c *jsonConfig) {
+		c.array = true
+	}
+}
+
+// JSONWriter writes documents as Extended JSON
+type JSONWriter struct {
+	w   *bufio.Writer
+	cfg jsonConfig
+	n   int
+}
+
+func NewJSONWriter(w io.Writer, opts ...JSONOption) *JSONWriter {
+	return &JSONWriter{w: bufio.NewWriter(w), cfg: newJSONConfig(opts)}
+}
+
+// Write writes doc, which can be bson.Raw or any Go value encoded as a document
+func (w *JSONWriter) Write(doc interface{}) error {
+	data, err := bson.MarshalExtJSONWithRegistry(w.cfg.registry, doc, w.cfg.canonical, false)
+	if err != nil {
+		return fmt.Errorf("can't encode document %d: %w", w.n, err)
+	}
+
+	sep := "\n"
+	if w.cfg.array {
+		sep = ",\n"
+		if w.n == 0 {
+			sep = "[\n"
+		}
+	}
+	if w.n > 0 || w.cfg.array {
+		if _, err = w.w.WriteString(sep); err != nil {
+			return err
+		}
+	}
+	if _, err = w.w.Write(data); err != nil {
+		return err
+	}
+	w.n++
+	return nil
+}
+
+// Close finishes the array if needed and flushes buffered data, the underlying writer isn't closed
+func (w *JSONWriter) Close() error {
+	end := "\n"
+	switch {
+	case w.cfg.array && w.n == 0:
+		end = "[]\n"
+	case w.cfg.array:
+		end = "\n]\n"
+	case w.n == 0:
+		end = ""
+	}
+	if _, err := w.w.WriteString(end); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// JSONReader reads Extended JSON documents one by one, both one document per line and arrays are accepted
+type JSONReader struct {
+	br      *bufio.Reader
+	dec     *json.Decoder
+	cfg     jsonConfig
+	current bson.Raw
+	n       int
+	err     error
+}
+
+func NewJSONReader(r io.Reader, opts ...JSONOption) *JSONReader {
+	return &JSONReader{br: bufio.NewReader(r), cfg: newJSONConfig(opts)}
+}
+
+// Next reads the next document, it returns false at the end of input or on error
+func (r *JSONReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.dec == nil && !r.start() {
+		return false
+	}
+	if !r.dec.More() {
+		return false
+	}
+
+	var msg json.RawMessage
+	if err := r.dec.Decode(&msg); err != nil {
+		r.err = fmt.Errorf("can't read document %d: %w", r.n, err)
+		return false
+	}
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON(msg, false, &doc); err != nil {
+		r.err = fmt.Errorf("can't read document %d: %w", r.n, err)
+		return false
+	}
+	r.current = doc
+	r.n++
+	return true
+}
+
+func (r *JSONReader) start() bool {
+	isArray, err := startsWithArray(r.br)
+	if err != nil {
+		r.err = err
+		return false
+	}
+	r.dec = json.NewDecoder(r.br)
+	if isArray {
+		if _, err = r.dec.Token(); err != nil {
+			r.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// Raw returns the current document
+func (r *JSONReader) Raw() bson.Raw {
+	return r.current
+}
+
+// Decode decodes the current document into v, decoding errors are *DecodeError
+func (r *JSONReader) Decode(v interface{}) error {
+	return Unmarshal(r.cfg.registry, r.current, v)
+}
+
+// Err returns the error which stopped reading
+func (r *JSONReader) Err() error {
+	return r.err
+}
+
+// ReadJSON reads and decodes all documents from r
+func ReadJSON[T any](r io.Reader, opts ...JSONOption) ([]T, error) {
+	jr := NewJSONReader(r, opts...)
+	var res []T
+	for jr.Next() {
+		var doc T
+		if err := jr.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("can't decode document %d: %w", len(res), err)
+		}
+		res = append(res, doc)
+	}
+	return res, jr.Err()
+}
+
+// ExportJSON writes documents of c matching filter to w and returns the number of written documents
+func ExportJSON(ctx context.Context, c Collection, filter interface{}, w io.Writer, opts ...JSONOption) (int64, error) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	cur, err := c.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	jw := NewJSONWriter(w, opts...)
+	var n int64
+	for cur.Next(ctx) {
+		if err = jw.Write(cur.Current); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err = cur.Err(); err != nil {
+		return n, err
+	}
+	return n, jw.Close()
+}
+
+// ImportJSON inserts all documents from r into c and returns the number of inserted documents
+func ImportJSON(ctx context.Context, c Collection, r io.Reader, opts ...JSONOption) (int64, error) {
+	jr := NewJSONReader(r, opts...)
+	var n int64
+	for jr.Next() {
+		if _, err := c.InsertOne(ctx, jr.Raw()); err != nil {
+			return n, fmt.Errorf("can't insert document %d: %w", n, err)
+		}
+		n++
+	}
+	return n, jr.Err()
+}
+
+// TypeChange is a field which has another BSON type after a round trip
+type TypeChange struct {
+	// Path is the dotted path of the field, array elements are addressed by index
+	Path   string
+	Before bsontype.Type
+	// After is 0 if the field is missing after the round trip
+	After bsontype.Type
+}
+
+func (c TypeChange) String() string {
+	if c.After == 0 {
+		return fmt.Sprintf("%v: %v -> missing", c.Path, c.Before)
+	}
+	return fmt.Sprintf("%v: %v -> %v", c.Path, c.Before, c.After)
+}
+
+// JSONRoundTrip writes doc as Extended JSON, reads it back and returns fields with changed BSON types,
+// only WithCanonicalJSON and WithJSONRegistry options are used
+func JSONRoundTrip(doc interface{}, opts ...JSONOption) ([]TypeChange, error) {
+	cfg := newJSONConfig(opts)
+
+	before, err := bson.MarshalWithRegistry(cfg.registry, doc)
+	if err != nil {
+		return nil, err
+	}
+	data, err := bson.MarshalExtJSON(bson.Raw(before), cfg.canonical, false)
+	if err != nil {
+		return nil, err
+	}
+	var after bson.Raw
+	if err = bson.UnmarshalExtJSON(data, false, &after); err != nil {
+		return nil, err
+	}
+
+	return typeChanges("", before, after)
+}
+
+func typeChanges(prefix string, before, after bson.Raw) ([]TypeChange, error) {
+	elems, err := before.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []TypeChange
+	for _, e := range elems {
+		path := prefix + e.Key()
+		bv := e.Value()
+		av, err := after.LookupErr(e.Key())
+		if err != nil {
+			res = append(res, TypeChange{Path: path, Before: bv.Type})
+			continue
+		}
+		if bv.Type != av.Type {
+			res = append(res, TypeChange{Path: path, Before: bv.Type, After: av.Type})
+			continue
+		}
+
+		var nested []TypeChange
+		switch bv.Type {
+		case bsontype.EmbeddedDocument:
+			nested, err = typeChanges(path+".", bv.Document(), av.Document())
+		case bsontype.Array:
+			nested, err = typeChanges(path+".", bv.Array(), av.Array())
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, nested...)
+	}
+	return res, nil
+}
@@ -0,0 +1,105 @@
+package mongodb_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+func TestJSONFixtures(t *testing.T) {
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	fixtures := []mongodb.CustomNestedMapStruct{
+		{ID: "1", Data: map[string]interface{}{"createdAt": created, "n": int64(5)}},
+		{ID: "2", Data: map[string]interface{}{"price": mongodb.NewDecimal(1999, -2)}},
+	}
+
+	tt := []struct {
+		name string
+		opts []mongodb.JSONOption
+	}{
+		{"relaxed lines", nil},
+		{"canonical array", []mongodb.JSONOption{mongodb.WithCanonicalJSON(), mongodb.WithJSONArray()}},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				var buf bytes.Buffer
+				w := mongodb.NewJSONWriter(&buf, tc.opts...)
+				for _, f := range fixtures {
+					assert.Nil(t, w.Write(f))
+				}
+				assert.Nil(t, w.Close())
+
+				res, err := mongodb.ReadJSON[mongodb.CustomNestedMapStruct](&buf, tc.opts...)
+				assert.Nil(t, err)
+				assert.Len(t, res, 2)
+				assert.Equal(t, created, res[0].Data["createdAt"].(time.Time).UTC())
+				assert.Equal(t, fixtures[1].Data["price"], res[1].Data["price"])
+			},
+		)
+	}
+}
+
+func TestJSONWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, mongodb.NewJSONWriter(&buf, mongodb.WithJSONArray()).Close())
+	assert.Equal(t, "[]\n", buf.String())
+
+	docs, err := mongodb.ReadJSONDump(&buf)
+	assert.Nil(t, err)
+	assert.Empty(t, docs)
+}
+
+func TestExportImportJSON(t *testing.T) {
+	ctx := context.Background()
+	src := mongotest.NewCollection()
+	for _, id := range []string{"1", "2", "3"} {
+		_, err := src.InsertOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "n", Value: int64(1)}})
+		assert.Nil(t, err)
+	}
+
+	var buf bytes.Buffer
+	n, err := mongodb.ExportJSON(ctx, src, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: "1"}}}}, &buf, mongodb.WithCanonicalJSON())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	dst := mongotest.NewCollection()
+	n, err = mongodb.ImportJSON(ctx, dst, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, bsontype.Int64, dst.Docs()[0].Lookup("n").Type)
+
+	_, err = mongodb.ImportJSON(ctx, dst, strings.NewReader(`{"_id": "2"}`+"\n"+`{"_id": `))
+	assert.NotNil(t, err)
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	doc := bson.D{
+		{Key: "small", Value: int64(5)},
+		{Key: "big", Value: int64(1 << 40)},
+		{Key: "nested", Value: bson.D{{Key: "list", Value: bson.A{int64(1), "a"}}}},
+	}
+
+	changes, err := mongodb.JSONRoundTrip(doc)
+	assert.Nil(t, err)
+	assert.Equal(t, []mongodb.TypeChange{
+		{Path: "small", Before: bsontype.Int64, After: bsontype.Int32},
+		{Path: "nested.list.0", Before: bsontype.Int64, After: bsontype.Int32},
+	}, changes)
+	assert.Equal(t, "small: 64-bit integer -> 32-bit integer", changes[0].String())
+
+	changes, err = mongodb.JSONRoundTrip(doc, mongodb.WithCanonicalJSON())
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+}
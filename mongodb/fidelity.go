@@ -0,0 +1,412 @@
+package mongodb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Round-trip fidelity mode
+//
+// Problem description:
+// BSON has less types than Go, so values put to map[string]interface{}
+// don't come back with the same Go types:
+// uint8/uint16 -> int32, uint32/uint64 -> int64, float32 -> float64,
+// [3]int -> primitive.A, CustomFlatStructure -> primitive.D and so on.
+// Look at insertNestedAllTypes and ExecWithNestedMapAllTypes
+//
+// FidelityMap stores a type tag alongside each value:
+//
+// {"uint8": {"t": "uint8", "v": 6}, "array": {"t": "[3]int", "v": [1, 2, 3]}}
+//
+// and restores the exact original Go type during decoding.
+// Named types are tagged with the package path: "github.com/asstart/go-receipts/mongodb.CustomFlatStructure",
+// so types with the same name from different packages don't clash.
+// Basic types, time.Time, pointers, arrays, slices and maps of them are supported out of the box,
+// struct types need to be registered with WithFidelity:
+//
+// reg := mongodb.NewRegistry(mongodb.WithFidelity(mongodb.CustomFlatStructure{}))
+//
+// Nested map[string]interface{} and []interface{} are tagged recursively.
+// time.Time keeps only milliseconds and is decoded in UTC, the same as for regular fields.
+
+// FidelityMap is a map[string]interface{} which keeps Go types of its values
+// when encoded with a registry built with WithFidelity
+type FidelityMap map[string]interface{}
+
+const (
+	fidelityTypeKey  = "t"
+	fidelityValueKey = "v"
+	fidelityNilTag   = "nil"
+)
+
+var tFidelityMap = reflect.TypeOf(FidelityMap{})
+
+var fidelityBuiltins = []interface{}{
+	false,
+	int(0), int8(0), int16(0), int32(0), int64(0),
+	uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+	float32(0), float64(0),
+	complex64(0), complex128(0),
+	"",
+	time.Time{},
+	FidelityMap{},
+	primitive.ObjectID{},
+	primitive.DateTime(0),
+	primitive.Decimal128{},
+	primitive.Binary{},
+	primitive.Timestamp{},
+	primitive.Regex{},
+}
+
+// WithFidelity enables FidelityMap encoding and registers additional
+// named types (usually structs) which can be stored in FidelityMap.
+// If two different types have the same package path and name (types declared inside functions),
+// encoding and decoding of FidelityMap fail with the error about the conflict
+func WithFidelity(types ...interface{}) RegistryOption {
+	return func(c *registryConfig) {
+		fc, ok := c.encoders[tFidelityMap].(*fidelityCodec)
+		if !ok {
+			fc = newFidelityCodec()
+			c.encoders[tFidelityMap] = fc
+			c.decoders[tFidelityMap] = fc
+		}
+		for _, v := range types {
+			fc.register(reflect.TypeOf(v))
+		}
+	}
+}
+
+type fidelityCodec struct {
+	types map[string]reflect.Type
+	// err is the conflict of registered types, it's returned on every encoding and decoding
+	err error
+}
+
+func newFidelityCodec() *fidelityCodec {
+	fc := &fidelityCodec{types: map[string]reflect.Type{}}
+	for _, v := range fidelityBuiltins {
+		fc.register(reflect.TypeOf(v))
+	}
+	return fc
+}
+
+func (fc *fidelityCodec) register(t reflect.Type) {
+	tag := typeTag(t)
+	if registered, ok := fc.types[tag]; ok && registered != t {
+		if fc.err == nil {
+			fc.err = fmt.Errorf("fidelity types %v and %v have the same tag %v", registered, t, tag)
+		}
+		return
+	}
+	fc.types[tag] = t
+}
+
+// typeTag is the type name with package paths of named types: *[]github.com/asstart/go-receipts/mongodb.CustomFlatStructure
+func typeTag(t reflect.Type) string {
+	if t.Name() != "" {
+		if t.PkgPath() == "" {
+			return t.Name()
+		}
+		return t.PkgPath() + "." + t.Name()
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + typeTag(t.Elem())
+	case reflect.Slice:
+		return "[]" + typeTag(t.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%v", t.Len(), typeTag(t.Elem()))
+	case reflect.Map:
+		return fmt.Sprintf("map[%v]%v", typeTag(t.Key()), typeTag(t.Elem()))
+	}
+	return t.String()
+}
+
+func (fc *fidelityCodec) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tFidelityMap {
+		return bsoncodec.ValueEncoderError{Name: "FidelityMapEncodeValue", Types: []reflect.Type{tFidelityMap}, Received: val}
+	}
+	if fc.err != nil {
+		return fc.err
+	}
+	if val.IsNil() {
+		return vw.WriteNull()
+	}
+
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, val.Len())
+	for _, k := range val.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ew, err := dw.WriteDocumentElement(k)
+		if err != nil {
+			return err
+		}
+		err = fc.encodeTagged(ec, ew, val.MapIndex(reflect.ValueOf(k)).Elem())
+		if err != nil {
+			return fmt.Errorf("can't encode key %v: %w", k, err)
+		}
+	}
+	return dw.WriteDocumentEnd()
+}
+
+func (fc *fidelityCodec) encodeTagged(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	tag := fidelityNilTag
+	if val.IsValid() {
+		tag = typeTag(val.Type())
+		if _, err := fc.parseTag(tag); err != nil {
+			return err
+		}
+	}
+
+	tw, err := dw.WriteDocumentElement(fidelityTypeKey)
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteString(tag); err != nil {
+		return err
+	}
+
+	ew, err := dw.WriteDocumentElement(fidelityValueKey)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !val.IsValid():
+		err = ew.WriteNull()
+	case val.Type() == tMap:
+		err = fc.EncodeValue(ec, ew, val.Convert(tFidelityMap))
+	case val.Type() == tSlice:
+		err = fc.encodeSlice(ec, ew, val)
+	default:
+		var enc bsoncodec.ValueEncoder
+		enc, err = ec.LookupEncoder(val.Type())
+		if err != nil {
+			return err
+		}
+		err = enc.EncodeValue(ec, ew, val)
+	}
+	if err != nil {
+		return err
+	}
+
+	return dw.WriteDocumentEnd()
+}
+
+func (fc *fidelityCodec) encodeSlice(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.IsNil() {
+		return vw.WriteNull()
+	}
+	aw, err := vw.WriteArray()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < val.Len(); i++ {
+		ew, err := aw.WriteArrayElement()
+		if err != nil {
+			return err
+		}
+		if err = fc.encodeTagged(ec, ew, val.Index(i).Elem()); err != nil {
+			return fmt.Errorf("can't encode index %v: %w", i, err)
+		}
+	}
+	return aw.WriteArrayEnd()
+}
+
+func (fc *fidelityCodec) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tFidelityMap {
+		return bsoncodec.ValueDecoderError{Name: "FidelityMapDecodeValue", Types: []reflect.Type{tFidelityMap}, Received: val}
+	}
+	if fc.err != nil {
+		return fc.err
+	}
+
+	switch vr.Type() {
+	case bsontype.Type(0), bsontype.EmbeddedDocument:
+	case bsontype.Null:
+		val.Set(reflect.Zero(tFidelityMap))
+		return vr.ReadNull()
+	default:
+		return fmt.Errorf("cannot decode %v into a FidelityMap", vr.Type())
+	}
+
+	b, err := bsonrw.Copier{}.CopyDocumentToBytes(vr)
+	if err != nil {
+		return err
+	}
+	m, err := fc.decodeMap(dc, bson.Raw(b))
+	if err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(m))
+	return nil
+}
+
+func (fc *fidelityCodec) decodeMap(dc bsoncodec.DecodeContext, doc bson.Raw) (FidelityMap, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	res := make(FidelityMap, len(elems))
+	for _, e := range elems {
+		v, err := fc.decodeTagged(dc, e.Value())
+		if err != nil {
+			return nil, fmt.Errorf("can't decode key %v: %w", e.Key(), err)
+		}
+		res[e.Key()] = v
+	}
+	return res, nil
+}
+
+func (fc *fidelityCodec) decodeTagged(dc bsoncodec.DecodeContext, rv bson.RawValue) (interface{}, error) {
+	wrapper, ok := rv.DocumentOK()
+	if !ok {
+		return nil, fmt.Errorf("expected tagged document, got %v", rv.Type)
+	}
+	tag, ok := wrapper.Lookup(fidelityTypeKey).StringValueOK()
+	if !ok {
+		return nil, fmt.Errorf("type tag is missing")
+	}
+	v := wrapper.Lookup(fidelityValueKey)
+
+	switch tag {
+	case fidelityNilTag:
+		return nil, nil
+	case tMap.String():
+		if v.Type == bsontype.Null {
+			return map[string]interface{}(nil), nil
+		}
+		m, err := fc.decodeMap(dc, v.Document())
+		return map[string]interface{}(m), err
+	case tSlice.String():
+		return fc.decodeSlice(dc, v)
+	}
+
+	t, err := fc.parseTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	ptr := reflect.New(t)
+	if err = v.UnmarshalWithContext(&dc, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+func (fc *fidelityCodec) decodeSlice(dc bsoncodec.DecodeContext, rv bson.RawValue) (interface{}, error) {
+	if rv.Type == bsontype.Null {
+		return []interface{}(nil), nil
+	}
+	arr, ok := rv.ArrayOK()
+	if !ok {
+		return nil, fmt.Errorf("expected array, got %v", rv.Type)
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]interface{}, 0, len(values))
+	for i, ev := range values {
+		v, err := fc.decodeTagged(dc, ev)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode index %v: %w", i, err)
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// parseTag restores reflect.Type from its string representation,
+// composite types are built from registered ones
+func (fc *fidelityCodec) parseTag(tag string) (reflect.Type, error) {
+	if t, ok := fc.types[tag]; ok {
+		return t, nil
+	}
+
+	switch {
+	case tag == tEmpty.String():
+		return tEmpty, nil
+	case strings.HasPrefix(tag, "*"):
+		elem, err := fc.parseTag(tag[1:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.PtrTo(elem), nil
+	case strings.HasPrefix(tag, "[]"):
+		elem, err := fc.parseTag(tag[2:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+	case strings.HasPrefix(tag, "["):
+		end := strings.Index(tag, "]")
+		if end < 0 {
+			break
+		}
+		n, err := strconv.Atoi(tag[1:end])
+		if err != nil {
+			break
+		}
+		elem, err := fc.parseTag(tag[end+1:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ArrayOf(n, elem), nil
+	case strings.HasPrefix(tag, "map["):
+		end := matchingBracket(tag, len("map"))
+		if end < 0 {
+			break
+		}
+		key, err := fc.parseTag(tag[len("map["):end])
+		if err != nil {
+			return nil, err
+		}
+		elem, err := fc.parseTag(tag[end+1:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MapOf(key, elem), nil
+	}
+
+	return nil, fmt.Errorf("type %v is not registered for fidelity encoding", tag)
+}
+
+func matchingBracket(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,86 @@
+package mongodb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFidelityMapRoundTrip(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	data := map[string]interface{}{
+		"int8":    int8(1),
+		"uint8":   uint8(6),
+		"uint16":  uint16(7),
+		"uint32":  uint32(8),
+		"uint64":  uint64(9),
+		"uint":    uint(10),
+		"float32": float32(1.4),
+		"rune":    rune(12),
+		"nil":     nil,
+		"array":   [3]int{1, 2, 3},
+		"slice":   []int{1, 2, 3},
+		"time":    now,
+		"pointer": &now,
+		"strmap":  map[string]string{"1": "11"},
+		"nested":  map[string]interface{}{"1": uint8(1), "2": []interface{}{float32(2.5), "s"}},
+		"struct":  mongodb.CustomFlatStructure{ID: "1", Date: now},
+	}
+
+	reg := mongodb.NewRegistry(mongodb.WithFidelity(mongodb.CustomFlatStructure{}))
+
+	raw, err := bson.MarshalWithRegistry(reg, mongodb.FidelityNestedMapStruct{ID: "fidelity", Data: data})
+	assert.Nil(t, err)
+
+	var res mongodb.FidelityNestedMapStruct
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.Nil(t, err)
+
+	for k, v := range data {
+		assert.IsType(t, v, res.Data[k], k)
+		if k == "pointer" {
+			continue
+		}
+		assert.Equal(t, v, res.Data[k], k)
+	}
+	assert.True(t, now.Equal(*res.Data["pointer"].(*time.Time)))
+}
+
+func TestFidelityMapUnregisteredType(t *testing.T) {
+	reg := mongodb.NewRegistry(mongodb.WithFidelity())
+
+	_, err := bson.MarshalWithRegistry(reg, mongodb.FidelityNestedMapStruct{
+		Data: mongodb.FidelityMap{"struct": mongodb.CustomFlatStructure{}},
+	})
+	assert.NotNil(t, err)
+}
+
+func localID() interface{} {
+	type ID struct{ V string }
+	return ID{V: "local"}
+}
+
+func TestFidelityMapTypeTags(t *testing.T) {
+	type ID struct{ V string }
+
+	reg := mongodb.NewRegistry(mongodb.WithFidelity(ID{}))
+	raw, err := bson.MarshalWithRegistry(reg, mongodb.FidelityNestedMapStruct{Data: mongodb.FidelityMap{"id": []ID{{V: "1"}}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "[]github.com/asstart/go-receipts/mongodb_test.ID", bson.Raw(raw).Lookup("data", "id", "t").StringValue())
+
+	var res mongodb.FidelityNestedMapStruct
+	assert.Nil(t, bson.UnmarshalWithRegistry(reg, raw, &res))
+	assert.Equal(t, []ID{{V: "1"}}, res.Data["id"])
+
+	// both types are github.com/asstart/go-receipts/mongodb_test.ID
+	reg = mongodb.NewRegistry(mongodb.WithFidelity(ID{}, localID()))
+	_, err = bson.MarshalWithRegistry(reg, mongodb.FidelityNestedMapStruct{Data: mongodb.FidelityMap{"id": ID{}}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "same tag")
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "same tag")
+}
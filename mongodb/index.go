@@ -0,0 +1,490 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Indexes declared with struct tags
+//
+// Problem description:
+// readFlat looks documents up by id, but nothing creates an index on it,
+// so every lookup scans the collection. Indexes created by hand in one environment
+// are missing in another, and nobody notices until the collection grows.
+//
+// Indexes are declared next to the fields with mongoidx tags:
+//
+// type CustomFlatStructure struct {
+// 		ID   string    `mongoidx:"unique"`
+// 		Date time.Time `mongoidx:"ttl=720h"`
+// }
+//
+// A tag is a comma separated list of options:
+// desc - descending order instead of ascending,
+// unique, sparse,
+// ttl=<duration> - documents expire after the date stored in the field plus duration,
+// name=<name> - the index name instead of the generated one (id_1, date_-1, etc.),
+// group=<group> - fields with the same group form a compound index in the order of the fields,
+// options of any field of the group apply to the whole index.
+// A field can be a part of several indexes, their tags are separated by ';': `mongoidx:"unique;group=by_date"`.
+// Fields of embedded structs are indexed by their dotted paths.
+//
+// SyncIndexes lists existing indexes, plans which indexes have to be created or dropped and applies the plan:
+//
+// plan, err := mongodb.SyncIndexes[mongodb.CustomFlatStructure](ctx, client.Database(db).Collection(coll).Indexes())
+//
+// An index is recreated if its keys or options changed, indexes which aren't declared are kept
+// unless WithIndexPrune is set, _id_ is never dropped and an index declared on _id alone can't have options. Applying the same declarations again does nothing.
+// WithIndexDryRun prints the plan without applying it:
+//
+// create id_1 {id: 1} unique
+// drop date_1 {date: 1} (changed)
+// create date_1 {date: 1} ttl=720h0m0s
+
+// ErrIndexTag is returned for mongoidx tags which can't be parsed
+var ErrIndexTag = errors.New("invalid mongoidx tag")
+
+// IndexLister lists indexes of a collection, mongo.IndexView implements it
+type IndexLister interface {
+	List(ctx context.Context, opts ...*options.ListIndexesOptions) (*mongo.Cursor, error)
+}
+
+// IndexView manages indexes of a collection, mongo.IndexView implements it
+type IndexView interface {
+	IndexLister
+	CreateOne(ctx context.Context, model mongo.IndexModel, opts ...*options.CreateIndexesOptions) (string, error)
+	DropOne(ctx context.Context, name string, opts ...*options.DropIndexesOptions) (bson.Raw, error)
+}
+
+var _ IndexView = mongo.IndexView{}
+
+// Index describes an index
+type Index struct {
+	Name string
+	// Keys are field paths with 1 for ascending or -1 for descending order
+	Keys   bson.D
+	Unique bool
+	Sparse bool
+	// ExpireAfterSeconds is set for TTL indexes
+	ExpireAfterSeconds *int32
+}
+
+// Model returns the index model for IndexView.CreateOne
+func (i Index) Model() mongo.IndexModel {
+	opts := options.Index().SetName(i.Name)
+	if i.Unique {
+		opts.SetUnique(true)
+	}
+	if i.Sparse {
+		opts.SetSparse(true)
+	}
+	if i.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(*i.ExpireAfterSeconds)
+	}
+	return mongo.IndexModel{Keys: i.Keys, Options: opts}
+}
+
+// String renders the index as name, keys and options: date_1 {date: 1} ttl=720h0m0s
+func (i Index) String() string {
+	keys := make([]string, 0, len(i.Keys))
+	for _, k := range i.Keys {
+		keys = append(keys, fmt.Sprintf("%v: %v", k.Key, k.Value))
+	}
+	s := fmt.Sprintf("%v {%v}", i.Name, strings.Join(keys, ", "))
+	if i.Unique {
+		s += " unique"
+	}
+	if i.Sparse {
+		s += " sparse"
+	}
+	if i.ExpireAfterSeconds != nil {
+		s += fmt.Sprintf(" ttl=%v", time.Duration(*i.ExpireAfterSeconds)*time.Second)
+	}
+	return s
+}
+
+func (i Index) equal(other Index) bool {
+	return i.Name == other.Name && i.sameKeys(other) && i.Unique == other.Unique && i.Sparse == other.Sparse &&
+		reflect.DeepEqual(i.ExpireAfterSeconds, other.ExpireAfterSeconds)
+}
+
+func (i Index) sameKeys(other Index) bool {
+	return reflect.DeepEqual(i.Keys, other.Keys)
+}
+
+// indexName generates the name the same way as the driver does
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%v_%v", k.Key, k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// IndexesOf returns indexes declared with mongoidx tags of T, which should be a struct
+func IndexesOf[T any]() ([]Index, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%w: %v isn't a struct", ErrIndexTag, t)
+	}
+
+	p := indexParser{groups: map[string]int{}, seen: map[reflect.Type]bool{}}
+	if err := p.parseStruct(t, ""); err != nil {
+		return nil, err
+	}
+	for i := range p.indexes {
+		if p.indexes[i].Name == "" {
+			p.indexes[i].Name = indexName(p.indexes[i].Keys)
+		}
+	}
+	return p.indexes, nil
+}
+
+type indexParser struct {
+	indexes []Index
+	// groups are positions of compound indexes in indexes
+	groups map[string]int
+	// seen are structs being parsed, recursive types are parsed once
+	seen map[reflect.Type]bool
+}
+
+func (p *indexParser) parseStruct(t reflect.Type, prefix string) error {
+	if p.seen[t] {
+		return nil
+	}
+	p.seen[t] = true
+	defer delete(p.seen, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tags, err := bsoncodec.DefaultStructTagParser.ParseStructTags(f)
+		if err != nil || tags.Skip {
+			continue
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if tags.Inline && ft.Kind() == reflect.Struct {
+			if err = p.parseStruct(ft, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+
+		path := prefix + tags.Name
+		if tag, ok := f.Tag.Lookup("mongoidx"); ok {
+			for _, spec := range strings.Split(tag, ";") {
+				if err = p.parseSpec(t, f, path, spec); err != nil {
+					return err
+				}
+			}
+		}
+		if ft.Kind() == reflect.Struct {
+			if err = p.parseStruct(ft, path+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *indexParser) parseSpec(t reflect.Type, f reflect.StructField, path, spec string) error {
+	var (
+		idx   Index
+		order = int32(1)
+		group string
+	)
+	for _, opt := range strings.Split(spec, ",") {
+		opt = strings.TrimSpace(opt)
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "", "asc":
+		case "desc":
+			order = -1
+		case "unique":
+			idx.Unique = true
+		case "sparse":
+			idx.Sparse = true
+		case "name":
+			idx.Name = value
+		case "group":
+			group = value
+		case "ttl":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 || d%time.Second != 0 || d/time.Second > math.MaxInt32 {
+				return fmt.Errorf("%w: %v.%v: ttl should be whole seconds: %q", ErrIndexTag, t, f.Name, value)
+			}
+			seconds := int32(d / time.Second)
+			idx.ExpireAfterSeconds = &seconds
+		default:
+			return fmt.Errorf("%w: %v.%v: unknown option %q", ErrIndexTag, t, f.Name, opt)
+		}
+	}
+	idx.Keys = bson.D{{Key: path, Value: order}}
+
+	if group == "" {
+		p.indexes = append(p.indexes, idx)
+		return nil
+	}
+	if idx.ExpireAfterSeconds != nil {
+		return fmt.Errorf("%w: %v.%v: ttl can't be set for compound index %v", ErrIndexTag, t, f.Name, group)
+	}
+
+	pos, ok := p.groups[group]
+	if !ok {
+		p.groups[group] = len(p.indexes)
+		p.indexes = append(p.indexes, idx)
+		return nil
+	}
+	g := &p.indexes[pos]
+	g.Keys = append(g.Keys, idx.Keys...)
+	g.Unique = g.Unique || idx.Unique
+	g.Sparse = g.Sparse || idx.Sparse
+	if idx.Name != "" {
+		if g.Name != "" && g.Name != idx.Name {
+			return fmt.Errorf("%w: %v.%v: names %v and %v for compound index %v", ErrIndexTag, t, f.Name, g.Name, idx.Name, group)
+		}
+		g.Name = idx.Name
+	}
+	return nil
+}
+
+type indexDocument struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	Unique             bool   `bson:"unique"`
+	Sparse             bool   `bson:"sparse"`
+	ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+}
+
+// ListIndexes returns existing indexes including _id_,
+// numeric key orders are returned as int32 whatever type they are stored with
+func ListIndexes(ctx context.Context, l IndexLister) ([]Index, error) {
+	cur, err := l.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var res []Index
+	for cur.Next(ctx) {
+		var doc indexDocument
+		if err = cur.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("can't decode index: %w", err)
+		}
+		for i, k := range doc.Key {
+			doc.Key[i].Value = keyOrder(k.Value)
+		}
+		res = append(res, Index{
+			Name:               doc.Name,
+			Keys:               doc.Key,
+			Unique:             doc.Unique,
+			Sparse:             doc.Sparse,
+			ExpireAfterSeconds: doc.ExpireAfterSeconds,
+		})
+	}
+	return res, cur.Err()
+}
+
+// keyOrder converts numeric orders (1, 1.0, NumberLong(1)) to int32, special index types ("text", "2dsphere") are kept
+func keyOrder(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int64:
+		return int32(n)
+	case float64:
+		return int32(n)
+	}
+	return v
+}
+
+// Index actions of IndexOp
+const (
+	IndexCreate = "create"
+	IndexDrop   = "drop"
+)
+
+// IndexOp is an operation of IndexPlan
+type IndexOp struct {
+	Action string
+	Index  Index
+	// Reason explains drops: changed or not declared
+	Reason string
+}
+
+func (op IndexOp) String() string {
+	if op.Reason == "" {
+		return fmt.Sprintf("%v %v", op.Action, op.Index)
+	}
+	return fmt.Sprintf("%v %v (%v)", op.Action, op.Index, op.Reason)
+}
+
+// IndexPlan is the list of operations turning existing indexes into declared ones,
+// drops go before creates, so changed indexes are dropped before they're created again
+type IndexPlan struct {
+	Ops []IndexOp
+	// Unchanged are names of declared indexes which already exist
+	Unchanged []string
+}
+
+// Empty reports whether there's nothing to do
+func (p IndexPlan) Empty() bool {
+	return len(p.Ops) == 0
+}
+
+// String renders operations one per line
+func (p IndexPlan) String() string {
+	var sb strings.Builder
+	for _, op := range p.Ops {
+		sb.WriteString(op.String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Apply runs the operations. Dropping a missing index isn't an error,
+// and the server doesn't create an identical index twice, so an interrupted plan can be applied again
+func (p IndexPlan) Apply(ctx context.Context, v IndexView) error {
+	for _, op := range p.Ops {
+		var err error
+		switch op.Action {
+		case IndexDrop:
+			_, err = v.DropOne(ctx, op.Index.Name)
+			if isIndexNotFound(err) {
+				err = nil
+			}
+		case IndexCreate:
+			_, err = v.CreateOne(ctx, op.Index.Model())
+		}
+		if err != nil {
+			return fmt.Errorf("can't %v index %v: %w", op.Action, op.Index.Name, err)
+		}
+	}
+	return nil
+}
+
+func isIndexNotFound(err error) bool {
+	var se mongo.ServerError
+	// IndexNotFound or NamespaceNotFound if there's no collection at all
+	return errors.As(err, &se) && (se.HasErrorCode(27) || se.HasErrorCode(26))
+}
+
+// IndexOption configures PlanIndexes and SyncIndexes
+type IndexOption func(*indexConfig)
+
+type indexConfig struct {
+	prune  bool
+	dryRun io.Writer
+}
+
+// WithIndexPrune drops existing indexes which aren't declared, except _id_
+func WithIndexPrune() IndexOption {
+	return func(c *indexConfig) {
+		c.prune = true
+	}
+}
+
+// WithIndexDryRun makes SyncIndexes print the plan to w instead of applying it
+func WithIndexDryRun(w io.Writer) IndexOption {
+	return func(c *indexConfig) {
+		c.dryRun = w
+	}
+}
+
+// idIndex is the index MongoDB creates for _id of every collection
+var idIndex = Index{Name: "_id_", Keys: bson.D{{Key: "_id", Value: int32(1)}}}
+
+// PlanIndexes compares existing indexes with desired ones,
+// a declared index on _id alone must not have options since _id_ can't be changed
+func PlanIndexes(ctx context.Context, l IndexLister, desired []Index, opts ...IndexOption) (IndexPlan, error) {
+	var cfg indexConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	existing, err := ListIndexes(ctx, l)
+	if err != nil {
+		return IndexPlan{}, fmt.Errorf("can't list indexes: %w", err)
+	}
+
+	var (
+		plan    IndexPlan
+		creates []IndexOp
+		matched = make([]bool, len(existing))
+	)
+	for _, d := range desired {
+		if d.Name == idIndex.Name || d.sameKeys(idIndex) {
+			// the _id_ index always exists and can't be changed, only a plain declaration of it is accepted
+			if d.Unique || d.Sparse || d.ExpireAfterSeconds != nil || !d.sameKeys(idIndex) {
+				return IndexPlan{}, fmt.Errorf("%w: %v conflicts with the _id_ index", ErrIndexTag, d)
+			}
+			plan.Unchanged = append(plan.Unchanged, idIndex.Name)
+			continue
+		}
+		found := false
+		for i, e := range existing {
+			if matched[i] || e.Name == idIndex.Name || (e.Name != d.Name && !e.sameKeys(d)) {
+				continue
+			}
+			matched[i] = true
+			if e.equal(d) {
+				found = true
+				plan.Unchanged = append(plan.Unchanged, d.Name)
+				continue
+			}
+			plan.Ops = append(plan.Ops, IndexOp{Action: IndexDrop, Index: e, Reason: "changed"})
+		}
+		if !found {
+			creates = append(creates, IndexOp{Action: IndexCreate, Index: d})
+		}
+	}
+
+	if cfg.prune {
+		for i, e := range existing {
+			if !matched[i] && e.Name != idIndex.Name {
+				plan.Ops = append(plan.Ops, IndexOp{Action: IndexDrop, Index: e, Reason: "not declared"})
+			}
+		}
+	}
+
+	plan.Ops = append(plan.Ops, creates...)
+	return plan, nil
+}
+
+// SyncIndexes makes indexes of the collection match mongoidx tags of T and returns the applied plan
+func SyncIndexes[T any](ctx context.Context, v IndexView, opts ...IndexOption) (IndexPlan, error) {
+	var cfg indexConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	desired, err := IndexesOf[T]()
+	if err != nil {
+		return IndexPlan{}, err
+	}
+	plan, err := PlanIndexes(ctx, v, desired, opts...)
+	if err != nil {
+		return IndexPlan{}, err
+	}
+
+	if cfg.dryRun != nil {
+		_, err = io.WriteString(cfg.dryRun, plan.String())
+		return plan, err
+	}
+	return plan, plan.Apply(ctx, v)
+}
@@ -0,0 +1,175 @@
+package mongodb_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type indexedEvent struct {
+	ID     string `bson:"_id"`
+	Tenant string `bson:"tenant" mongoidx:"group=tenant_seq,unique;group=tenant_kind"`
+	Seq    int64  `bson:"seq" mongoidx:"group=tenant_seq,desc"`
+	Kind   string `bson:"kind" mongoidx:"group=tenant_kind,name=by_kind"`
+	Source struct {
+		Host string `bson:"host" mongoidx:"sparse"`
+	} `bson:"source"`
+}
+
+func indexStrings(indexes []mongodb.Index) []string {
+	res := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		res = append(res, i.String())
+	}
+	return res
+}
+
+func TestIndexesOf(t *testing.T) {
+	flat, err := mongodb.IndexesOf[mongodb.CustomFlatStructure]()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"id_1 {id: 1} unique", "date_1 {date: 1} ttl=720h0m0s"}, indexStrings(flat))
+
+	events, err := mongodb.IndexesOf[indexedEvent]()
+	assert.Nil(t, err)
+	assert.Equal(
+		t,
+		[]string{
+			"tenant_1_seq_-1 {tenant: 1, seq: -1} unique",
+			"by_kind {tenant: 1, kind: 1}",
+			"source.host_1 {source.host: 1} sparse",
+		},
+		indexStrings(events),
+	)
+}
+
+func TestIndexesOfInvalidTags(t *testing.T) {
+	type unknownOption struct {
+		A string `mongoidx:"uniq"`
+	}
+	type badTTL struct {
+		A string `mongoidx:"ttl=1.5s"`
+	}
+	type ttlInGroup struct {
+		A string `mongoidx:"group=g,ttl=1h"`
+		B string `mongoidx:"group=g"`
+	}
+
+	_, err := mongodb.IndexesOf[unknownOption]()
+	assert.ErrorIs(t, err, mongodb.ErrIndexTag)
+	_, err = mongodb.IndexesOf[badTTL]()
+	assert.ErrorIs(t, err, mongodb.ErrIndexTag)
+	_, err = mongodb.IndexesOf[ttlInGroup]()
+	assert.ErrorIs(t, err, mongodb.ErrIndexTag)
+	_, err = mongodb.IndexesOf[string]()
+	assert.ErrorIs(t, err, mongodb.ErrIndexTag)
+}
+
+func TestSyncIndexes(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+	view := c.Indexes()
+
+	// an index created by hand with another TTL and an index which isn't declared
+	_, err := view.CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "date", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(60),
+	})
+	assert.Nil(t, err)
+	_, err = view.CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "legacy", Value: 1}}})
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	_, err = mongodb.SyncIndexes[mongodb.CustomFlatStructure](ctx, view, mongodb.WithIndexDryRun(&out))
+	assert.Nil(t, err)
+	assert.Equal(
+		t,
+		"drop date_1 {date: 1} ttl=1m0s (changed)\n"+
+			"create id_1 {id: 1} unique\n"+
+			"create date_1 {date: 1} ttl=720h0m0s\n",
+		out.String(),
+	)
+	assert.Equal(t, 2, c.Calls(mongotest.OpCreateIndex))
+
+	plan, err := mongodb.SyncIndexes[mongodb.CustomFlatStructure](ctx, view, mongodb.WithIndexPrune())
+	assert.Nil(t, err)
+	assert.Len(t, plan.Ops, 4)
+	assert.Equal(t, mongodb.IndexOp{Action: mongodb.IndexDrop, Index: mongodb.Index{Name: "legacy_1", Keys: bson.D{{Key: "legacy", Value: int32(1)}}}, Reason: "not declared"}, plan.Ops[1])
+
+	existing, err := mongodb.ListIndexes(ctx, view)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"_id_ {_id: 1}", "id_1 {id: 1} unique", "date_1 {date: 1} ttl=720h0m0s"}, indexStrings(existing))
+
+	plan, err = mongodb.SyncIndexes[mongodb.CustomFlatStructure](ctx, view, mongodb.WithIndexPrune())
+	assert.Nil(t, err)
+	assert.True(t, plan.Empty())
+	assert.Equal(t, []string{"id_1", "date_1"}, plan.Unchanged)
+}
+
+func TestPlanIndexesKeepsIDIndex(t *testing.T) {
+	type plainID struct {
+		ID string `bson:"_id" mongoidx:""`
+	}
+	type uniqueID struct {
+		ID string `bson:"_id" mongoidx:"unique"`
+	}
+	type renamedID struct {
+		ID string `bson:"_id" mongoidx:"name=_id_,sparse"`
+	}
+
+	ctx := context.Background()
+	view := mongotest.NewCollection().Indexes()
+
+	desired, err := mongodb.IndexesOf[plainID]()
+	assert.Nil(t, err)
+	plan, err := mongodb.PlanIndexes(ctx, view, desired, mongodb.WithIndexPrune())
+	assert.Nil(t, err)
+	assert.True(t, plan.Empty())
+	assert.Equal(t, []string{"_id_"}, plan.Unchanged)
+
+	desired, err = mongodb.IndexesOf[uniqueID]()
+	assert.Nil(t, err)
+	_, err = mongodb.PlanIndexes(ctx, view, desired)
+	assert.ErrorIs(t, err, mongodb.ErrIndexTag)
+
+	desired, err = mongodb.IndexesOf[renamedID]()
+	assert.Nil(t, err)
+	_, err = mongodb.PlanIndexes(ctx, view, desired)
+	assert.ErrorIs(t, err, mongodb.ErrIndexTag)
+
+	// another index named _id_
+	_, err = mongodb.PlanIndexes(ctx, view, []mongodb.Index{{Name: "_id_", Keys: bson.D{{Key: "tenant", Value: int32(1)}}}})
+	assert.ErrorIs(t, err, mongodb.ErrIndexTag)
+}
+
+func TestIndexPlanApplyIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+	view := c.Indexes()
+
+	desired, err := mongodb.IndexesOf[indexedEvent]()
+	assert.Nil(t, err)
+	plan, err := mongodb.PlanIndexes(ctx, view, desired)
+	assert.Nil(t, err)
+
+	// the second create fails, applying the plan again finishes it
+	c.FailNext(mongotest.OpCreateIndex, nil, errors.New("connection reset"))
+	assert.NotNil(t, plan.Apply(ctx, view))
+	assert.Nil(t, plan.Apply(ctx, view))
+
+	existing, err := mongodb.ListIndexes(ctx, view)
+	assert.Nil(t, err)
+	assert.Len(t, existing, 4)
+
+	// dropping an already dropped index isn't an error
+	drop := mongodb.IndexPlan{Ops: []mongodb.IndexOp{{Action: mongodb.IndexDrop, Index: existing[1]}}}
+	assert.Nil(t, drop.Apply(ctx, view))
+	assert.Nil(t, drop.Apply(ctx, view))
+}
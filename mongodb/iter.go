@@ -0,0 +1,212 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Streaming iteration over a cursor
+//
+// Problem description:
+// decoding.go only reads single documents with FindOne, and Repository.Find
+// loads all matching documents into memory, which doesn't work for scanning
+// collections of CustomNestedMapStruct with millions of Data bags.
+// Decoding with cursor.Decode also uses the collection registry,
+// so dates in Data arrive as primitive.DateTime.
+//
+// Iter reads documents one by one and decodes each of them into T only when it's reached:
+//
+// it, err := mongodb.FindIter[mongodb.CustomNestedMapStruct](ctx, c, mongodb.Exists("data.createdAt", true),
+// 		mongodb.WithIterBatchSize(500),
+// 		mongodb.WithIterProjection(bson.D{{Key: "id", Value: 1}, {Key: "data", Value: 1}}),
+// 		mongodb.WithIterSort(bson.D{{Key: "_id", Value: 1}}),
+// )
+// defer it.Close(ctx)
+// for it.Next(ctx) {
+// 		doc := it.Value()
+// }
+// err = it.Err()
+//
+// Documents are decoded with customRegistry unless WithIterRegistry is set,
+// NewIter wraps a cursor which is already open, e.g. a result of Aggregate.
+//
+// A document which can't be decoded stops the iteration by default, Err returns its error.
+// WithDecodeErrorsPerDocument keeps going instead: Next returns true for such a document,
+// DecodeErr returns its error and Value returns the zero value, so bad documents
+// can be logged or collected while the rest of the collection is scanned.
+//
+// A cancelled context stops the iteration even if the cursor has buffered documents,
+// Err returns the context error then.
+
+// IterOption configures Iter
+type IterOption func(*iterConfig)
+
+type iterConfig struct {
+	registry   *bsoncodec.Registry
+	batchSize  *int32
+	projection interface{}
+	sort       interface{}
+	perDoc     bool
+}
+
+// WithIterRegistry sets the registry used to decode documents
+func WithIterRegistry(reg *bsoncodec.Registry) IterOption {
+	return func(c *iterConfig) {
+		c.registry = reg
+	}
+}
+
+// WithIterBatchSize sets the number of documents the server returns in a batch, used by FindIter
+func WithIterBatchSize(n int32) IterOption {
+	return func(c *iterConfig) {
+		c.batchSize = &n
+	}
+}
+
+// WithIterProjection sets the fields returned by the server, used by FindIter
+func WithIterProjection(projection interface{}) IterOption {
+	return func(c *iterConfig) {
+		c.projection = projection
+	}
+}
+
+// WithIterSort sets the order of documents, used by FindIter
+func WithIterSort(sort interface{}) IterOption {
+	return func(c *iterConfig) {
+		c.sort = sort
+	}
+}
+
+// WithDecodeErrorsPerDocument returns decode errors with the documents instead of stopping the iteration
+func WithDecodeErrorsPerDocument() IterOption {
+	return func(c *iterConfig) {
+		c.perDoc = true
+	}
+}
+
+func newIterConfig(opts []IterOption) iterConfig {
+	cfg := iterConfig{registry: customRegistry()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// Iter decodes documents of a cursor into T one by one
+type Iter[T any] struct {
+	cur     *mongo.Cursor
+	cfg     iterConfig
+	n       int64
+	value   T
+	decoded bool
+	docErr  error
+	err     error
+}
+
+func NewIter[T any](cur *mongo.Cursor, opts ...IterOption) *Iter[T] {
+	return &Iter[T]{cur: cur, cfg: newIterConfig(opts)}
+}
+
+// FindIter finds documents matching filter and returns the iterator over them, nil filter matches all documents
+func FindIter[T any](ctx context.Context, c Collection, filter interface{}, opts ...IterOption) (*Iter[T], error) {
+	cfg := newIterConfig(opts)
+
+	fo := options.Find()
+	if cfg.batchSize != nil {
+		fo.SetBatchSize(*cfg.batchSize)
+	}
+	if cfg.projection != nil {
+		fo.SetProjection(cfg.projection)
+	}
+	if cfg.sort != nil {
+		fo.SetSort(cfg.sort)
+	}
+	if filter == nil {
+		filter = bson.D{}
+	}
+
+	cur, err := c.Find(ctx, filter, fo)
+	if err != nil {
+		return nil, err
+	}
+	return &Iter[T]{cur: cur, cfg: cfg}, nil
+}
+
+// Next moves to the next document, it returns false when there are no more documents,
+// the context is done or a document can't be decoded (unless errors are returned per document)
+func (it *Iter[T]) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	// buffered documents are returned by the cursor without checking the context
+	if err := ctx.Err(); err != nil {
+		it.err = err
+		return false
+	}
+	if !it.cur.Next(ctx) {
+		it.err = it.cur.Err()
+		return false
+	}
+
+	var zero T
+	it.value, it.decoded, it.docErr = zero, false, nil
+	it.n++
+
+	if !it.cfg.perDoc {
+		if err := it.decode(); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// Value returns the current document decoded into T,
+// the zero value if it can't be decoded
+func (it *Iter[T]) Value() T {
+	it.decode()
+	return it.value
+}
+
+// DecodeErr returns the error of decoding the current document
+func (it *Iter[T]) DecodeErr() error {
+	return it.decode()
+}
+
+// decode decodes the current document once
+func (it *Iter[T]) decode() error {
+	if it.decoded || it.cur.Current == nil {
+		return it.docErr
+	}
+	it.decoded = true
+
+	if err := Unmarshal(it.cfg.registry, it.cur.Current, &it.value); err != nil {
+		var zero T
+		it.value = zero
+		it.docErr = fmt.Errorf("can't decode document %d: %w", it.n-1, err)
+		if id, idErr := it.cur.Current.LookupErr("_id"); idErr == nil {
+			it.docErr = fmt.Errorf("can't decode document %d (_id %v): %w", it.n-1, decodeID(id), err)
+		}
+	}
+	return it.docErr
+}
+
+// Raw returns the current document as it's stored, it's valid until the next call of Next
+func (it *Iter[T]) Raw() bson.Raw {
+	return it.cur.Current
+}
+
+// Err returns the error which stopped the iteration, nil if all documents were read
+func (it *Iter[T]) Err() error {
+	return it.err
+}
+
+// Close closes the cursor
+func (it *Iter[T]) Close(ctx context.Context) error {
+	return it.cur.Close(ctx)
+}
@@ -0,0 +1,108 @@
+package mongodb_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// iterCollection has documents with id "0".."4", "2" has a string instead of the Data document
+func iterCollection(t *testing.T) *mongotest.Collection {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+	for i := 4; i >= 0; i-- {
+		var data interface{} = bson.D{{Key: "createdAt", Value: time.Now()}, {Key: "n", Value: i}}
+		if i == 2 {
+			data = "broken"
+		}
+		_, err := c.InsertOne(ctx, bson.D{{Key: "id", Value: strconv.Itoa(i)}, {Key: "data", Value: data}, {Key: "extra", Value: true}})
+		assert.Nil(t, err)
+	}
+	return c
+}
+
+func TestFindIter(t *testing.T) {
+	ctx := context.Background()
+	c := iterCollection(t)
+
+	it, err := mongodb.FindIter[mongodb.CustomNestedMapStruct](
+		ctx,
+		c,
+		mongodb.In("id", "0", "1", "3"),
+		mongodb.WithIterBatchSize(2),
+		mongodb.WithIterSort(bson.D{{Key: "id", Value: 1}}),
+		mongodb.WithIterProjection(bson.D{{Key: "id", Value: 1}, {Key: "data", Value: 1}}),
+	)
+	assert.Nil(t, err)
+	defer it.Close(ctx)
+
+	var ids []string
+	for it.Next(ctx) {
+		doc := it.Value()
+		assert.Nil(t, it.DecodeErr())
+		assert.IsType(t, time.Time{}, doc.Data["createdAt"])
+		assert.Equal(t, bson.RawValue{}, it.Raw().Lookup("extra"))
+		ids = append(ids, doc.ID)
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, []string{"0", "1", "3"}, ids)
+}
+
+func TestIterDecodeErrors(t *testing.T) {
+	ctx := context.Background()
+	c := iterCollection(t)
+	sorted := mongodb.WithIterSort(bson.D{{Key: "id", Value: 1}})
+
+	it, err := mongodb.FindIter[mongodb.CustomNestedMapStruct](ctx, c, nil, sorted)
+	assert.Nil(t, err)
+	var ids []string
+	for it.Next(ctx) {
+		ids = append(ids, it.Value().ID)
+	}
+	assert.Equal(t, []string{"0", "1"}, ids)
+	var de *mongodb.DecodeError
+	assert.ErrorAs(t, it.Err(), &de)
+	assert.Equal(t, "Data", de.Path)
+
+	it, err = mongodb.FindIter[mongodb.CustomNestedMapStruct](ctx, c, nil, sorted, mongodb.WithDecodeErrorsPerDocument())
+	assert.Nil(t, err)
+	ids = nil
+	var failed []string
+	for it.Next(ctx) {
+		if err := it.DecodeErr(); err != nil {
+			assert.ErrorAs(t, err, &de)
+			assert.Equal(t, mongodb.CustomNestedMapStruct{}, it.Value())
+			failed = append(failed, it.Raw().Lookup("id").StringValue())
+			continue
+		}
+		ids = append(ids, it.Value().ID)
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, []string{"0", "1", "3", "4"}, ids)
+	assert.Equal(t, []string{"2"}, failed)
+}
+
+func TestIterContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	docs := []interface{}{bson.D{{Key: "id", Value: "1"}}, bson.D{{Key: "id", Value: "2"}}}
+	cur, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+	assert.Nil(t, err)
+
+	it := mongodb.NewIter[mongodb.CustomFlatStructure](cur)
+	assert.True(t, it.Next(ctx))
+	assert.Equal(t, "1", it.Value().ID)
+
+	cancel()
+	assert.False(t, it.Next(ctx))
+	assert.ErrorIs(t, it.Err(), context.Canceled)
+	assert.Nil(t, it.Close(context.Background()))
+}
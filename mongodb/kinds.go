@@ -0,0 +1,176 @@
+package mongodb
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Polymorphic decoding with a discriminator
+//
+// Problem description:
+// CustomFlatStructure put to CustomNestedMapStruct.Data is decoded back as primitive.D,
+// because there's no information about the Go type in the stored document.
+//
+// Add the type to a registry under a name:
+//
+// reg := mongodb.NewRegistry(mongodb.WithKind("flat", mongodb.CustomFlatStructure{}))
+//
+// The encoder writes the name to the _kind field of the document:
+//
+// {"_kind": "flat", "id": "1", "date": ...}
+//
+// and the decoder instantiates the registered struct
+// when it meets such a document in interface{} positions (map values, slice elements, etc.).
+// Documents with unknown or missing _kind are decoded as usual.
+//
+// Kinds can also be registered for the whole program with RegisterKind (usually in init())
+// and added to a registry with WithKinds. The package itself doesn't register any kinds,
+// so names are never taken by the examples.
+
+// KindKey is the name of the discriminator field
+const KindKey = "_kind"
+
+var kinds = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+}{
+	byName: map[string]reflect.Type{},
+}
+
+// RegisterKind registers the struct type of v under name.
+// Registering the same name for different types panics
+func RegisterKind(name string, v interface{}) {
+	t := kindStructType(name, v)
+
+	kinds.Lock()
+	defer kinds.Unlock()
+
+	if registered, ok := kinds.byName[name]; ok && registered != t {
+		panic(fmt.Sprintf("mongodb: kind %v is already registered for %v", name, registered))
+	}
+	kinds.byName[name] = t
+}
+
+// WithKind enables _kind encoding and decoding for the struct type of v under name in the registry only.
+// Adding the same name for different types panics
+func WithKind(name string, v interface{}) RegistryOption {
+	t := kindStructType(name, v)
+	return func(c *registryConfig) {
+		if registered, ok := c.kinds[name]; ok && registered != t {
+			panic(fmt.Sprintf("mongodb: kind %v is already added for %v", name, registered))
+		}
+		c.kinds[name] = t
+		c.encoders[t] = &kindEncoder{name: name}
+	}
+}
+
+func kindStructType(name string, v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("mongodb: kind %v should be a struct, got %T", name, v))
+	}
+	return t
+}
+
+// WithKinds enables _kind encoding and decoding for all kinds registered with RegisterKind
+func WithKinds() RegistryOption {
+	return func(c *registryConfig) {
+		kinds.RLock()
+		defer kinds.RUnlock()
+
+		for name, t := range kinds.byName {
+			c.kinds[name] = t
+			c.encoders[t] = &kindEncoder{name: name}
+		}
+	}
+}
+
+// kindStructCodec encodes registered structs without the _kind field,
+// the error is returned only for nil tag parser
+var kindStructCodec, _ = bsoncodec.NewStructCodec(bsoncodec.DefaultStructTagParser)
+
+type kindEncoder struct {
+	name string
+}
+
+func (ke *kindEncoder) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	var buf bytes.Buffer
+	bvw, err := bsonrw.NewBSONValueWriter(&buf)
+	if err != nil {
+		return err
+	}
+	if err = kindStructCodec.EncodeValue(ec, bvw, val); err != nil {
+		return err
+	}
+
+	doc := buf.Bytes()
+	idx, withKind := bsoncore.AppendDocumentStart(nil)
+	withKind = bsoncore.AppendStringElement(withKind, KindKey, ke.name)
+	withKind = append(withKind, doc[4:len(doc)-1]...)
+	withKind, err = bsoncore.AppendDocumentEnd(withKind, idx)
+	if err != nil {
+		return err
+	}
+
+	return bsonrw.Copier{}.CopyDocumentFromBytes(vw, withKind)
+}
+
+// kindDecoder decodes interface{} values,
+// documents with registered _kind are decoded into the registered type,
+// everything else is passed to fallback
+type kindDecoder struct {
+	kinds    map[string]reflect.Type
+	fallback bsoncodec.ValueDecoder
+}
+
+func (kd *kindDecoder) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tEmpty {
+		return bsoncodec.ValueDecoderError{Name: "KindDecodeValue", Types: []reflect.Type{tEmpty}, Received: val}
+	}
+
+	vt := vr.Type()
+	switch vt {
+	case bsontype.Type(0), bsontype.EmbeddedDocument:
+	default:
+		return kd.fallback.DecodeValue(dc, vr, val)
+	}
+
+	doc, err := bsonrw.Copier{}.CopyDocumentToBytes(vr)
+	if err != nil {
+		return err
+	}
+
+	name, ok := bson.Raw(doc).Lookup(KindKey).StringValueOK()
+	t, registered := kd.kinds[name]
+	if !ok || !registered {
+		return kd.fallback.DecodeValue(dc, newDocumentReader(vt, doc), val)
+	}
+
+	dec, err := dc.LookupDecoder(t)
+	if err != nil {
+		return err
+	}
+	res := reflect.New(t).Elem()
+	if err = dec.DecodeValue(dc, newDocumentReader(vt, doc), res); err != nil {
+		return fmt.Errorf("can't decode kind %v: %w", name, err)
+	}
+	val.Set(res)
+	return nil
+}
+
+// newDocumentReader reads doc back the same way it was read from the original reader:
+// as a top-level document or as an embedded one, the driver decodes them differently
+func newDocumentReader(t bsontype.Type, doc []byte) bsonrw.ValueReader {
+	if t == bsontype.Type(0) {
+		return bsonrw.NewBSONDocumentReader(doc)
+	}
+	return bsonrw.NewBSONValueReader(t, doc)
+}
@@ -0,0 +1,80 @@
+package mongodb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type eventPayload struct {
+	Name  string
+	Count int
+}
+
+func TestKinds(t *testing.T) {
+	reg := mongodb.NewRegistry(
+		mongodb.WithKind("flat", mongodb.CustomFlatStructure{}),
+		mongodb.WithKind("event", eventPayload{}),
+		mongodb.WithDateTimeAsTime(),
+	)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	doc := mongodb.CustomNestedMapStruct{
+		ID: "kinds",
+		Data: map[string]interface{}{
+			"struct":  mongodb.CustomFlatStructure{ID: "1", Date: now},
+			"pointer": &eventPayload{Name: "created", Count: 1},
+			"nested":  map[string]interface{}{"1": eventPayload{Name: "nested"}},
+			"slice":   []interface{}{eventPayload{Name: "in slice"}},
+			"plain":   map[string]interface{}{"_kind": "unknown"},
+		},
+	}
+
+	raw, err := bson.MarshalWithRegistry(reg, doc)
+	assert.Nil(t, err)
+	assert.Equal(t, "flat", bson.Raw(raw).Lookup("data", "struct", mongodb.KindKey).StringValue())
+
+	var res mongodb.CustomNestedMapStruct
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.Nil(t, err)
+
+	assert.Equal(t, mongodb.CustomFlatStructure{ID: "1", Date: now}, res.Data["struct"])
+	assert.Equal(t, eventPayload{Name: "created", Count: 1}, res.Data["pointer"])
+	assert.Equal(t, eventPayload{Name: "nested"}, res.Data["nested"].(map[string]interface{})["1"])
+	assert.Equal(t, eventPayload{Name: "in slice"}, res.Data["slice"].(primitive.A)[0])
+	assert.Equal(t, map[string]interface{}{"_kind": "unknown"}, res.Data["plain"])
+
+	// typed fields are not affected by _kind
+	var flat mongodb.CustomFlatStructure
+	err = bson.UnmarshalWithRegistry(reg, bson.Raw(raw).Lookup("data", "struct").Document(), &flat)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", flat.ID)
+}
+
+func TestRegisterKind(t *testing.T) {
+	mongodb.RegisterKind("registered event", eventPayload{})
+
+	raw, err := bson.MarshalWithRegistry(mongodb.NewRegistry(mongodb.WithKinds()), bson.M{"e": eventPayload{Name: "e"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "registered event", bson.Raw(raw).Lookup("e", mongodb.KindKey).StringValue())
+
+	// the package doesn't register kinds of the examples
+	assert.NotPanics(t, func() { mongodb.RegisterKind("flat", eventPayload{}) })
+}
+
+func TestWithKindConflict(t *testing.T) {
+	assert.Panics(t, func() {
+		mongodb.NewRegistry(mongodb.WithKind("conflict", eventPayload{}), mongodb.WithKind("conflict", mongodb.CustomFlatStructure{}))
+	})
+	assert.Panics(t, func() { mongodb.WithKind("not a struct", 1) })
+}
+
+func TestRegisterKindConflict(t *testing.T) {
+	mongodb.RegisterKind("conflict", eventPayload{})
+	assert.Panics(t, func() { mongodb.RegisterKind("conflict", mongodb.CustomFlatStructure{}) })
+	assert.Panics(t, func() { mongodb.RegisterKind("not a struct", 1) })
+}
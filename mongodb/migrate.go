@@ -0,0 +1,438 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Field type migrations
+//
+// Problem description:
+// documents written by older services have mixed types under the same key:
+// dates as strings, integers as doubles and so on.
+// Every reader has to handle all the variants (look at Bag), and filters and sorts
+// on such fields don't work as expected, {"Data.createdAt": {"$gt": date}} skips strings.
+//
+// Migrator converts the stored values to canonical BSON types in place:
+//
+// m := mongodb.Migration{
+// 	Name: "canonical-data",
+// 	Conversions: []mongodb.Conversion{
+// 		{Field: "data.createdAt", From: []bsontype.Type{bsontype.String}, To: bsontype.DateTime},
+// 		{Field: "data.count", To: bsontype.Int64},
+// 	},
+// }
+// report, err := mongodb.NewMigrator(c, mongodb.WithCheckpoints(checkpoints)).Run(ctx, m)
+//
+// Documents are read in batches ordered by _id and updated with $set of the converted fields,
+// with a single BulkWrite per batch if the collection is a BulkWriter.
+// {"_id": {"$gt": lastID}} only matches _id of the same type bracket as lastID,
+// so the next batch also matches _id of the types sorted after it with $type,
+// and a collection with both string and ObjectID _id is migrated completely.
+// Values are decoded with customRegistry, so dates are time.Time, and converted
+// with the same rules as Bag accessors, e.g. Int64 accepts 3.0 and "3", but not 3.5.
+// Values which can't be converted are left as is and reported in MigrationReport.Failures.
+//
+// Migrations are idempotent: values which already have the target type are skipped,
+// running a migration again modifies nothing.
+// WithDryRun only reports what would be converted.
+// WithCheckpoints stores the last processed _id after every batch, an interrupted migration
+// continues from it, the checkpoint is removed when the migration completes.
+
+// DefaultMigrationBatchSize is the number of documents read and written at once
+const DefaultMigrationBatchSize = 500
+
+// ErrMigrationName is returned if the migration name is empty while checkpoints are enabled
+var ErrMigrationName = errors.New("migration name is required for checkpoints")
+
+// Conversion converts values of a single field
+type Conversion struct {
+	// Field is the BSON key or dotted path of the field: "data.createdAt"
+	Field string
+	// From limits the conversion to values of these types, all types are converted if it's empty
+	From []bsontype.Type
+	// To is the canonical type: DateTime, Int64, Int32, Double, String or Decimal128
+	To bsontype.Type
+	// Layout is the layout of strings converted to DateTime, time.RFC3339Nano by default
+	Layout string
+	// Convert replaces the built-in conversion, v is decoded with customRegistry
+	Convert func(v interface{}) (interface{}, error)
+}
+
+// Migration is a named set of conversions
+type Migration struct {
+	// Name identifies the checkpoint of the migration
+	Name        string
+	Conversions []Conversion
+}
+
+// MigrationReport contains counts of a migration run
+type MigrationReport struct {
+	// Scanned is the number of read documents
+	Scanned int64
+	// Updated is the number of updated documents, or documents which would be updated in dry run mode
+	Updated int64
+	// Converted is the number of converted values by field
+	Converted map[string]int64
+	// Failures are values which can't be converted
+	Failures []ConversionFailure
+	// ResumedAfter is the _id from the checkpoint if the run continued an interrupted one
+	ResumedAfter interface{}
+}
+
+// ConversionFailure describes a value which can't be converted
+type ConversionFailure struct {
+	ID    interface{}
+	Field string
+	Err   error
+}
+
+func (f ConversionFailure) Error() string {
+	return fmt.Sprintf("document %v: %v: %v", f.ID, f.Field, f.Err)
+}
+
+func (f ConversionFailure) Unwrap() error {
+	return f.Err
+}
+
+// Migrator runs migrations over a collection
+type Migrator struct {
+	coll        Collection
+	batchSize   int64
+	dryRun      bool
+	checkpoints Collection
+	registry    *bsoncodec.Registry
+}
+
+// MigratorOption configures Migrator
+type MigratorOption func(*Migrator)
+
+// WithBatchSize sets the number of documents read and written at once
+func WithBatchSize(n int64) MigratorOption {
+	return func(m *Migrator) {
+		m.batchSize = n
+	}
+}
+
+// WithDryRun makes Migrator count conversions without writing anything
+func WithDryRun() MigratorOption {
+	return func(m *Migrator) {
+		m.dryRun = true
+	}
+}
+
+// WithCheckpoints stores checkpoints of migrations in c, one document per migration with the name as _id
+func WithCheckpoints(c Collection) MigratorOption {
+	return func(m *Migrator) {
+		m.checkpoints = c
+	}
+}
+
+func NewMigrator(c Collection, opts ...MigratorOption) *Migrator {
+	m := &Migrator{
+		coll:      c,
+		batchSize: DefaultMigrationBatchSize,
+		registry:  customRegistry(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+type checkpoint struct {
+	LastID bson.RawValue `bson:"lastID"`
+}
+
+// Run applies the migration to all documents of the collection
+func (m *Migrator) Run(ctx context.Context, mig Migration) (MigrationReport, error) {
+	report := MigrationReport{Converted: map[string]int64{}}
+
+	useCheckpoints := m.checkpoints != nil && !m.dryRun
+	if useCheckpoints && mig.Name == "" {
+		return report, ErrMigrationName
+	}
+
+	var lastID bson.RawValue
+	if useCheckpoints {
+		var err error
+		if lastID, err = m.loadCheckpoint(ctx, mig.Name); err != nil {
+			return report, err
+		}
+		if lastID.Type != 0 {
+			report.ResumedAfter = decodeID(lastID)
+		}
+	}
+
+	for {
+		docs, err := m.nextBatch(ctx, lastID)
+		if err != nil {
+			return report, err
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		var models []mongo.WriteModel
+		for _, doc := range docs {
+			report.Scanned++
+			id := doc.Lookup("_id")
+			set := m.convert(doc, id, mig.Conversions, &report)
+			if len(set) == 0 {
+				continue
+			}
+			report.Updated++
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.D{{Key: "_id", Value: id}}).
+				SetUpdate(bson.D{{Key: "$set", Value: set}}))
+		}
+		lastID = docs[len(docs)-1].Lookup("_id")
+
+		if m.dryRun {
+			continue
+		}
+		if err = m.write(ctx, models); err != nil {
+			return report, err
+		}
+		if useCheckpoints {
+			if err = m.saveCheckpoint(ctx, mig.Name, lastID); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if useCheckpoints {
+		_, err := m.checkpoints.DeleteOne(ctx, bson.D{{Key: "_id", Value: mig.Name}})
+		return report, err
+	}
+	return report, nil
+}
+
+func (m *Migrator) nextBatch(ctx context.Context, lastID bson.RawValue) ([]bson.Raw, error) {
+	filter := bson.D{}
+	if lastID.Type != 0 {
+		// $gt only matches _id of the same type bracket as lastID, later brackets are matched by $type
+		filter = bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: lastID}}}}
+		if later := laterIDTypes(lastID.Type); len(later) > 0 {
+			filter = bson.D{{Key: "$or", Value: bson.A{
+				filter,
+				bson.D{{Key: "_id", Value: bson.D{{Key: "$type", Value: later}}}},
+			}}}
+		}
+	}
+	cur, err := m.coll.Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(m.batchSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var docs []bson.Raw
+	for cur.Next(ctx) {
+		docs = append(docs, append(bson.Raw(nil), cur.Current...))
+	}
+	return docs, cur.Err()
+}
+
+// idTypeBrackets are types of _id in the order mongodb sorts values of different types,
+// comparison operators only match values of the same bracket
+var idTypeBrackets = [][]bsontype.Type{
+	{bsontype.MinKey},
+	{bsontype.Undefined, bsontype.Null},
+	{bsontype.Double, bsontype.Int32, bsontype.Int64, bsontype.Decimal128},
+	{bsontype.String, bsontype.Symbol},
+	{bsontype.EmbeddedDocument},
+	{bsontype.Binary},
+	{bsontype.ObjectID},
+	{bsontype.Boolean},
+	{bsontype.DateTime},
+	{bsontype.Timestamp},
+	{bsontype.DBPointer},
+	{bsontype.JavaScript},
+	{bsontype.CodeWithScope},
+	{bsontype.MaxKey},
+}
+
+// laterIDTypes returns type numbers of the brackets sorted after the bracket of t
+func laterIDTypes(t bsontype.Type) bson.A {
+	var later bson.A
+	found := false
+	for _, types := range idTypeBrackets {
+		for _, bt := range types {
+			if found {
+				later = append(later, int32(bt))
+			}
+		}
+		for _, bt := range types {
+			found = found || bt == t
+		}
+	}
+	return later
+}
+
+// convert returns the $set document with converted fields of doc
+func (m *Migrator) convert(doc bson.Raw, id bson.RawValue, conversions []Conversion, report *MigrationReport) bson.D {
+	var set bson.D
+	for _, conv := range conversions {
+		rv, err := doc.LookupErr(strings.Split(conv.Field, ".")...)
+		if err != nil || !conv.applies(rv.Type) {
+			continue
+		}
+
+		v, err := m.convertValue(conv, rv)
+		if err != nil {
+			report.Failures = append(report.Failures, ConversionFailure{ID: decodeID(id), Field: conv.Field, Err: err})
+			continue
+		}
+		report.Converted[conv.Field]++
+		set = append(set, bson.E{Key: conv.Field, Value: v})
+	}
+	return set
+}
+
+// applies reports whether values of type t should be converted,
+// missing values, nulls and values of the target type are skipped
+func (conv Conversion) applies(t bsontype.Type) bool {
+	if t == conv.To || t == bsontype.Null || t == bsontype.Undefined {
+		return false
+	}
+	if len(conv.From) == 0 {
+		return true
+	}
+	for _, from := range conv.From {
+		if t == from {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Migrator) convertValue(conv Conversion, rv bson.RawValue) (interface{}, error) {
+	var v interface{}
+	if err := rv.UnmarshalWithRegistry(m.registry, &v); err != nil {
+		return nil, err
+	}
+	if conv.Convert != nil {
+		return conv.Convert(v)
+	}
+
+	var (
+		res interface{}
+		ok  bool
+	)
+	switch conv.To {
+	case bsontype.DateTime:
+		layout := conv.Layout
+		if layout == "" {
+			layout = time.RFC3339Nano
+		}
+		res, ok = toTime(v, layout)
+	case bsontype.Int64:
+		res, ok = toInt64(v)
+	case bsontype.Int32:
+		var i int64
+		if i, ok = toInt64(v); ok {
+			res, ok = int32(i), int64(int32(i)) == i
+		}
+	case bsontype.Double:
+		res, ok = toFloat64(v)
+	case bsontype.String:
+		res, ok = toString(v)
+		if !ok {
+			res, ok = numberString(v)
+		}
+	case bsontype.Decimal128:
+		var s string
+		if s, ok = numberString(v); ok {
+			var err error
+			res, err = primitive.ParseDecimal128(s)
+			ok = err == nil
+		}
+	default:
+		return nil, fmt.Errorf("conversion to %v is not supported", conv.To)
+	}
+
+	if !ok {
+		return nil, &BagTypeError{Key: conv.Field, Type: conv.To.String(), Value: v}
+	}
+	return res, nil
+}
+
+// numberString formats numbers without losing precision, strings are accepted if they are numbers
+func numberString(v interface{}) (string, bool) {
+	if b, ok := v.(bool); ok {
+		return strconv.FormatBool(b), true
+	}
+	f, ok := toBigFloat(v)
+	if !ok {
+		return "", false
+	}
+	return f.Text('g', -1), true
+}
+
+func (m *Migrator) write(ctx context.Context, models []mongo.WriteModel) error {
+	if len(models) == 0 {
+		return nil
+	}
+	if bw, ok := m.coll.(BulkWriter); ok {
+		_, err := bw.BulkWrite(ctx, models)
+		return err
+	}
+	for _, model := range models {
+		u := model.(*mongo.UpdateOneModel)
+		if _, err := m.coll.UpdateOne(ctx, u.Filter, u.Update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) loadCheckpoint(ctx context.Context, name string) (bson.RawValue, error) {
+	var cp checkpoint
+	err := m.checkpoints.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&cp)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return bson.RawValue{}, nil
+	}
+	if err != nil {
+		return bson.RawValue{}, fmt.Errorf("can't load checkpoint of %v: %w", name, err)
+	}
+	return cp.LastID, nil
+}
+
+func (m *Migrator) saveCheckpoint(ctx context.Context, name string, lastID bson.RawValue) error {
+	_, err := m.checkpoints.UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: name}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "lastID", Value: lastID},
+			{Key: "updatedAt", Value: time.Now()},
+		}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("can't save checkpoint of %v: %w", name, err)
+	}
+	return nil
+}
+
+func decodeID(id bson.RawValue) interface{} {
+	var res interface{}
+	if err := id.Unmarshal(&res); err != nil {
+		return id
+	}
+	return res
+}
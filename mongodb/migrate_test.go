@@ -0,0 +1,205 @@
+package mongodb_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var canonicalData = mongodb.Migration{
+	Name: "canonical-data",
+	Conversions: []mongodb.Conversion{
+		{Field: "data.createdAt", From: []bsontype.Type{bsontype.String}, To: bsontype.DateTime},
+		{Field: "data.count", To: bsontype.Int64},
+	},
+}
+
+func legacyCollection(t *testing.T) *mongotest.Collection {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	docs := []bson.D{
+		{{Key: "_id", Value: "1"}, {Key: "data", Value: bson.D{{Key: "createdAt", Value: "2022-01-01T00:00:00Z"}, {Key: "count", Value: 3.0}}}},
+		{{Key: "_id", Value: "2"}, {Key: "data", Value: bson.D{{Key: "createdAt", Value: created}, {Key: "count", Value: int64(4)}}}},
+		{{Key: "_id", Value: "3"}, {Key: "data", Value: bson.D{{Key: "createdAt", Value: "yesterday"}, {Key: "count", Value: "5"}}}},
+		{{Key: "_id", Value: "4"}, {Key: "data", Value: bson.D{{Key: "count", Value: 4.5}}}},
+		{{Key: "_id", Value: "5"}, {Key: "data", Value: bson.D{{Key: "createdAt", Value: nil}, {Key: "count", Value: int32(6)}}}},
+	}
+	for _, d := range docs {
+		_, err := c.InsertOne(ctx, d)
+		assert.Nil(t, err)
+	}
+	return c
+}
+
+func lookupType(t *testing.T, c *mongotest.Collection, id string, path ...string) bsontype.Type {
+	for _, d := range c.Docs() {
+		if d.Lookup("_id").StringValue() == id {
+			return d.Lookup(path...).Type
+		}
+	}
+	t.Fatalf("document %v not found", id)
+	return 0
+}
+
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	c := legacyCollection(t)
+
+	report, err := mongodb.NewMigrator(c, mongodb.WithDryRun()).Run(ctx, canonicalData)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), report.Scanned)
+	assert.Equal(t, int64(3), report.Updated)
+	assert.Equal(t, map[string]int64{"data.createdAt": 1, "data.count": 3}, report.Converted)
+	assert.Len(t, report.Failures, 2)
+	assert.Equal(t, bsontype.String, lookupType(t, c, "1", "data", "createdAt"))
+
+	report, err = mongodb.NewMigrator(c, mongodb.WithBatchSize(2)).Run(ctx, canonicalData)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), report.Scanned)
+	assert.Equal(t, int64(3), report.Updated)
+
+	assert.Equal(t, bsontype.DateTime, lookupType(t, c, "1", "data", "createdAt"))
+	assert.Equal(t, bsontype.Int64, lookupType(t, c, "1", "data", "count"))
+	assert.Equal(t, bsontype.String, lookupType(t, c, "3", "data", "createdAt"))
+	assert.Equal(t, bsontype.Int64, lookupType(t, c, "3", "data", "count"))
+	assert.Equal(t, bsontype.Double, lookupType(t, c, "4", "data", "count"))
+	assert.Equal(t, bsontype.Null, lookupType(t, c, "5", "data", "createdAt"))
+	assert.Equal(t, bsontype.Int64, lookupType(t, c, "5", "data", "count"))
+
+	var failure mongodb.ConversionFailure
+	assert.ErrorAs(t, report.Failures[0], &failure)
+	assert.Equal(t, "3", failure.ID)
+	assert.Equal(t, "data.createdAt", failure.Field)
+	var typeErr *mongodb.BagTypeError
+	assert.ErrorAs(t, report.Failures[1], &typeErr)
+	assert.Equal(t, 4.5, typeErr.Value)
+
+	var flat struct {
+		Data struct {
+			CreatedAt time.Time `bson:"createdAt"`
+		}
+	}
+	assert.Nil(t, c.FindOne(ctx, bson.D{{Key: "_id", Value: "1"}}).Decode(&flat))
+	assert.Equal(t, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), flat.Data.CreatedAt.UTC())
+
+	report, err = mongodb.NewMigrator(c).Run(ctx, canonicalData)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), report.Updated)
+	assert.Len(t, report.Failures, 2)
+}
+
+func TestMigrationConversions(t *testing.T) {
+	ctx := context.Background()
+
+	tt := []struct {
+		name     string
+		value    interface{}
+		conv     mongodb.Conversion
+		expected bsontype.Type
+	}{
+		{"layout", "01.02.2022", mongodb.Conversion{To: bsontype.DateTime, Layout: "02.01.2006"}, bsontype.DateTime},
+		{"int32", int64(7), mongodb.Conversion{To: bsontype.Int32}, bsontype.Int32},
+		{"int32 overflow", int64(1 << 40), mongodb.Conversion{To: bsontype.Int32}, bsontype.Int64},
+		{"double", "2.5", mongodb.Conversion{To: bsontype.Double}, bsontype.Double},
+		{"string", 2.5, mongodb.Conversion{To: bsontype.String}, bsontype.String},
+		{"decimal", 2.5, mongodb.Conversion{To: bsontype.Decimal128}, bsontype.Decimal128},
+		{"from mismatch", 2.5, mongodb.Conversion{From: []bsontype.Type{bsontype.String}, To: bsontype.Int64}, bsontype.Double},
+		{
+			"custom",
+			"yes",
+			mongodb.Conversion{To: bsontype.Boolean, Convert: func(v interface{}) (interface{}, error) { return v == "yes", nil }},
+			bsontype.Boolean,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				c := mongotest.NewCollection()
+				_, err := c.InsertOne(ctx, bson.D{{Key: "_id", Value: "1"}, {Key: "v", Value: tc.value}})
+				assert.Nil(t, err)
+
+				tc.conv.Field = "v"
+				_, err = mongodb.NewMigrator(c).Run(ctx, mongodb.Migration{Conversions: []mongodb.Conversion{tc.conv}})
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, lookupType(t, c, "1", "v"))
+			},
+		)
+	}
+}
+
+// flakyCollection fails writes after the limit and hides BulkWrite of the underlying collection
+type flakyCollection struct {
+	mongodb.Collection
+	writes int
+}
+
+var errWrite = errors.New("write failed")
+
+func (c *flakyCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if c.writes == 0 {
+		return nil, errWrite
+	}
+	c.writes--
+	return c.Collection.UpdateOne(ctx, filter, update, opts...)
+}
+
+func TestMigrationResume(t *testing.T) {
+	ctx := context.Background()
+	c := legacyCollection(t)
+	checkpoints := mongotest.NewCollection()
+
+	flaky := &flakyCollection{Collection: c, writes: 1}
+	report, err := mongodb.NewMigrator(flaky, mongodb.WithBatchSize(2), mongodb.WithCheckpoints(checkpoints)).Run(ctx, canonicalData)
+	assert.ErrorIs(t, err, errWrite)
+	assert.Equal(t, int64(4), report.Scanned)
+	assert.Equal(t, bsontype.Int64, lookupType(t, c, "1", "data", "count"))
+	assert.Equal(t, bsontype.String, lookupType(t, c, "3", "data", "count"))
+	assert.Len(t, checkpoints.Docs(), 1)
+
+	report, err = mongodb.NewMigrator(c, mongodb.WithBatchSize(2), mongodb.WithCheckpoints(checkpoints)).Run(ctx, canonicalData)
+	assert.Nil(t, err)
+	assert.Equal(t, "2", report.ResumedAfter)
+	assert.Equal(t, int64(3), report.Scanned)
+	assert.Equal(t, int64(2), report.Updated)
+	assert.Equal(t, bsontype.Int64, lookupType(t, c, "3", "data", "count"))
+	assert.Empty(t, checkpoints.Docs())
+
+	_, err = mongodb.NewMigrator(c, mongodb.WithCheckpoints(checkpoints)).Run(ctx, mongodb.Migration{})
+	assert.ErrorIs(t, err, mongodb.ErrMigrationName)
+}
+
+func TestMigrationMixedIDTypes(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+	checkpoints := mongotest.NewCollection()
+
+	// each type is a separate bracket, {$gt: "b"} alone would skip the ObjectID and the date
+	ids := []interface{}{"b", primitive.NewObjectID(), 7, "a", time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for _, id := range ids {
+		_, err := c.InsertOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "data", Value: bson.D{{Key: "count", Value: "1"}}}})
+		assert.Nil(t, err)
+	}
+
+	report, err := mongodb.NewMigrator(c, mongodb.WithBatchSize(2), mongodb.WithCheckpoints(checkpoints)).Run(ctx, canonicalData)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(ids)), report.Scanned)
+	assert.Equal(t, int64(len(ids)), report.Updated)
+	for _, d := range c.Docs() {
+		assert.Equal(t, bsontype.Int64, d.Lookup("data", "count").Type, d.Lookup("_id"))
+	}
+	assert.Empty(t, checkpoints.Docs())
+}
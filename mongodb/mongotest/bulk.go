@@ -0,0 +1,90 @@
+package mongotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BulkWrite applies models one by one with InsertOne, UpdateOne and DeleteOne.
+// Supported models are *mongo.InsertOneModel, *mongo.UpdateOneModel and *mongo.DeleteOneModel.
+// Like the driver, ordered writes (the default) stop at the first write error,
+// unordered ones apply all models, errors are returned as mongo.BulkWriteException
+func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.call(OpBulkWrite); err != nil {
+		return nil, err
+	}
+	if len(models) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+
+	bo := options.MergeBulkWriteOptions(opts...)
+	ordered := bo.Ordered == nil || *bo.Ordered
+
+	res := &mongo.BulkWriteResult{UpsertedIDs: map[int64]interface{}{}}
+	var writeErrors []mongo.BulkWriteError
+
+	for i, model := range models {
+		err := c.applyModel(ctx, model, int64(i), res)
+		if err == nil {
+			continue
+		}
+
+		var we mongo.WriteException
+		if !errors.As(err, &we) || len(we.WriteErrors) == 0 {
+			return res, err
+		}
+		for _, e := range we.WriteErrors {
+			e.Index = i
+			writeErrors = append(writeErrors, mongo.BulkWriteError{WriteError: e, Request: model})
+		}
+		if ordered {
+			break
+		}
+	}
+
+	if len(writeErrors) > 0 {
+		return res, mongo.BulkWriteException{WriteErrors: writeErrors}
+	}
+	return res, nil
+}
+
+func (c *Collection) applyModel(ctx context.Context, model mongo.WriteModel, idx int64, res *mongo.BulkWriteResult) error {
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		if _, err := c.InsertOne(ctx, m.Document); err != nil {
+			return err
+		}
+		res.InsertedCount++
+	case *mongo.UpdateOneModel:
+		uo := options.Update()
+		if m.Upsert != nil {
+			uo.SetUpsert(*m.Upsert)
+		}
+		ur, err := c.UpdateOne(ctx, m.Filter, m.Update, uo)
+		if err != nil {
+			return err
+		}
+		res.MatchedCount += ur.MatchedCount
+		res.ModifiedCount += ur.ModifiedCount
+		res.UpsertedCount += ur.UpsertedCount
+		if ur.UpsertedID != nil {
+			res.UpsertedIDs[idx] = ur.UpsertedID
+		}
+	case *mongo.DeleteOneModel:
+		dr, err := c.DeleteOne(ctx, m.Filter)
+		if err != nil {
+			return err
+		}
+		res.DeletedCount += dr.DeletedCount
+	default:
+		return fmt.Errorf("mongotest: write model %T is not supported", model)
+	}
+	return nil
+}
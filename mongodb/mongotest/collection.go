@@ -0,0 +1,525 @@
+// Package mongotest provides an in-memory collection for testing code
+// which depends on mongodb.Collection without a running mongodb instance.
+//
+// Documents are marshalled to BSON on insert and returned as *mongo.SingleResult
+// built from the stored bytes, so decoding goes through the same codecs
+// as with the real driver: a time.Time put to map[string]interface{}
+// comes back as primitive.DateTime with the default registry,
+// and as time.Time with the registry from mongodb.NewRegistry(mongodb.WithDateTimeAsTime()).
+//
+// Filters support equality and comparison operators: {"id": "1", "n": {"$gt": 1}},
+// results are sorted across types in the mongodb order: numbers, strings, documents, ObjectIDs, dates and so on,
+// updates support $set, $unset, $inc and $push operators,
+// BulkWrite supports insert, update and delete models.
+//
+// Indexes returns an IndexView which keeps index definitions for mongodb.SyncIndexes.
+//
+// Errors can be injected with FailNext to test retries and error handling.
+//
+// EventSource is an in-memory source of change streams for mongodb.Watch.
+package mongotest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Collection is an in-memory collection
+type Collection struct {
+	mu       sync.Mutex
+	registry *bsoncodec.Registry
+	docs     []bson.Raw
+	failures map[string][]error
+	calls    map[string]int
+	indexes  []indexSpec
+}
+
+// Option configures Collection
+type Option func(*Collection)
+
+// WithRegistry sets the registry used to encode and decode documents,
+// the same as the registry of a real collection
+func WithRegistry(reg *bsoncodec.Registry) Option {
+	return func(c *Collection) {
+		c.registry = reg
+	}
+}
+
+func NewCollection(opts ...Option) *Collection {
+	c := &Collection{registry: bson.DefaultRegistry}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// InsertOne stores document, _id is generated if document doesn't have it.
+// Inserting a document with an existing _id returns a duplicate key error
+func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.call(OpInsertOne); err != nil {
+		return nil, err
+	}
+
+	doc, id, err := c.marshalWithID(document)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, d := range c.docs {
+		if d.Lookup("_id").Equal(doc.Lookup("_id")) {
+			return nil, duplicateKeyError(doc.Lookup("_id"))
+		}
+	}
+	c.docs = append(c.docs, doc)
+
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+// FindOne returns the first document matching filter, options are ignored
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	if err := ctx.Err(); err != nil {
+		return c.errResult(err)
+	}
+	if err := c.call(OpFindOne); err != nil {
+		return c.errResult(err)
+	}
+
+	f, err := c.marshal(filter)
+	if err != nil {
+		return c.errResult(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, d := range c.docs {
+		ok, err := matches(d, f)
+		if err != nil {
+			return c.errResult(err)
+		}
+		if ok {
+			return mongo.NewSingleResultFromDocument(d, nil, c.registry)
+		}
+	}
+	return c.errResult(mongo.ErrNoDocuments)
+}
+
+// Find returns all documents matching filter.
+// Skip, Limit, Sort and Projection options are applied, other options are ignored
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.call(OpFind); err != nil {
+		return nil, err
+	}
+
+	f, err := c.marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	found, err := c.filter(f)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	fo := options.MergeFindOptions(opts...)
+	if fo.Sort != nil {
+		sortBy, err := c.marshal(fo.Sort)
+		if err != nil {
+			return nil, err
+		}
+		if err = sortDocs(found, sortBy); err != nil {
+			return nil, err
+		}
+	}
+	if fo.Skip != nil {
+		found = found[minInt(int(*fo.Skip), len(found)):]
+	}
+	if fo.Limit != nil && *fo.Limit > 0 {
+		found = found[:minInt(int(*fo.Limit), len(found))]
+	}
+	if fo.Projection != nil {
+		projection, err := c.marshal(fo.Projection)
+		if err != nil {
+			return nil, err
+		}
+		for i, d := range found {
+			if found[i], err = project(d, projection); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	docs := make([]interface{}, 0, len(found))
+	for _, d := range found {
+		docs = append(docs, d)
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, c.registry)
+}
+
+// CountDocuments returns the number of documents matching filter, options are ignored
+func (c *Collection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := c.call(OpCountDocuments); err != nil {
+		return 0, err
+	}
+
+	f, err := c.marshal(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found, err := c.filter(f)
+	return int64(len(found)), err
+}
+
+// UpdateOne updates the first document matching filter.
+// Supported operators are $set, $unset, $inc and $push, upsert option is respected
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.call(OpUpdateOne); err != nil {
+		return nil, err
+	}
+
+	f, err := c.marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	u, err := c.marshal(update)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, d := range c.docs {
+		ok, err := matches(d, f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		updated, err := applyUpdate(d, u)
+		if err != nil {
+			return nil, err
+		}
+		res := &mongo.UpdateResult{MatchedCount: 1}
+		if !bytes.Equal(updated, d) {
+			c.docs[i] = updated
+			res.ModifiedCount = 1
+		}
+		return res, nil
+	}
+
+	uo := options.MergeUpdateOptions(opts...)
+	if uo.Upsert == nil || !*uo.Upsert {
+		return &mongo.UpdateResult{}, nil
+	}
+
+	base, err := upsertBase(f)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := applyUpdate(base, u)
+	if err != nil {
+		return nil, err
+	}
+	doc, id, err := c.marshalWithID(doc)
+	if err != nil {
+		return nil, err
+	}
+	c.docs = append(c.docs, doc)
+
+	return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: id}, nil
+}
+
+// DeleteOne deletes the first document matching filter, options are ignored
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.call(OpDeleteOne); err != nil {
+		return nil, err
+	}
+
+	f, err := c.marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, d := range c.docs {
+		ok, err := matches(d, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			c.docs = append(c.docs[:i], c.docs[i+1:]...)
+			return &mongo.DeleteResult{DeletedCount: 1}, nil
+		}
+	}
+	return &mongo.DeleteResult{}, nil
+}
+
+// Docs returns copies of all stored documents
+func (c *Collection) Docs() []bson.Raw {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := make([]bson.Raw, 0, len(c.docs))
+	for _, d := range c.docs {
+		res = append(res, append(bson.Raw(nil), d...))
+	}
+	return res
+}
+
+// filter returns documents matching f, c.mu should be held by the caller
+func (c *Collection) filter(f bson.Raw) ([]bson.Raw, error) {
+	var res []bson.Raw
+	for _, d := range c.docs {
+		ok, err := matches(d, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+func (c *Collection) errResult(err error) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(bson.D{}, err, c.registry)
+}
+
+func (c *Collection) marshal(v interface{}) (bson.Raw, error) {
+	if v == nil {
+		return bson.Raw(bsoncore.NewDocumentBuilder().Build()), nil
+	}
+	b, err := bson.MarshalWithRegistry(c.registry, v)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(b), nil
+}
+
+// marshalWithID works like the driver: if there's no _id, ObjectID is prepended to the document
+func (c *Collection) marshalWithID(v interface{}) (bson.Raw, interface{}, error) {
+	doc, err := c.marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if idVal, err := doc.LookupErr("_id"); err == nil {
+		var id interface{}
+		err = idVal.UnmarshalWithRegistry(c.registry, &id)
+		return doc, id, err
+	}
+
+	id := primitive.NewObjectID()
+	elems := doc[4 : len(doc)-1]
+	idx, withID := bsoncore.AppendDocumentStart(nil)
+	withID = bsoncore.AppendObjectIDElement(withID, "_id", id)
+	withID = append(withID, elems...)
+	withID, err = bsoncore.AppendDocumentEnd(withID, idx)
+	return bson.Raw(withID), id, err
+}
+
+// project keeps the fields of doc included by projection or removes the excluded ones,
+// _id is kept unless it's excluded. Only top-level fields are projected: "data.n" keeps the whole data
+func project(doc bson.Raw, projection bson.Raw) (bson.Raw, error) {
+	fields, err := projection.Elements()
+	if err != nil {
+		return nil, err
+	}
+	keep := map[string]bool{}
+	inclusive, keepID := false, true
+	for _, f := range fields {
+		key := strings.SplitN(f.Key(), ".", 2)[0]
+		on, _ := f.Value().BooleanOK()
+		if n, ok := f.Value().AsInt64OK(); ok {
+			on = n != 0
+		}
+		if key == "_id" {
+			keepID = on
+			continue
+		}
+		keep[key] = on
+		inclusive = inclusive || on
+	}
+
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	idx, res := bsoncore.AppendDocumentStart(nil)
+	for _, e := range elems {
+		on, listed := keep[e.Key()]
+		switch {
+		case e.Key() == "_id" && !keepID,
+			e.Key() != "_id" && inclusive && !on,
+			e.Key() != "_id" && !inclusive && listed:
+			continue
+		}
+		res = append(res, e...)
+	}
+	res, err = bsoncore.AppendDocumentEnd(res, idx)
+	return bson.Raw(res), err
+}
+
+// matches reports whether doc matches the filter.
+// Keys can be dotted paths, numbers of different BSON types are compared by value
+// and an array field matches if any of its elements is equal to the filter value.
+// Values can be documents with comparison operators, look at matchOperators,
+// filters can be combined with $and and $or
+func matches(doc bson.Raw, filter bson.Raw) (bool, error) {
+	elems, err := filter.Elements()
+	if err != nil {
+		return false, err
+	}
+	for _, e := range elems {
+		if strings.HasPrefix(e.Key(), "$") {
+			ok, err := matchLogical(doc, e)
+			if err != nil || !ok {
+				return false, err
+			}
+			continue
+		}
+
+		v, err := doc.LookupErr(strings.Split(e.Key(), ".")...)
+		found := err == nil
+
+		if ops, ok := operators(e.Value()); ok {
+			ok, err := matchOperators(v, found, ops)
+			if err != nil || !ok {
+				return false, err
+			}
+			continue
+		}
+
+		if !found || !equal(v, e.Value()) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchLogical reports whether doc matches $and or $or of filters
+func matchLogical(doc bson.Raw, e bson.RawElement) (bool, error) {
+	if e.Key() != "$and" && e.Key() != "$or" {
+		return false, fmt.Errorf("mongotest: operator %v is not supported", e.Key())
+	}
+	values, err := arrayValues(e)
+	if err != nil {
+		return false, err
+	}
+	if len(values) == 0 {
+		return false, fmt.Errorf("mongotest: %v expects a nonempty array", e.Key())
+	}
+
+	isOr := e.Key() == "$or"
+	for _, v := range values {
+		sub, ok := v.DocumentOK()
+		if !ok {
+			return false, fmt.Errorf("mongotest: %v expects documents, got %v", e.Key(), v.Type)
+		}
+		ok, err := matches(doc, sub)
+		if err != nil {
+			return false, err
+		}
+		if ok == isOr {
+			return isOr, nil
+		}
+	}
+	return !isOr, nil
+}
+
+func equal(v bson.RawValue, expected bson.RawValue) bool {
+	if i1, ok := v.AsInt64OK(); ok {
+		if i2, ok := expected.AsInt64OK(); ok && isInteger(v) && isInteger(expected) {
+			return i1 == i2
+		}
+	}
+	if f1, ok := numberOK(v); ok {
+		f2, ok := numberOK(expected)
+		return ok && f1 == f2
+	}
+	if v.Equal(expected) {
+		return true
+	}
+	if arr, ok := v.ArrayOK(); ok && expected.Type != bsontype.Array {
+		values, _ := arr.Values()
+		for _, ev := range values {
+			if equal(ev, expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isInteger(v bson.RawValue) bool {
+	return v.Type == bsontype.Int32 || v.Type == bsontype.Int64
+}
+
+func numberOK(v bson.RawValue) (float64, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return float64(v.Int32()), true
+	case bsontype.Int64:
+		return float64(v.Int64()), true
+	case bsontype.Double:
+		f := v.Double()
+		return f, !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+func number(v bson.RawValue) float64 {
+	f, _ := numberOK(v)
+	return f
+}
+
+func duplicateKeyError(id bson.RawValue) error {
+	return mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{
+			{
+				Code:    11000,
+				Message: fmt.Sprintf("E11000 duplicate key error collection: mongotest index: _id_ dup key: { _id: %v }", id),
+			},
+		},
+	}
+}
@@ -0,0 +1,325 @@
+package mongotest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestInsertAndFindOne(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	res, err := c.InsertOne(ctx, bson.M{"id": "1", "n": int32(1), "tags": []string{"a", "b"}, "data": bson.M{"kind": "a"}})
+	assert.Nil(t, err)
+	assert.IsType(t, primitive.ObjectID{}, res.InsertedID)
+
+	tt := []struct {
+		name   string
+		filter interface{}
+		found  bool
+	}{
+		{"empty filter", nil, true},
+		{"equality", bson.M{"id": "1"}, true},
+		{"number of other type", bson.M{"n": 1.0}, true},
+		{"array element", bson.M{"tags": "b"}, true},
+		{"dotted path", bson.M{"data.kind": "a"}, true},
+		{"operator", bson.M{"n": bson.M{"$gte": 1}}, true},
+		{"unsupported operator", bson.M{"id": bson.M{"$regex": "1"}}, false},
+		{"not equal", bson.M{"id": "2"}, false},
+		{"missing field", bson.M{"missing": "1"}, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				var doc bson.M
+				err := c.FindOne(ctx, tc.filter).Decode(&doc)
+				if tc.found {
+					assert.Nil(t, err)
+					assert.Equal(t, "1", doc["id"])
+				} else {
+					assert.NotNil(t, err)
+				}
+			},
+		)
+	}
+}
+
+func TestFindOneDecodesLikeDriver(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	_, err := c.InsertOne(ctx, bson.M{"id": "1", "data": map[string]interface{}{"createdAt": time.Now()}})
+	assert.Nil(t, err)
+
+	var doc struct {
+		Data map[string]interface{}
+	}
+	err = c.FindOne(ctx, bson.M{"id": "1"}).Decode(&doc)
+	assert.Nil(t, err)
+	assert.IsType(t, primitive.DateTime(0), doc.Data["createdAt"])
+
+	_, err = c.FindOne(ctx, bson.M{"id": "2"}).DecodeBytes()
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+}
+
+func TestInsertDuplicateID(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	_, err := c.InsertOne(ctx, bson.M{"_id": "1"})
+	assert.Nil(t, err)
+
+	_, err = c.InsertOne(ctx, bson.M{"_id": "1"})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	assert.Len(t, c.Docs(), 1)
+}
+
+func TestCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c := mongotest.NewCollection()
+
+	_, err := c.InsertOne(ctx, bson.M{"id": "1"})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, c.FindOne(ctx, bson.M{"id": "1"}).Err(), context.Canceled)
+}
+
+func TestUpdateOne(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	_, err := c.InsertOne(ctx, bson.M{"id": "1", "n": int32(1), "data": bson.M{"a": "a"}})
+	assert.Nil(t, err)
+
+	res, err := c.UpdateOne(ctx, bson.M{"id": "1"}, bson.D{
+		{Key: "$set", Value: bson.M{"data.b": "b"}},
+		{Key: "$unset", Value: bson.M{"data.a": ""}},
+		{Key: "$inc", Value: bson.M{"n": int32(2)}},
+		{Key: "$push", Value: bson.M{"tags": "t"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.MatchedCount)
+	assert.Equal(t, int64(1), res.ModifiedCount)
+
+	var doc bson.M
+	err = c.FindOne(ctx, bson.M{"id": "1"}).Decode(&doc)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), doc["n"])
+	assert.Equal(t, bson.M{"b": "b"}, doc["data"])
+	assert.Equal(t, bson.A{"t"}, doc["tags"])
+
+	res, err = c.UpdateOne(ctx, bson.M{"id": "2"}, bson.M{"$set": bson.M{"n": 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), res.MatchedCount)
+
+	res, err = c.UpdateOne(ctx, bson.M{"id": "2"}, bson.M{"$set": bson.M{"n": 1}}, options.Update().SetUpsert(true))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.UpsertedCount)
+	assert.NotNil(t, res.UpsertedID)
+
+	cnt, err := c.CountDocuments(ctx, bson.M{"id": "2"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), cnt)
+
+	_, err = c.UpdateOne(ctx, bson.M{"id": "1"}, bson.M{"n": 1})
+	assert.NotNil(t, err)
+}
+
+func TestFindAndDelete(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	for _, n := range []int{3, 1, 2} {
+		_, err := c.InsertOne(ctx, bson.M{"kind": "k", "n": n})
+		assert.Nil(t, err)
+	}
+
+	cur, err := c.Find(ctx, bson.M{"kind": "k"}, options.Find().SetSort(bson.M{"n": -1}).SetSkip(1).SetLimit(1))
+	assert.Nil(t, err)
+
+	var docs []bson.M
+	assert.Nil(t, cur.All(ctx, &docs))
+	assert.Len(t, docs, 1)
+	assert.Equal(t, int32(2), docs[0]["n"])
+
+	res, err := c.DeleteOne(ctx, bson.M{"n": 2})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.DeletedCount)
+
+	res, err = c.DeleteOne(ctx, bson.M{"n": 2})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), res.DeletedCount)
+	assert.Len(t, c.Docs(), 2)
+}
+
+func TestSortAcrossTypes(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	for _, id := range []interface{}{time.Now(), primitive.NewObjectID(), "s", 7, 2.5} {
+		_, err := c.InsertOne(ctx, bson.M{"_id": id})
+		assert.Nil(t, err)
+	}
+
+	cur, err := c.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	assert.Nil(t, err)
+	var types []bsontype.Type
+	for cur.Next(ctx) {
+		types = append(types, cur.Current.Lookup("_id").Type)
+	}
+	assert.Equal(t, []bsontype.Type{bsontype.Double, bsontype.Int32, bsontype.String, bsontype.ObjectID, bsontype.DateTime}, types)
+}
+
+func TestFindProjection(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	_, err := c.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}, {Key: "a", Value: 1}, {Key: "b", Value: bson.D{{Key: "c", Value: 2}}}, {Key: "d", Value: 3}})
+	assert.Nil(t, err)
+
+	tt := []struct {
+		name       string
+		projection bson.D
+		keys       []string
+	}{
+		{"inclusion", bson.D{{Key: "a", Value: 1}, {Key: "b.c", Value: true}}, []string{"_id", "a", "b"}},
+		{"inclusion without id", bson.D{{Key: "_id", Value: 0}, {Key: "d", Value: 1}}, []string{"d"}},
+		{"exclusion", bson.D{{Key: "a", Value: 0}}, []string{"_id", "b", "d"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				cur, err := c.Find(ctx, bson.D{}, options.Find().SetProjection(tc.projection))
+				assert.Nil(t, err)
+				assert.True(t, cur.Next(ctx))
+
+				elems, err := cur.Current.Elements()
+				assert.Nil(t, err)
+				var keys []string
+				for _, e := range elems {
+					keys = append(keys, e.Key())
+				}
+				assert.Equal(t, tc.keys, keys)
+			},
+		)
+	}
+}
+
+func TestFilterOperators(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	for _, n := range []interface{}{1, int64(2), 3.5, "4"} {
+		_, err := c.InsertOne(ctx, bson.M{"n": n})
+		assert.Nil(t, err)
+	}
+	_, err := c.InsertOne(ctx, bson.M{"other": 1})
+	assert.Nil(t, err)
+
+	tt := []struct {
+		name   string
+		filter bson.M
+		count  int64
+	}{
+		{"$gt", bson.M{"n": bson.M{"$gt": 1}}, 2},
+		{"$gte and $lt", bson.M{"n": bson.M{"$gte": 2, "$lt": 3.5}}, 1},
+		{"$lte string", bson.M{"n": bson.M{"$lte": "4"}}, 1},
+		{"$eq", bson.M{"n": bson.M{"$eq": 2.0}}, 1},
+		{"$ne", bson.M{"n": bson.M{"$ne": 1}}, 4},
+		{"$in", bson.M{"n": bson.M{"$in": bson.A{1, "4"}}}, 2},
+		{"$nin", bson.M{"n": bson.M{"$nin": bson.A{1, "4"}}}, 3},
+		{"$exists", bson.M{"n": bson.M{"$exists": true}}, 4},
+		{"not $exists", bson.M{"n": bson.M{"$exists": false}}, 1},
+		{"$and", bson.M{"$and": bson.A{bson.M{"n": bson.M{"$gt": 1}}, bson.M{"n": bson.M{"$lt": 3}}}}, 1},
+		{"$or", bson.M{"$or": bson.A{bson.M{"n": "4"}, bson.M{"other": 1}}}, 2},
+		{"$type", bson.M{"n": bson.M{"$type": bson.A{bsontype.Int64, bsontype.String}}}, 2},
+		{"$or in $and", bson.M{"$and": bson.A{bson.M{"n": bson.M{"$exists": true}}, bson.M{"$or": bson.A{bson.M{"n": 1}, bson.M{"n": 3.5}}}}}, 2},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				cnt, err := c.CountDocuments(ctx, tc.filter)
+				assert.Nil(t, err)
+				assert.Equal(t, tc.count, cnt)
+			},
+		)
+	}
+
+	_, err = c.CountDocuments(ctx, bson.M{"$or": bson.A{}})
+	assert.NotNil(t, err)
+}
+
+func TestBulkWrite(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	_, err := c.InsertOne(ctx, bson.M{"_id": "1", "n": 1})
+	assert.Nil(t, err)
+
+	res, err := c.BulkWrite(ctx, []mongo.WriteModel{
+		mongo.NewInsertOneModel().SetDocument(bson.M{"_id": "2"}),
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "1"}).SetUpdate(bson.M{"$set": bson.M{"n": 2}}),
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": "3"}).SetUpdate(bson.M{"$set": bson.M{"n": 3}}).SetUpsert(true),
+		mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": "2"}),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.InsertedCount)
+	assert.Equal(t, int64(1), res.ModifiedCount)
+	assert.Equal(t, int64(1), res.UpsertedCount)
+	assert.Equal(t, "3", res.UpsertedIDs[2])
+	assert.Equal(t, int64(1), res.DeletedCount)
+	assert.Len(t, c.Docs(), 2)
+
+	models := []mongo.WriteModel{
+		mongo.NewInsertOneModel().SetDocument(bson.M{"_id": "1"}),
+		mongo.NewInsertOneModel().SetDocument(bson.M{"_id": "4"}),
+	}
+
+	_, err = c.BulkWrite(ctx, models)
+	var bwe mongo.BulkWriteException
+	assert.ErrorAs(t, err, &bwe)
+	assert.Equal(t, 0, bwe.WriteErrors[0].Index)
+	assert.Len(t, c.Docs(), 2)
+
+	res, err = c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	assert.Equal(t, int64(1), res.InsertedCount)
+	assert.Len(t, c.Docs(), 3)
+}
+
+func TestFailNext(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+	injected := errors.New("injected")
+
+	c.FailNext(mongotest.OpInsertOne, injected)
+	c.FailNext(mongotest.OpFindOne, injected)
+
+	_, err := c.InsertOne(ctx, bson.M{"_id": "1"})
+	assert.ErrorIs(t, err, injected)
+	assert.Empty(t, c.Docs())
+
+	_, err = c.InsertOne(ctx, bson.M{"_id": "1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, c.Calls(mongotest.OpInsertOne))
+
+	assert.ErrorIs(t, c.FindOne(ctx, bson.M{"_id": "1"}).Err(), injected)
+	assert.Nil(t, c.FindOne(ctx, bson.M{"_id": "1"}).Err())
+}
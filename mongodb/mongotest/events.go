@@ -0,0 +1,172 @@
+package mongotest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrTokenNotFound is returned by EventSource.Open if there's no event with the resume token
+var ErrTokenNotFound = errors.New("mongotest: resume token not found")
+
+// EventSource is an in-memory mongodb.EventSource.
+// Events are added with Push and kept forever, so streams can be resumed after any of them.
+// Like real change streams, a new stream gets only events pushed after it's opened
+type EventSource struct {
+	mu     sync.Mutex
+	events []bson.Raw
+	err    error
+	opened []bson.Raw
+	// notify is closed and replaced when something changes
+	notify chan struct{}
+}
+
+func NewEventSource() *EventSource {
+	return &EventSource{notify: make(chan struct{})}
+}
+
+var _ mongodb.EventSource = (*EventSource)(nil)
+
+// Push adds an event with the operation type, {"_id": id} as the document key and the full document,
+// which can be nil. The resume token and cluster time are generated
+func (s *EventSource) Push(operationType string, id interface{}, fullDocument interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := len(s.events) + 1
+	ev, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: fmt.Sprintf("%016x", seq)}}},
+		{Key: "operationType", Value: operationType},
+		{Key: "clusterTime", Value: primitive.Timestamp{T: uint32(seq)}},
+		{Key: "documentKey", Value: bson.D{{Key: "_id", Value: id}}},
+		{Key: "fullDocument", Value: fullDocument},
+	})
+	if err != nil {
+		return err
+	}
+
+	s.events = append(s.events, ev)
+	s.broadcast()
+	return nil
+}
+
+// Fail makes all open streams fail with err
+func (s *EventSource) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	s.broadcast()
+}
+
+// Opened returns resume tokens passed to Open, nil for new streams
+func (s *EventSource) Opened() []bson.Raw {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bson.Raw(nil), s.opened...)
+}
+
+func (s *EventSource) broadcast() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// Open returns a stream of events after resumeAfter, or of new events if it's nil
+func (s *EventSource) Open(ctx context.Context, resumeAfter bson.Raw) (mongodb.ChangeStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.opened = append(s.opened, resumeAfter)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	pos := len(s.events)
+	if resumeAfter != nil {
+		pos = -1
+		for i, ev := range s.events {
+			if bytes.Equal(ev.Lookup("_id").Value, resumeAfter) {
+				pos = i + 1
+				break
+			}
+		}
+		if pos < 0 {
+			return nil, ErrTokenNotFound
+		}
+	}
+	return &changeStream{src: s, pos: pos}, nil
+}
+
+type changeStream struct {
+	src     *EventSource
+	pos     int
+	current bson.Raw
+	err     error
+	closed  bool
+}
+
+// Next waits for the next event until ctx is done, the stream is closed or the source fails
+func (cs *changeStream) Next(ctx context.Context) bool {
+	for {
+		cs.src.mu.Lock()
+		switch {
+		case cs.closed || cs.err != nil:
+			cs.src.mu.Unlock()
+			return false
+		case cs.src.err != nil:
+			cs.err = cs.src.err
+			cs.src.mu.Unlock()
+			return false
+		case cs.pos < len(cs.src.events):
+			cs.current = cs.src.events[cs.pos]
+			cs.pos++
+			cs.src.mu.Unlock()
+			return true
+		}
+		notify := cs.src.notify
+		cs.src.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			cs.src.mu.Lock()
+			cs.err = ctx.Err()
+			cs.src.mu.Unlock()
+			return false
+		case <-notify:
+		}
+	}
+}
+
+func (cs *changeStream) Decode(val interface{}) error {
+	return bson.Unmarshal(cs.current, val)
+}
+
+func (cs *changeStream) ResumeToken() bson.Raw {
+	if cs.current == nil {
+		return nil
+	}
+	return cs.current.Lookup("_id").Document()
+}
+
+func (cs *changeStream) Err() error {
+	cs.src.mu.Lock()
+	defer cs.src.mu.Unlock()
+	return cs.err
+}
+
+func (cs *changeStream) Close(ctx context.Context) error {
+	cs.src.mu.Lock()
+	defer cs.src.mu.Unlock()
+	cs.closed = true
+	cs.src.broadcast()
+	return nil
+}
@@ -0,0 +1,153 @@
+package mongotest
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// operators returns the filter value as a document of operators: {"$gt": 1, "$lt": 10}
+func operators(v bson.RawValue) ([]bson.RawElement, bool) {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return nil, false
+	}
+	first, err := doc.IndexErr(0)
+	if err != nil || !strings.HasPrefix(first.Key(), "$") {
+		return nil, false
+	}
+	elems, err := doc.Elements()
+	return elems, err == nil
+}
+
+// matchOperators reports whether v matches all operators.
+// Supported operators are $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists and $type with type numbers,
+// values of different types are never ordered, like with mongodb type brackets
+func matchOperators(v bson.RawValue, found bool, ops []bson.RawElement) (bool, error) {
+	for _, op := range ops {
+		var ok bool
+		switch op.Key() {
+		case "$eq":
+			ok = found && equal(v, op.Value())
+		case "$ne":
+			ok = !found || !equal(v, op.Value())
+		case "$gt":
+			ok = found && ordered(v, op.Value(), func(c int) bool { return c > 0 })
+		case "$gte":
+			ok = found && ordered(v, op.Value(), func(c int) bool { return c >= 0 })
+		case "$lt":
+			ok = found && ordered(v, op.Value(), func(c int) bool { return c < 0 })
+		case "$lte":
+			ok = found && ordered(v, op.Value(), func(c int) bool { return c <= 0 })
+		case "$in", "$nin":
+			values, err := arrayValues(op)
+			if err != nil {
+				return false, err
+			}
+			in := false
+			for _, ev := range values {
+				if found && equal(v, ev) {
+					in = true
+					break
+				}
+			}
+			ok = in == (op.Key() == "$in")
+		case "$exists":
+			ok = found == truthy(op.Value())
+		case "$type":
+			types, err := typeNumbers(op)
+			if err != nil {
+				return false, err
+			}
+			ok = found && types[v.Type]
+		default:
+			return false, fmt.Errorf("mongotest: operator %v is not supported", op.Key())
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func arrayValues(op bson.RawElement) ([]bson.RawValue, error) {
+	arr, ok := op.Value().ArrayOK()
+	if !ok {
+		return nil, fmt.Errorf("mongotest: %v expects an array, got %v", op.Key(), op.Value().Type)
+	}
+	return arr.Values()
+}
+
+// typeNumbers returns types of $type given as a number or an array of numbers: {"$type": [2, 7]}
+func typeNumbers(op bson.RawElement) (map[bsontype.Type]bool, error) {
+	values := []bson.RawValue{op.Value()}
+	if arr, ok := op.Value().ArrayOK(); ok {
+		var err error
+		if values, err = arr.Values(); err != nil {
+			return nil, err
+		}
+	}
+	types := make(map[bsontype.Type]bool, len(values))
+	for _, tv := range values {
+		n, ok := tv.AsInt64OK()
+		if !ok {
+			return nil, fmt.Errorf("mongotest: $type expects type numbers, got %v", tv.Type)
+		}
+		types[bsontype.Type(n)] = true
+	}
+	return types, nil
+}
+
+// ordered compares v with expected if they are comparable: numbers or values of the same type
+func ordered(v bson.RawValue, expected bson.RawValue, cmp func(int) bool) bool {
+	_, vNum := numberOK(v)
+	_, eNum := numberOK(expected)
+
+	if v.Type != expected.Type && !(vNum && eNum) {
+		return false
+	}
+	return cmp(compare(v, expected))
+}
+
+func truthy(v bson.RawValue) bool {
+	if b, ok := v.BooleanOK(); ok {
+		return b
+	}
+	f, ok := numberOK(v)
+	return ok && f != 0
+}
+
+// typeBrackets are types in the order mongodb sorts values of different types,
+// types of the same bracket are compared by value
+var typeBrackets = [][]bsontype.Type{
+	{bsontype.MinKey},
+	{bsontype.Undefined, bsontype.Null},
+	{bsontype.Double, bsontype.Int32, bsontype.Int64, bsontype.Decimal128},
+	{bsontype.String, bsontype.Symbol},
+	{bsontype.EmbeddedDocument},
+	{bsontype.Array},
+	{bsontype.Binary},
+	{bsontype.ObjectID},
+	{bsontype.Boolean},
+	{bsontype.DateTime},
+	{bsontype.Timestamp},
+	{bsontype.Regex},
+	{bsontype.DBPointer},
+	{bsontype.JavaScript},
+	{bsontype.CodeWithScope},
+	{bsontype.MaxKey},
+}
+
+// typeBracket returns the sort position of values of type t
+func typeBracket(t bsontype.Type) int {
+	for i, types := range typeBrackets {
+		for _, bt := range types {
+			if bt == t {
+				return i
+			}
+		}
+	}
+	return len(typeBrackets)
+}
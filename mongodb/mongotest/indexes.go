@@ -0,0 +1,148 @@
+package mongotest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexView keeps index definitions of Collection, it implements mongodb.IndexView.
+// Indexes are only stored and listed, unique and TTL indexes aren't enforced
+type IndexView struct {
+	c *Collection
+}
+
+// Indexes returns the index view of the collection, like (*mongo.Collection).Indexes
+func (c *Collection) Indexes() *IndexView {
+	return &IndexView{c: c}
+}
+
+type indexSpec struct {
+	Name               string   `bson:"name"`
+	Key                bson.Raw `bson:"key"`
+	Unique             bool     `bson:"unique,omitempty"`
+	Sparse             bool     `bson:"sparse,omitempty"`
+	ExpireAfterSeconds *int32   `bson:"expireAfterSeconds,omitempty"`
+}
+
+func (s indexSpec) sameOptions(other indexSpec) bool {
+	sameTTL := s.ExpireAfterSeconds == nil && other.ExpireAfterSeconds == nil ||
+		s.ExpireAfterSeconds != nil && other.ExpireAfterSeconds != nil && *s.ExpireAfterSeconds == *other.ExpireAfterSeconds
+	return s.Unique == other.Unique && s.Sparse == other.Sparse && sameTTL
+}
+
+// List returns the _id_ index and created indexes, options are ignored
+func (v *IndexView) List(ctx context.Context, opts ...*options.ListIndexesOptions) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := v.c.call(OpListIndexes); err != nil {
+		return nil, err
+	}
+
+	v.c.mu.Lock()
+	defer v.c.mu.Unlock()
+
+	idKey, err := bson.Marshal(bson.D{{Key: "_id", Value: int32(1)}})
+	if err != nil {
+		return nil, err
+	}
+	docs := []interface{}{indexSpec{Name: "_id_", Key: idKey}}
+	for _, s := range v.c.indexes {
+		docs = append(docs, s)
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+// CreateOne stores the index. Like the server, creating an identical index does nothing,
+// and an index with the same name or keys but different options is a conflict
+func (v *IndexView) CreateOne(ctx context.Context, model mongo.IndexModel, opts ...*options.CreateIndexesOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := v.c.call(OpCreateIndex); err != nil {
+		return "", err
+	}
+
+	key, err := v.c.marshal(model.Keys)
+	if err != nil {
+		return "", err
+	}
+	spec := indexSpec{Key: key}
+	if o := model.Options; o != nil {
+		if o.Name != nil {
+			spec.Name = *o.Name
+		}
+		spec.Unique = o.Unique != nil && *o.Unique
+		spec.Sparse = o.Sparse != nil && *o.Sparse
+		spec.ExpireAfterSeconds = o.ExpireAfterSeconds
+	}
+	if spec.Name == "" {
+		if spec.Name, err = indexName(key); err != nil {
+			return "", err
+		}
+	}
+
+	v.c.mu.Lock()
+	defer v.c.mu.Unlock()
+
+	for _, s := range v.c.indexes {
+		sameName, sameKey := s.Name == spec.Name, bytes.Equal(s.Key, spec.Key)
+		switch {
+		case sameName && sameKey && s.sameOptions(spec):
+			return spec.Name, nil
+		case sameName && !sameKey:
+			return "", mongo.CommandError{Code: 86, Name: "IndexKeySpecsConflict", Message: "index with name " + s.Name + " already exists with different keys"}
+		case sameName || sameKey:
+			return "", mongo.CommandError{Code: 85, Name: "IndexOptionsConflict", Message: "index " + s.Name + " already exists with different options"}
+		}
+	}
+	v.c.indexes = append(v.c.indexes, spec)
+	return spec.Name, nil
+}
+
+// DropOne removes the index, the result is always empty
+func (v *IndexView) DropOne(ctx context.Context, name string, opts ...*options.DropIndexesOptions) (bson.Raw, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := v.c.call(OpDropIndex); err != nil {
+		return nil, err
+	}
+	if name == "_id_" {
+		return nil, mongo.CommandError{Code: 72, Name: "InvalidOptions", Message: "cannot drop _id index"}
+	}
+
+	v.c.mu.Lock()
+	defer v.c.mu.Unlock()
+
+	for i, s := range v.c.indexes {
+		if s.Name == name {
+			v.c.indexes = append(v.c.indexes[:i], v.c.indexes[i+1:]...)
+			return bson.Raw{}, nil
+		}
+	}
+	return nil, mongo.CommandError{Code: 27, Name: "IndexNotFound", Message: "index not found with name [" + name + "]"}
+}
+
+// indexName generates the name the same way as the driver does: a_1_b_-1
+func indexName(key bson.Raw) (string, error) {
+	elems, err := key.Elements()
+	if err != nil {
+		return "", err
+	}
+	parts := make([]string, 0, len(elems))
+	for _, e := range elems {
+		var order interface{}
+		if err = e.Value().Unmarshal(&order); err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%v_%v", e.Key(), order))
+	}
+	return strings.Join(parts, "_"), nil
+}
@@ -0,0 +1,51 @@
+package mongotest
+
+// Operation names for FailNext
+const (
+	OpInsertOne      = "InsertOne"
+	OpFindOne        = "FindOne"
+	OpFind           = "Find"
+	OpCountDocuments = "CountDocuments"
+	OpUpdateOne      = "UpdateOne"
+	OpDeleteOne      = "DeleteOne"
+	OpBulkWrite      = "BulkWrite"
+	OpListIndexes    = "Indexes.List"
+	OpCreateIndex    = "Indexes.CreateOne"
+	OpDropIndex      = "Indexes.DropOne"
+)
+
+// FailNext makes the next calls of the operation return errs one by one instead of doing anything,
+// e.g. FailNext(OpInsertOne, netErr, netErr) fails two inserts and lets the third one through.
+// Models of BulkWrite are applied with InsertOne, UpdateOne and DeleteOne, so their errors apply as well
+func (c *Collection) FailNext(op string, errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures == nil {
+		c.failures = map[string][]error{}
+	}
+	c.failures[op] = append(c.failures[op], errs...)
+}
+
+// Calls returns the number of calls of the operation including failed ones
+func (c *Collection) Calls(op string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[op]
+}
+
+// call counts the call of op and returns the injected error if there's one
+func (c *Collection) call(op string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = map[string]int{}
+	}
+	c.calls[op]++
+
+	errs := c.failures[op]
+	if len(errs) == 0 {
+		return nil
+	}
+	c.failures[op] = errs[1:]
+	return errs[0]
+}
@@ -0,0 +1,285 @@
+package mongotest
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// applyUpdate applies update operators to doc.
+// Documents are modified as bson.D, so types of untouched values are kept as is
+func applyUpdate(doc bson.Raw, update bson.Raw) (bson.Raw, error) {
+	var d bson.D
+	if err := bson.Unmarshal(doc, &d); err != nil {
+		return nil, err
+	}
+
+	ops, err := update.Elements()
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("mongotest: update document is empty")
+	}
+
+	for _, op := range ops {
+		if !strings.HasPrefix(op.Key(), "$") {
+			return nil, fmt.Errorf("mongotest: replacement documents are not supported, got key %v", op.Key())
+		}
+		fields, ok := op.Value().DocumentOK()
+		if !ok {
+			return nil, fmt.Errorf("mongotest: %v expects a document, got %v", op.Key(), op.Value().Type)
+		}
+		elems, err := fields.Elements()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range elems {
+			path := strings.Split(f.Key(), ".")
+			cur, _ := getPath(d, path)
+			v, err := toValue(f.Value())
+			if err != nil {
+				return nil, err
+			}
+
+			switch op.Key() {
+			case "$set":
+				d, err = setPath(d, path, v)
+			case "$unset":
+				d = unsetPath(d, path)
+			case "$inc":
+				var sum interface{}
+				sum, err = inc(cur, f.Value())
+				if err == nil {
+					d, err = setPath(d, path, sum)
+				}
+			case "$push":
+				arr, ok := cur.(primitive.A)
+				if cur != nil && !ok {
+					return nil, fmt.Errorf("mongotest: $push to non-array field %v", f.Key())
+				}
+				d, err = setPath(d, path, append(arr, v))
+			default:
+				return nil, fmt.Errorf("mongotest: update operator %v is not supported", op.Key())
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return bson.Marshal(d)
+}
+
+// upsertBase builds the document for upsert from the equality fields of filter
+func upsertBase(filter bson.Raw) (bson.Raw, error) {
+	elems, err := filter.Elements()
+	if err != nil {
+		return nil, err
+	}
+	d := bson.D{}
+	for _, e := range elems {
+		v, err := toValue(e.Value())
+		if err != nil {
+			return nil, err
+		}
+		d, err = setPath(d, strings.Split(e.Key(), "."), v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bson.Marshal(d)
+}
+
+// toValue decodes rv the same way as values of documents decoded to bson.D:
+// embedded documents become bson.D and arrays become primitive.A
+func toValue(rv bson.RawValue) (interface{}, error) {
+	wrapped, err := bson.Marshal(bson.D{{Key: "v", Value: rv}})
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err = bson.Unmarshal(wrapped, &d); err != nil {
+		return nil, err
+	}
+	return d[0].Value, nil
+}
+
+func getPath(d bson.D, path []string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return e.Value, true
+		}
+		if sub, ok := e.Value.(bson.D); ok {
+			return getPath(sub, path[1:])
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+func setPath(d bson.D, path []string, v interface{}) (bson.D, error) {
+	for i, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			d[i].Value = v
+			return d, nil
+		}
+		sub, ok := e.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("mongotest: can't set %v inside non-document field %v", strings.Join(path[1:], "."), e.Key)
+		}
+		sub, err := setPath(sub, path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		d[i].Value = sub
+		return d, nil
+	}
+
+	if len(path) == 1 {
+		return append(d, bson.E{Key: path[0], Value: v}), nil
+	}
+	sub, err := setPath(bson.D{}, path[1:], v)
+	if err != nil {
+		return nil, err
+	}
+	return append(d, bson.E{Key: path[0], Value: sub}), nil
+}
+
+func unsetPath(d bson.D, path []string) bson.D {
+	for i, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return append(d[:i], d[i+1:]...)
+		}
+		if sub, ok := e.Value.(bson.D); ok {
+			d[i].Value = unsetPath(sub, path[1:])
+		}
+		return d
+	}
+	return d
+}
+
+// inc adds by to cur with the same type promotion as the server: int32 -> int64 -> double
+func inc(cur interface{}, by bson.RawValue) (interface{}, error) {
+	if cur == nil {
+		cur = int32(0)
+	}
+
+	switch by.Type {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double:
+	default:
+		return nil, fmt.Errorf("mongotest: $inc expects a number, got %v", by.Type)
+	}
+
+	switch c := cur.(type) {
+	case float64:
+		return c + number(by), nil
+	case int32:
+		switch by.Type {
+		case bsontype.Double:
+			return float64(c) + by.Double(), nil
+		case bsontype.Int64:
+			return int64(c) + by.Int64(), nil
+		}
+		sum := int64(c) + int64(by.Int32())
+		if sum > math.MaxInt32 || sum < math.MinInt32 {
+			return sum, nil
+		}
+		return int32(sum), nil
+	case int64:
+		if by.Type == bsontype.Double {
+			return float64(c) + by.Double(), nil
+		}
+		i, _ := by.AsInt64OK()
+		return c + i, nil
+	}
+	return nil, fmt.Errorf("mongotest: $inc of non-numeric value %T", cur)
+}
+
+// sortDocs sorts docs by the fields of sortBy, 1 is ascending and -1 is descending order
+func sortDocs(docs []bson.Raw, sortBy bson.Raw) error {
+	keys, err := sortBy.Elements()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, k := range keys {
+			dir, _ := k.Value().AsInt64OK()
+			path := strings.Split(k.Key(), ".")
+			vi, _ := docs[i].LookupErr(path...)
+			vj, _ := docs[j].LookupErr(path...)
+			c := compare(vi, vj)
+			if c == 0 {
+				continue
+			}
+			if dir < 0 {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
+
+// compare orders missing values first, values of different types by type brackets
+// and values of the same type by value or by bytes
+func compare(a, b bson.RawValue) int {
+	if a.Type == 0 || b.Type == 0 {
+		return int(a.Type) - int(b.Type)
+	}
+	if fa, ok := numberOK(a); ok {
+		if fb, ok := numberOK(b); ok {
+			switch {
+			case fa < fb:
+				return -1
+			case fa > fb:
+				return 1
+			}
+			return 0
+		}
+	}
+	if sa, ok := a.StringValueOK(); ok {
+		if sb, ok := b.StringValueOK(); ok {
+			return strings.Compare(sa, sb)
+		}
+	}
+	if da, ok := a.DateTimeOK(); ok {
+		if db, ok := b.DateTimeOK(); ok {
+			switch {
+			case da < db:
+				return -1
+			case da > db:
+				return 1
+			}
+			return 0
+		}
+	}
+	if a.Type != b.Type {
+		return typeBracket(a.Type) - typeBracket(b.Type)
+	}
+	return bytes.Compare(a.Value, b.Value)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
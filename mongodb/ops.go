@@ -0,0 +1,44 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+)
+
+// Context propagation
+//
+// Every Exec* function has a *Context variant which accepts a context,
+// so the caller (for example an http handler with r.Context()) is able
+// to abort Mongo work on cancellation or when the deadline is exceeded.
+// The context is passed down to every driver call.
+//
+// Additionally each single operation (insert, find, etc.) can be bounded by WithTimeout:
+//
+// res, err := mongodb.ExecWithFlatContext(r.Context(), conStr, db, coll, id, mongodb.WithTimeout(time.Second))
+//
+// The operation timeout never extends the deadline of the parent context.
+
+// OpOption configures a single operation
+type OpOption func(*opConfig)
+
+type opConfig struct {
+	timeout time.Duration
+}
+
+// WithTimeout bounds every single operation by d, zero means no additional timeout
+func WithTimeout(d time.Duration) OpOption {
+	return func(c *opConfig) {
+		c.timeout = d
+	}
+}
+
+func withOpTimeout(ctx context.Context, opts ...OpOption) (context.Context, context.CancelFunc) {
+	var cfg opConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, cfg.timeout)
+}
@@ -0,0 +1,33 @@
+package mongodb_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecContextCancellation(t *testing.T) {
+	conStr := "mongodb://localhost:1/"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := mongodb.ExecWithFlatContext(ctx, conStr, "test", "test_decoding", "canceled")
+	assert.True(t, errors.Is(err, context.Canceled), err)
+}
+
+func TestExecContextDeadline(t *testing.T) {
+	conStr := "mongodb://localhost:1/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := mongodb.ExecWithNestedMapCustomMapTypeContext(ctx, conStr, "test", "test_decoding", "deadline", mongodb.WithTimeout(time.Minute))
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,466 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+)
+
+// Typed filters and updates
+//
+// Problem description:
+// filters are written as primitive.M{"id": id} literals, and a typo in a field name
+// isn't an error: the query silently matches nothing and returns ErrNoDocuments.
+//
+// Filters and updates can be built with functions instead:
+//
+// f := mongodb.And(
+// 		mongodb.Eq("id", id),
+// 		mongodb.Range("date", from, to),
+// 		mongodb.Or(mongodb.Exists("deletedAt", false), mongodb.In("status", "active", "pending")),
+// )
+// u := mongodb.Set("date", time.Now()).Inc("version", 1)
+//
+// Both can be passed to Collection methods as is (they implement bson.Marshaler)
+// and rendered for logging: id = "1" AND "2022-01-01T00:00:00Z" <= date < "2023-01-01T00:00:00Z".
+//
+// Validate and ValidateUpdate check field names against bson tags of a struct,
+// fields of nested structs and slices are addressed with dots, anything is allowed
+// under maps and interface{}, e.g. "data.createdAt" for CustomNestedMapStruct:
+//
+// f := mongodb.Validate[mongodb.CustomFlatStructure](mongodb.Eq("idd", id))
+// err := f.Err() // unknown field idd of mongodb.CustomFlatStructure
+//
+// Collection methods fail with the same error when they encode an invalid filter or update.
+//
+// Values are encoded with customRegistry by default. They have to be encoded the same way
+// as the stored documents (uints, times, decimals, etc.), otherwise the filter silently matches nothing,
+// so pass the registry of the collection when it isn't customRegistry:
+//
+// f := mongodb.Eq("hits", uint64(5)).WithRegistry(reg)
+// u := mongodb.Set("date", time.Now()).WithRegistry(reg)
+
+// queryRegistry encodes values of filters and updates without a registry
+var queryRegistry = customRegistry()
+
+// ErrEmptyOr is the error of Or without filters, the server rejects an empty $or
+var ErrEmptyOr = errors.New("empty Or filter, at least one filter is needed")
+
+// UnknownFieldError is the error of filters and updates with fields which T doesn't have
+type UnknownFieldError struct {
+	Type  reflect.Type
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %v of %v", e.Field, e.Type)
+}
+
+// Filter is a query filter
+type Filter struct {
+	op       string
+	field    string
+	values   []interface{}
+	nested   []Filter
+	err      error
+	registry *bsoncodec.Registry
+}
+
+const (
+	opEq        = "$eq"
+	opIn        = "$in"
+	opRange     = "range"
+	opExists    = "$exists"
+	opElemMatch = "$elemMatch"
+	opAnd       = "$and"
+	opOr        = "$or"
+)
+
+// Eq matches documents with field equal to v, for arrays any element can be equal to v
+func Eq(field string, v interface{}) Filter {
+	return Filter{op: opEq, field: field, values: []interface{}{v}}
+}
+
+// In matches documents with field equal to any of values
+func In(field string, values ...interface{}) Filter {
+	return Filter{op: opIn, field: field, values: values}
+}
+
+// Range matches documents with from <= field < to, nil bounds are omitted,
+// Range with both bounds nil matches all documents
+func Range(field string, from, to interface{}) Filter {
+	return Filter{op: opRange, field: field, values: []interface{}{from, to}}
+}
+
+// Exists matches documents which have (or don't have) field
+func Exists(field string, exists bool) Filter {
+	return Filter{op: opExists, field: field, values: []interface{}{exists}}
+}
+
+// ElemMatch matches documents with an element of array field matching f,
+// fields of f are fields of the elements
+func ElemMatch(field string, f Filter) Filter {
+	return Filter{op: opElemMatch, field: field, nested: []Filter{f}}
+}
+
+// And matches documents matching all filters, And() matches all documents
+func And(filters ...Filter) Filter {
+	return Filter{op: opAnd, nested: filters}
+}
+
+// Or matches documents matching any of filters, Or() is invalid (see ErrEmptyOr)
+func Or(filters ...Filter) Filter {
+	f := Filter{op: opOr, nested: filters}
+	if len(filters) == 0 {
+		f.err = ErrEmptyOr
+	}
+	return f
+}
+
+// Err returns the validation error of the filter
+func (f Filter) Err() error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, n := range f.nested {
+		if err := n.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// D returns the filter as a BSON document
+func (f Filter) D() bson.D {
+	switch f.op {
+	case opEq:
+		return bson.D{{Key: f.field, Value: f.values[0]}}
+	case opIn:
+		return bson.D{{Key: f.field, Value: bson.D{{Key: opIn, Value: bson.A(f.values)}}}}
+	case opRange:
+		var bounds bson.D
+		if f.values[0] != nil {
+			bounds = append(bounds, bson.E{Key: "$gte", Value: f.values[0]})
+		}
+		if f.values[1] != nil {
+			bounds = append(bounds, bson.E{Key: "$lt", Value: f.values[1]})
+		}
+		if len(bounds) == 0 {
+			return bson.D{}
+		}
+		return bson.D{{Key: f.field, Value: bounds}}
+	case opExists:
+		return bson.D{{Key: f.field, Value: bson.D{{Key: opExists, Value: f.values[0]}}}}
+	case opElemMatch:
+		return bson.D{{Key: f.field, Value: bson.D{{Key: opElemMatch, Value: f.nested[0].D()}}}}
+	case opAnd, opOr:
+		if f.op == opAnd && len(f.nested) == 0 {
+			return bson.D{}
+		}
+		arr := make(bson.A, 0, len(f.nested))
+		for _, n := range f.nested {
+			arr = append(arr, n.D())
+		}
+		return bson.D{{Key: f.op, Value: arr}}
+	}
+	return bson.D{}
+}
+
+// WithRegistry returns f which encodes values with reg,
+// registries of nested filters aren't used, the registry of the outermost filter encodes all values
+func (f Filter) WithRegistry(reg *bsoncodec.Registry) Filter {
+	f.registry = reg
+	return f
+}
+
+// MarshalBSON encodes the filter, invalid filters return the validation error
+func (f Filter) MarshalBSON() ([]byte, error) {
+	if err := f.Err(); err != nil {
+		return nil, err
+	}
+	return bson.MarshalWithRegistry(orQueryRegistry(f.registry), f.D())
+}
+
+func orQueryRegistry(reg *bsoncodec.Registry) *bsoncodec.Registry {
+	if reg == nil {
+		return queryRegistry
+	}
+	return reg
+}
+
+// String renders the filter for logging
+func (f Filter) String() string {
+	switch f.op {
+	case opEq:
+		return fmt.Sprintf("%v = %v", f.field, formatValue(f.values[0]))
+	case opIn:
+		values := make([]string, 0, len(f.values))
+		for _, v := range f.values {
+			values = append(values, formatValue(v))
+		}
+		return fmt.Sprintf("%v IN [%v]", f.field, strings.Join(values, ", "))
+	case opRange:
+		from, to := f.values[0], f.values[1]
+		switch {
+		case from != nil && to != nil:
+			return fmt.Sprintf("%v <= %v < %v", formatValue(from), f.field, formatValue(to))
+		case from != nil:
+			return fmt.Sprintf("%v >= %v", f.field, formatValue(from))
+		case to != nil:
+			return fmt.Sprintf("%v < %v", f.field, formatValue(to))
+		}
+		return "TRUE"
+	case opExists:
+		if f.values[0] == true {
+			return fmt.Sprintf("%v EXISTS", f.field)
+		}
+		return fmt.Sprintf("%v NOT EXISTS", f.field)
+	case opElemMatch:
+		return fmt.Sprintf("%v ANY (%v)", f.field, f.nested[0])
+	case opAnd, opOr:
+		if len(f.nested) == 0 && f.op == opOr {
+			return "FALSE"
+		}
+		if len(f.nested) == 0 {
+			return "TRUE"
+		}
+		sep := " AND "
+		if f.op == opOr {
+			sep = " OR "
+		}
+		parts := make([]string, 0, len(f.nested))
+		for _, n := range f.nested {
+			s := n.String()
+			if (n.op == opAnd || n.op == opOr) && len(n.nested) > 1 {
+				s = "(" + s + ")"
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, sep)
+	}
+	return ""
+}
+
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return strconv.Quote(val)
+	case time.Time:
+		return strconv.Quote(val.Format(time.RFC3339Nano))
+	case nil:
+		return "null"
+	}
+	return fmt.Sprint(v)
+}
+
+// validate sets errors of fields which t doesn't have
+func (f Filter) validate(t reflect.Type) Filter {
+	if f.field != "" {
+		ft, ok := fieldType(t, f.field)
+		if !ok {
+			f.err = &UnknownFieldError{Type: t, Field: f.field}
+			return f
+		}
+		if f.op == opElemMatch {
+			t = elemType(ft)
+		}
+	}
+
+	if len(f.nested) > 0 {
+		nested := make([]Filter, 0, len(f.nested))
+		for _, n := range f.nested {
+			nested = append(nested, n.validate(t))
+		}
+		f.nested = nested
+	}
+	return f
+}
+
+// Validate returns f with an error if it has fields which T doesn't have
+func Validate[T any](f Filter) Filter {
+	return f.validate(reflect.TypeOf((*T)(nil)).Elem())
+}
+
+// Update is a list of update operators
+type Update struct {
+	ops      []updateOp
+	err      error
+	registry *bsoncodec.Registry
+}
+
+type updateOp struct {
+	op    string
+	field string
+	value interface{}
+}
+
+// Set sets field to v
+func Set(field string, v interface{}) Update {
+	return Update{}.Set(field, v)
+}
+
+// Inc increments field by n
+func Inc(field string, n interface{}) Update {
+	return Update{}.Inc(field, n)
+}
+
+// Push appends v to array field
+func Push(field string, v interface{}) Update {
+	return Update{}.Push(field, v)
+}
+
+// Set adds setting field to v
+func (u Update) Set(field string, v interface{}) Update {
+	return u.with("$set", field, v)
+}
+
+// Inc adds incrementing field by n
+func (u Update) Inc(field string, n interface{}) Update {
+	return u.with("$inc", field, n)
+}
+
+// Push adds appending v to array field
+func (u Update) Push(field string, v interface{}) Update {
+	return u.with("$push", field, v)
+}
+
+func (u Update) with(op, field string, v interface{}) Update {
+	ops := make([]updateOp, 0, len(u.ops)+1)
+	ops = append(ops, u.ops...)
+	u.ops = append(ops, updateOp{op: op, field: field, value: v})
+	return u
+}
+
+// Err returns the validation error of the update
+func (u Update) Err() error {
+	return u.err
+}
+
+// D returns the update as a BSON document, operators are in the order of their first use
+func (u Update) D() bson.D {
+	var res bson.D
+	byOp := map[string]int{}
+	for _, op := range u.ops {
+		i, ok := byOp[op.op]
+		if !ok {
+			i = len(res)
+			byOp[op.op] = i
+			res = append(res, bson.E{Key: op.op, Value: bson.D{}})
+		}
+		res[i].Value = append(res[i].Value.(bson.D), bson.E{Key: op.field, Value: op.value})
+	}
+	return res
+}
+
+// WithRegistry returns u which encodes values with reg
+func (u Update) WithRegistry(reg *bsoncodec.Registry) Update {
+	u.registry = reg
+	return u
+}
+
+// MarshalBSON encodes the update, invalid updates return the validation error
+func (u Update) MarshalBSON() ([]byte, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	return bson.MarshalWithRegistry(orQueryRegistry(u.registry), u.D())
+}
+
+// String renders the update for logging
+func (u Update) String() string {
+	parts := make([]string, 0, len(u.ops))
+	for _, op := range u.ops {
+		switch op.op {
+		case "$set":
+			parts = append(parts, fmt.Sprintf("SET %v = %v", op.field, formatValue(op.value)))
+		case "$inc":
+			parts = append(parts, fmt.Sprintf("INC %v BY %v", op.field, formatValue(op.value)))
+		case "$push":
+			parts = append(parts, fmt.Sprintf("PUSH %v TO %v", formatValue(op.value), op.field))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ValidateUpdate returns u with an error if it has fields which T doesn't have
+func ValidateUpdate[T any](u Update) Update {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	for _, op := range u.ops {
+		if _, ok := fieldType(t, op.field); !ok {
+			u.err = &UnknownFieldError{Type: t, Field: op.field}
+			return u
+		}
+	}
+	return u
+}
+
+// fieldType returns the type of the dotted path in t,
+// array indexes and positional operators ($, $[]) are allowed for slices,
+// _id is allowed for all structs as every document has it
+func fieldType(t reflect.Type, path string) (reflect.Type, bool) {
+	segments := strings.Split(path, ".")
+	if segments[0] == "_id" {
+		if ft, ok := walkField(t, segments); ok {
+			return ft, true
+		}
+		return tEmpty, true
+	}
+	return walkField(t, segments)
+}
+
+func walkField(t reflect.Type, segments []string) (reflect.Type, bool) {
+	for len(segments) > 0 {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		switch t.Kind() {
+		case reflect.Map, reflect.Interface:
+			return tEmpty, true
+		case reflect.Slice, reflect.Array:
+			if t.Elem().Kind() == reflect.Uint8 {
+				return nil, false
+			}
+			if isArrayIndex(segments[0]) {
+				segments = segments[1:]
+			}
+			// arrays of documents can be queried by the fields of their elements
+			t = t.Elem()
+		case reflect.Struct:
+			_, ft := structField(t, segments[0])
+			if ft == nil {
+				return nil, false
+			}
+			t = ft
+			segments = segments[1:]
+		default:
+			return nil, false
+		}
+	}
+	return t, true
+}
+
+func isArrayIndex(s string) bool {
+	if s == "$" || s == "$[]" {
+		return true
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// elemType returns the type of array elements for $elemMatch
+func elemType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		return t.Elem()
+	}
+	return tEmpty
+}
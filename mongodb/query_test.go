@@ -0,0 +1,254 @@
+package mongodb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+type queryItem struct {
+	SKU string `bson:"sku"`
+	Qty int    `bson:"qty"`
+}
+
+type queryOrder struct {
+	ID      string                 `bson:"_id"`
+	Status  string                 `bson:"status"`
+	Total   *int                   `bson:"total,omitempty"`
+	Created time.Time              `bson:"created"`
+	Items   []queryItem            `bson:"items"`
+	Tags    []string               `bson:"tags"`
+	Meta    map[string]interface{} `bson:"meta"`
+}
+
+func extJSON(t *testing.T, v interface{}) string {
+	data, err := bson.Marshal(v)
+	assert.Nil(t, err)
+	js, err := bson.MarshalExtJSON(bson.Raw(data), false, false)
+	assert.Nil(t, err)
+	return string(js)
+}
+
+func TestFilterBSONAndString(t *testing.T) {
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(1, 0, 0)
+
+	tt := []struct {
+		name   string
+		filter mongodb.Filter
+		json   string
+		str    string
+	}{
+		{
+			"eq",
+			mongodb.Eq("status", "active"),
+			`{"status":"active"}`,
+			`status = "active"`,
+		},
+		{
+			"in",
+			mongodb.In("qty", 1, 2),
+			`{"qty":{"$in":[1,2]}}`,
+			`qty IN [1, 2]`,
+		},
+		{
+			"range",
+			mongodb.Range("created", from, to),
+			`{"created":{"$gte":{"$date":"2022-01-01T00:00:00Z"},"$lt":{"$date":"2023-01-01T00:00:00Z"}}}`,
+			`"2022-01-01T00:00:00Z" <= created < "2023-01-01T00:00:00Z"`,
+		},
+		{
+			"range without upper bound",
+			mongodb.Range("qty", 5, nil),
+			`{"qty":{"$gte":5}}`,
+			`qty >= 5`,
+		},
+		{
+			"exists",
+			mongodb.Exists("total", false),
+			`{"total":{"$exists":false}}`,
+			`total NOT EXISTS`,
+		},
+		{
+			"elem match",
+			mongodb.ElemMatch("items", mongodb.And(mongodb.Eq("sku", "a"), mongodb.Range("qty", nil, 3))),
+			`{"items":{"$elemMatch":{"$and":[{"sku":"a"},{"qty":{"$lt":3}}]}}}`,
+			`items ANY (sku = "a" AND qty < 3)`,
+		},
+		{
+			"and with or",
+			mongodb.And(mongodb.Eq("_id", "1"), mongodb.Or(mongodb.Eq("status", "a"), mongodb.Exists("total", true))),
+			`{"$and":[{"_id":"1"},{"$or":[{"status":"a"},{"total":{"$exists":true}}]}]}`,
+			`_id = "1" AND (status = "a" OR total EXISTS)`,
+		},
+		{
+			"empty and",
+			mongodb.And(),
+			`{}`,
+			`TRUE`,
+		},
+		{
+			"range without bounds",
+			mongodb.And(mongodb.Eq("status", "a"), mongodb.Range("qty", nil, nil)),
+			`{"$and":[{"status":"a"},{}]}`,
+			`status = "a" AND TRUE`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				assert.Equal(t, tc.json, extJSON(t, tc.filter))
+				assert.Equal(t, tc.str, tc.filter.String())
+			},
+		)
+	}
+}
+
+func TestEmptyOr(t *testing.T) {
+	f := mongodb.And(mongodb.Eq("status", "a"), mongodb.Or())
+	assert.ErrorIs(t, f.Err(), mongodb.ErrEmptyOr)
+	assert.Equal(t, `status = "a" AND FALSE`, f.String())
+
+	_, err := bson.Marshal(mongodb.Validate[queryOrder](f))
+	assert.ErrorIs(t, err, mongodb.ErrEmptyOr)
+}
+
+func TestUpdateBSONAndString(t *testing.T) {
+	u := mongodb.Set("status", "paid").Inc("total", 10).Push("tags", "vip").Set("meta.source", "web")
+
+	assert.Equal(
+		t,
+		`{"$set":{"status":"paid","meta.source":"web"},"$inc":{"total":10},"$push":{"tags":"vip"}}`,
+		extJSON(t, u),
+	)
+	assert.Equal(t, `SET status = "paid", INC total BY 10, PUSH "vip" TO tags, SET meta.source = "web"`, u.String())
+}
+
+func TestValidate(t *testing.T) {
+	tt := []struct {
+		name   string
+		filter mongodb.Filter
+		field  string
+	}{
+		{"known field", mongodb.Eq("status", "a"), ""},
+		{"id", mongodb.Eq("_id", "1"), ""},
+		{"pointer field", mongodb.Exists("total", true), ""},
+		{"array element field", mongodb.Eq("items.sku", "a"), ""},
+		{"array index", mongodb.Eq("items.0.qty", 1), ""},
+		{"array of scalars", mongodb.Eq("tags", "vip"), ""},
+		{"map key", mongodb.Eq("meta.anything.deeper", 1), ""},
+		{"elem match field", mongodb.ElemMatch("items", mongodb.Eq("qty", 1)), ""},
+		{"unknown field", mongodb.Eq("statuss", "a"), "statuss"},
+		{"go field name", mongodb.Eq("Status", "a"), "Status"},
+		{"unknown nested field", mongodb.Eq("items.price", 1), "items.price"},
+		{"field of time", mongodb.Eq("created.day", 1), "created.day"},
+		{"unknown field in or", mongodb.Or(mongodb.Eq("status", "a"), mongodb.In("state", "b")), "state"},
+		{"unknown elem match field", mongodb.ElemMatch("items", mongodb.Eq("price", 1)), "price"},
+		{"order field in elem match", mongodb.ElemMatch("items", mongodb.Eq("status", "a")), "status"},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				f := mongodb.Validate[queryOrder](tc.filter)
+				if tc.field == "" {
+					assert.Nil(t, f.Err())
+					return
+				}
+
+				var ufe *mongodb.UnknownFieldError
+				assert.ErrorAs(t, f.Err(), &ufe)
+				assert.Equal(t, tc.field, ufe.Field)
+
+				_, err := bson.Marshal(f)
+				assert.ErrorAs(t, err, &ufe)
+			},
+		)
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	u := mongodb.ValidateUpdate[queryOrder](mongodb.Set("status", "a").Push("items", queryItem{SKU: "a"}).Inc("items.$.qty", 1))
+	assert.Nil(t, u.Err())
+
+	u = mongodb.ValidateUpdate[queryOrder](mongodb.Set("status", "a").Inc("count", 1))
+	var ufe *mongodb.UnknownFieldError
+	assert.ErrorAs(t, u.Err(), &ufe)
+	assert.Equal(t, "count", ufe.Field)
+	assert.EqualError(t, u.Err(), "unknown field count of mongodb_test.queryOrder")
+}
+
+func TestFilterOnCollection(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+
+	for _, o := range []queryOrder{
+		{ID: "1", Status: "new", Tags: []string{}},
+		{ID: "2", Status: "paid", Tags: []string{}},
+		{ID: "3", Status: "shipped", Tags: []string{}},
+	} {
+		_, err := c.InsertOne(ctx, o)
+		assert.Nil(t, err)
+	}
+
+	n, err := c.CountDocuments(ctx, mongodb.Validate[queryOrder](mongodb.In("status", "new", "paid")))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	_, err = c.UpdateOne(
+		ctx,
+		mongodb.Validate[queryOrder](mongodb.Eq("_id", "1")),
+		mongodb.ValidateUpdate[queryOrder](mongodb.Set("status", "paid").Push("tags", "vip")),
+	)
+	assert.Nil(t, err)
+
+	var res queryOrder
+	err = c.FindOne(ctx, mongodb.Eq("_id", "1")).Decode(&res)
+	assert.Nil(t, err)
+	assert.Equal(t, "paid", res.Status)
+	assert.Equal(t, []string{"vip"}, res.Tags)
+
+	_, err = c.Find(ctx, mongodb.Validate[queryOrder](mongodb.Eq("state", "paid")))
+	var ufe *mongodb.UnknownFieldError
+	assert.ErrorAs(t, err, &ufe)
+}
+
+func TestFilterWithRegistry(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+	reg := mongodb.NewRegistry(mongodb.WithUints(mongodb.UintAsDecimal128))
+
+	for i, hits := range []uint64{5, 7} {
+		raw, err := bson.MarshalWithRegistry(reg, counters{Hits: hits, Tiny: uint8(i)})
+		assert.Nil(t, err)
+		_, err = c.InsertOne(ctx, bson.Raw(raw))
+		assert.Nil(t, err)
+	}
+
+	// uint64 is encoded as int64 by default, it doesn't match stored Decimal128
+	n, err := c.CountDocuments(ctx, mongodb.Eq("hits", uint64(5)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	n, err = c.CountDocuments(ctx, mongodb.Eq("hits", uint64(5)).WithRegistry(reg))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	f := mongodb.Or(mongodb.Eq("hits", uint64(7)), mongodb.And(mongodb.Eq("hits", uint64(5)), mongodb.Eq("tiny", 1)))
+	n, err = c.CountDocuments(ctx, f.WithRegistry(reg))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	_, err = c.UpdateOne(ctx, mongodb.Eq("hits", uint64(7)).WithRegistry(reg), mongodb.Set("hash", uint(1)).WithRegistry(reg))
+	assert.Nil(t, err)
+	assert.Equal(t, bsontype.Decimal128, c.Docs()[1].Lookup("hash").Type)
+}
@@ -0,0 +1,233 @@
+package mongodb
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonoptions"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Reusable registry builder
+//
+// customRegistry shows how to fix a single mapping (DateTime -> time.Time),
+// but every service which decodes loosely-typed maps needs more or less the same set of tweaks.
+// NewRegistry builds a registry with the default driver codecs
+// and applies the options on top of them, so the target Go type for each BSON type
+// found inside interface{} values can be picked independently:
+//
+// reg := mongodb.NewRegistry(
+// 		mongodb.WithDateTimeAsTime(),
+// 		mongodb.WithDocumentAsMap(),
+// 		mongodb.WithIntegersAsInt(),
+// )
+//
+// Options mostly affect values decoded into interface{} (map[string]interface{}, []interface{}, etc.),
+// typed struct fields keep decoding as before unless an option says otherwise.
+
+var (
+	tEmpty    = reflect.TypeOf((*interface{})(nil)).Elem()
+	tTime     = reflect.TypeOf(time.Time{})
+	tString   = reflect.TypeOf("")
+	tInt      = reflect.TypeOf(0)
+	tBigFloat = reflect.TypeOf(&big.Float{})
+	tSlice    = reflect.TypeOf([]interface{}{})
+	tMap      = reflect.TypeOf(map[string]interface{}{})
+)
+
+// enough bits to keep all 34 digits of Decimal128
+const decimalPrec = 113
+
+// RegistryOption configures a registry built by NewRegistry
+type RegistryOption func(*registryConfig)
+
+type registryConfig struct {
+	typeMap       map[bsontype.Type]reflect.Type
+	encoders      map[reflect.Type]bsoncodec.ValueEncoder
+	decoders      map[reflect.Type]bsoncodec.ValueDecoder
+	kindEncoders  map[reflect.Kind]bsoncodec.ValueEncoder
+	kindDecoders  map[reflect.Kind]bsoncodec.ValueDecoder
+	kinds         map[string]reflect.Type
+	binaryAsSlice bool
+}
+
+// NewRegistry returns a registry with the default driver codecs and all opts applied
+func NewRegistry(opts ...RegistryOption) *bsoncodec.Registry {
+	return NewRegistryBuilder(opts...).Build()
+}
+
+// NewRegistryBuilder is the same as NewRegistry but returns the builder,
+// so it's possible to register more codecs before building the registry
+func NewRegistryBuilder(opts ...RegistryOption) *bsoncodec.RegistryBuilder {
+	cfg := registryConfig{
+		typeMap:      map[bsontype.Type]reflect.Type{},
+		encoders:     map[reflect.Type]bsoncodec.ValueEncoder{},
+		decoders:     map[reflect.Type]bsoncodec.ValueDecoder{},
+		kindEncoders: map[reflect.Kind]bsoncodec.ValueEncoder{},
+		kindDecoders: map[reflect.Kind]bsoncodec.ValueDecoder{},
+		kinds:        map[string]reflect.Type{},
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	// the same codecs as bson.DefaultRegistry, including bson.Raw and bson.RawValue
+	rb := bson.NewRegistryBuilder()
+
+	for bt, rt := range cfg.typeMap {
+		rb.RegisterTypeMapEntry(bt, rt)
+	}
+	for t, enc := range cfg.encoders {
+		rb.RegisterTypeEncoder(t, enc)
+	}
+	for t, dec := range cfg.decoders {
+		rb.RegisterTypeDecoder(t, dec)
+	}
+	for k, enc := range cfg.kindEncoders {
+		rb.RegisterDefaultEncoder(k, enc)
+	}
+	for k, dec := range cfg.kindDecoders {
+		rb.RegisterDefaultDecoder(k, dec)
+	}
+
+	iface := bsoncodec.NewEmptyInterfaceCodec(
+		bsonoptions.EmptyInterfaceCodec().SetDecodeBinaryAsSlice(cfg.binaryAsSlice),
+	)
+	if len(cfg.kinds) > 0 {
+		rb.RegisterTypeDecoder(tEmpty, &kindDecoder{kinds: cfg.kinds, fallback: iface})
+	} else {
+		rb.RegisterTypeDecoder(tEmpty, iface)
+	}
+
+	return rb
+}
+
+// WithTypeMapEntry decodes values of BSON type bt found in interface{} into rt.
+// There should be a decoder for rt in the registry
+func WithTypeMapEntry(bt bsontype.Type, rt reflect.Type) RegistryOption {
+	return func(c *registryConfig) {
+		c.typeMap[bt] = rt
+	}
+}
+
+// WithDateTimeAsTime decodes BSON DateTime as time.Time instead of primitive.DateTime
+func WithDateTimeAsTime() RegistryOption {
+	return WithTypeMapEntry(bsontype.DateTime, tTime)
+}
+
+// WithArrayAsSlice decodes BSON arrays as []interface{} instead of primitive.A
+func WithArrayAsSlice() RegistryOption {
+	return WithTypeMapEntry(bsontype.Array, tSlice)
+}
+
+// WithDocumentAsMap decodes embedded documents as map[string]interface{} instead of primitive.D
+func WithDocumentAsMap() RegistryOption {
+	return WithTypeMapEntry(bsontype.EmbeddedDocument, tMap)
+}
+
+// WithIntegersAsInt decodes both BSON int32 and int64 as int
+func WithIntegersAsInt() RegistryOption {
+	return func(c *registryConfig) {
+		c.typeMap[bsontype.Int32] = tInt
+		c.typeMap[bsontype.Int64] = tInt
+	}
+}
+
+// WithObjectIDAsHex decodes ObjectID as its hex string representation
+func WithObjectIDAsHex() RegistryOption {
+	return WithTypeMapEntry(bsontype.ObjectID, tString)
+}
+
+// WithBinaryAsBytes decodes generic binary data as []byte instead of primitive.Binary.
+// Binary values with other subtypes (UUID, MD5, etc.) are kept as primitive.Binary
+func WithBinaryAsBytes() RegistryOption {
+	return func(c *registryConfig) {
+		c.binaryAsSlice = true
+	}
+}
+
+// WithDecimal128AsBigFloat decodes Decimal128 as *big.Float.
+// *big.Float values are encoded back as Decimal128
+func WithDecimal128AsBigFloat() RegistryOption {
+	return func(c *registryConfig) {
+		c.typeMap[bsontype.Decimal128] = tBigFloat
+		c.encoders[tBigFloat] = bsoncodec.ValueEncoderFunc(bigFloatEncodeValue)
+		c.decoders[tBigFloat] = bsoncodec.ValueDecoderFunc(bigFloatDecodeValue)
+	}
+}
+
+// WithDecimal128AsString decodes Decimal128 as its string representation.
+// This also allows to decode Decimal128 into string struct fields
+func WithDecimal128AsString() RegistryOption {
+	return func(c *registryConfig) {
+		c.typeMap[bsontype.Decimal128] = tString
+		c.decoders[tString] = bsoncodec.ValueDecoderFunc(decimalStringDecodeValue)
+	}
+}
+
+func bigFloatEncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tBigFloat {
+		return bsoncodec.ValueEncoderError{Name: "BigFloatEncodeValue", Types: []reflect.Type{tBigFloat}, Received: val}
+	}
+	if val.IsNil() {
+		return vw.WriteNull()
+	}
+	f := val.Interface().(*big.Float)
+	d, err := primitive.ParseDecimal128(f.Text('g', -1))
+	if err != nil {
+		return fmt.Errorf("can't encode %v as decimal128: %w", f, err)
+	}
+	return vw.WriteDecimal128(d)
+}
+
+func bigFloatDecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tBigFloat {
+		return bsoncodec.ValueDecoderError{Name: "BigFloatDecodeValue", Types: []reflect.Type{tBigFloat}, Received: val}
+	}
+
+	switch vr.Type() {
+	case bsontype.Decimal128:
+		d, err := vr.ReadDecimal128()
+		if err != nil {
+			return err
+		}
+		f, _, err := new(big.Float).SetPrec(decimalPrec).Parse(d.String(), 10)
+		if err != nil {
+			return fmt.Errorf("can't decode decimal128 %v into *big.Float: %w", d, err)
+		}
+		val.Set(reflect.ValueOf(f))
+	case bsontype.Double:
+		f, err := vr.ReadDouble()
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(big.NewFloat(f)))
+	case bsontype.Null:
+		val.Set(reflect.Zero(tBigFloat))
+		return vr.ReadNull()
+	default:
+		return fmt.Errorf("cannot decode %v into a *big.Float", vr.Type())
+	}
+	return nil
+}
+
+func decimalStringDecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if vr.Type() != bsontype.Decimal128 {
+		return bsoncodec.NewStringCodec().DecodeValue(dc, vr, val)
+	}
+	if !val.CanSet() || val.Kind() != reflect.String {
+		return bsoncodec.ValueDecoderError{Name: "DecimalStringDecodeValue", Kinds: []reflect.Kind{reflect.String}, Received: val}
+	}
+	d, err := vr.ReadDecimal128()
+	if err != nil {
+		return err
+	}
+	val.SetString(d.String())
+	return nil
+}
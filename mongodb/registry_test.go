@@ -0,0 +1,85 @@
+package mongodb_test
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewRegistry(t *testing.T) {
+	dec, _ := primitive.ParseDecimal128("12.345")
+	oid := primitive.NewObjectID()
+	doc := mongodb.CustomNestedMapStruct{
+		ID: "registry",
+		Data: map[string]interface{}{
+			"date":    time.Now(),
+			"array":   []int{1, 2},
+			"doc":     map[string]interface{}{"a": 1},
+			"int32":   int32(1),
+			"int64":   int64(2),
+			"decimal": dec,
+			"oid":     oid,
+			"binary":  primitive.Binary{Subtype: bsontype.BinaryGeneric, Data: []byte("bin")},
+		},
+	}
+	raw, err := bson.Marshal(doc)
+	assert.Nil(t, err)
+
+	tt := []struct {
+		name     string
+		opts     []mongodb.RegistryOption
+		key      string
+		expected interface{}
+	}{
+		{"no options keeps driver defaults", nil, "date", primitive.DateTime(0)},
+		{"datetime as time", []mongodb.RegistryOption{mongodb.WithDateTimeAsTime()}, "date", time.Time{}},
+		{"array as slice", []mongodb.RegistryOption{mongodb.WithArrayAsSlice()}, "array", []interface{}{}},
+		{"document as map", []mongodb.RegistryOption{mongodb.WithDocumentAsMap()}, "doc", map[string]interface{}{}},
+		{"int32 as int", []mongodb.RegistryOption{mongodb.WithIntegersAsInt()}, "int32", 0},
+		{"int64 as int", []mongodb.RegistryOption{mongodb.WithIntegersAsInt()}, "int64", 0},
+		{"decimal as big float", []mongodb.RegistryOption{mongodb.WithDecimal128AsBigFloat()}, "decimal", &big.Float{}},
+		{"decimal as string", []mongodb.RegistryOption{mongodb.WithDecimal128AsString()}, "decimal", ""},
+		{"objectid as hex", []mongodb.RegistryOption{mongodb.WithObjectIDAsHex()}, "oid", ""},
+		{"binary as bytes", []mongodb.RegistryOption{mongodb.WithBinaryAsBytes()}, "binary", []byte{}},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				var res mongodb.CustomNestedMapStruct
+				err := bson.UnmarshalWithRegistry(mongodb.NewRegistry(tc.opts...), raw, &res)
+				assert.Nil(t, err)
+				assert.IsType(t, tc.expected, res.Data[tc.key])
+			},
+		)
+	}
+}
+
+func TestNewRegistryDecimalValues(t *testing.T) {
+	dec, _ := primitive.ParseDecimal128("12.345")
+	raw, err := bson.Marshal(bson.M{"v": dec})
+	assert.Nil(t, err)
+
+	var asString map[string]interface{}
+	err = bson.UnmarshalWithRegistry(mongodb.NewRegistry(mongodb.WithDecimal128AsString()), raw, &asString)
+	assert.Nil(t, err)
+	assert.Equal(t, "12.345", asString["v"])
+
+	reg := mongodb.NewRegistry(mongodb.WithDecimal128AsBigFloat())
+	var asFloat map[string]interface{}
+	err = bson.UnmarshalWithRegistry(reg, raw, &asFloat)
+	assert.Nil(t, err)
+	assert.Equal(t, "12.345", asFloat["v"].(*big.Float).Text('g', -1))
+
+	// *big.Float goes back as decimal128
+	back, err := bson.MarshalWithRegistry(reg, asFloat)
+	assert.Nil(t, err)
+	assert.Equal(t, bsontype.Decimal128, bson.Raw(back).Lookup("v").Type)
+}
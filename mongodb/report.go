@@ -0,0 +1,169 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Decoding diagnostics
+//
+// Instead of printing %T of every decoded value (look at TestReadAllTypesMapDefault),
+// NewDecodeReport encodes a map with the custom registry, decodes it back with both
+// the default and the custom registries and reports for every field:
+// the Go type written, the BSON type stored, the Go types decoded and
+// whether the decoded value is equal to the written one.
+//
+// report, err := mongodb.NewDecodeReport(data, mongodb.NewRegistry(mongodb.WithDateTimeAsTime()))
+// report.WriteTable(os.Stdout)
+//
+// PATH       WRITTEN    BSON            DEFAULT             DEFAULT EQUAL  CUSTOM     CUSTOM EQUAL
+// int32      int32      32-bit integer  int32               true           int32      true
+// uint8      uint8      32-bit integer  int32               false          int32      false
+// time.Time  time.Time  UTC datetime    primitive.DateTime  false          time.Time  false
+//
+// Nested map[string]interface{} values are reported field by field with dotted paths.
+// The report can be written as JSON as well, so it's easy to store it and compare after driver upgrades.
+
+// FieldReport describes how a single field survives encoding and decoding
+type FieldReport struct {
+	Path         string `json:"path"`
+	WrittenType  string `json:"writtenType"`
+	BSONType     string `json:"bsonType"`
+	DefaultType  string `json:"defaultType"`
+	DefaultEqual bool   `json:"defaultEqual"`
+	CustomType   string `json:"customType"`
+	CustomEqual  bool   `json:"customEqual"`
+}
+
+// DecodeReport is the per-field result of NewDecodeReport sorted by path
+type DecodeReport struct {
+	Fields []FieldReport `json:"fields"`
+}
+
+// NewDecodeReport encodes data with custom registry and decodes it with the default and custom registries
+func NewDecodeReport(data map[string]interface{}, custom *bsoncodec.Registry) (*DecodeReport, error) {
+	raw, err := bson.MarshalWithRegistry(custom, data)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode data: %w", err)
+	}
+
+	var byDefault map[string]interface{}
+	if err = bson.UnmarshalWithRegistry(bson.DefaultRegistry, raw, &byDefault); err != nil {
+		return nil, fmt.Errorf("can't decode data with the default registry: %w", err)
+	}
+	var byCustom map[string]interface{}
+	if err = bson.UnmarshalWithRegistry(custom, raw, &byCustom); err != nil {
+		return nil, fmt.Errorf("can't decode data with the custom registry: %w", err)
+	}
+
+	report := &DecodeReport{}
+	report.add(nil, data, bson.Raw(raw), byDefault, byCustom)
+	sort.Slice(report.Fields, func(i, j int) bool {
+		return report.Fields[i].Path < report.Fields[j].Path
+	})
+	return report, nil
+}
+
+func (r *DecodeReport) add(path []string, written map[string]interface{}, raw bson.Raw, byDefault, byCustom interface{}) {
+	for k, v := range written {
+		p := append(append([]string(nil), path...), k)
+
+		defaultVal, _ := lookupDecoded(byDefault, k)
+		customVal, _ := lookupDecoded(byCustom, k)
+
+		if nested, ok := v.(map[string]interface{}); ok {
+			if sub, ok := raw.Lookup(k).DocumentOK(); ok {
+				r.add(p, nested, sub, defaultVal, customVal)
+				continue
+			}
+		}
+
+		r.Fields = append(r.Fields, FieldReport{
+			Path:         strings.Join(p, "."),
+			WrittenType:  typeName(v),
+			BSONType:     raw.Lookup(k).Type.String(),
+			DefaultType:  typeName(defaultVal),
+			DefaultEqual: equalDecoded(v, defaultVal),
+			CustomType:   typeName(customVal),
+			CustomEqual:  equalDecoded(v, customVal),
+		})
+	}
+}
+
+// WriteTable writes the report as a text table
+func (r *DecodeReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tWRITTEN\tBSON\tDEFAULT\tDEFAULT EQUAL\tCUSTOM\tCUSTOM EQUAL")
+	for _, f := range r.Fields {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			f.Path, f.WrittenType, f.BSONType, f.DefaultType, f.DefaultEqual, f.CustomType, f.CustomEqual)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *DecodeReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Field returns the report of the field with path
+func (r *DecodeReport) Field(path string) (FieldReport, bool) {
+	for _, f := range r.Fields {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return FieldReport{}, false
+}
+
+// lookupDecoded returns the value of key from a decoded document of any representation
+func lookupDecoded(doc interface{}, key string) (interface{}, bool) {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		v, ok := d[key]
+		return v, ok
+	case primitive.M:
+		v, ok := d[key]
+		return v, ok
+	case primitive.D:
+		for _, e := range d {
+			if e.Key == key {
+				return e.Value, true
+			}
+		}
+	case FidelityMap:
+		v, ok := d[key]
+		return v, ok
+	}
+	return nil, false
+}
+
+func typeName(v interface{}) string {
+	if v == nil {
+		return "nil"
+	}
+	return reflect.TypeOf(v).String()
+}
+
+// equalDecoded compares written and decoded values,
+// time.Time values are compared as instants, so only lost precision makes them different
+func equalDecoded(written, decoded interface{}) bool {
+	wt, ok := written.(time.Time)
+	if ok {
+		dt, ok := decoded.(time.Time)
+		return ok && wt.Equal(dt)
+	}
+	return reflect.DeepEqual(written, decoded)
+}
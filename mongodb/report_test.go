@@ -0,0 +1,58 @@
+package mongodb_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllTypesDecodeReport(t *testing.T) {
+	report, err := mongodb.AllTypesDecodeReport()
+	assert.Nil(t, err)
+
+	var table bytes.Buffer
+	assert.Nil(t, report.WriteTable(&table))
+	t.Log("\n" + table.String())
+
+	tt := []struct {
+		path         string
+		bsonType     string
+		defaultType  string
+		customType   string
+		defaultEqual bool
+		customEqual  bool
+	}{
+		{"string", "string", "string", "string", true, true},
+		{"int32", "32-bit integer", "int32", "int32", true, true},
+		{"uint8", "32-bit integer", "int32", "int32", false, false},
+		{"float32", "double", "float64", "float64", false, false},
+		{"time.Time", "UTC datetime", "primitive.DateTime", "time.Time", false, false},
+		{"slice", "array", "primitive.A", "[]interface {}", false, false},
+		{"map[string]interface - primitive.3", "boolean", "bool", "bool", true, true},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.path,
+			func(t *testing.T) {
+				f, ok := report.Field(tc.path)
+				assert.True(t, ok)
+				assert.Equal(t, tc.bsonType, f.BSONType)
+				assert.Equal(t, tc.defaultType, f.DefaultType)
+				assert.Equal(t, tc.customType, f.CustomType)
+				assert.Equal(t, tc.defaultEqual, f.DefaultEqual)
+				assert.Equal(t, tc.customEqual, f.CustomEqual)
+			},
+		)
+	}
+
+	var js bytes.Buffer
+	assert.Nil(t, report.WriteJSON(&js))
+
+	var decoded mongodb.DecodeReport
+	assert.Nil(t, json.Unmarshal(js.Bytes(), &decoded))
+	assert.Equal(t, *report, decoded)
+}
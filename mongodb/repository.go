@@ -0,0 +1,215 @@
+package mongodb
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Generic typed repository
+//
+// insertFlat/readFlat, insertNested/readNestedDefault and others
+// are the same CRUD code written for every struct.
+// Repository[T] does it once for any document type:
+//
+// repo := mongodb.NewRepository[mongodb.CustomFlatStructure](c)
+// err := repo.Insert(ctx, mongodb.CustomFlatStructure{ID: "1", Date: time.Now()})
+// flat, err := repo.FindByID(ctx, "1")
+//
+// Documents are looked up by the "id" field by default (the bson name of the ID field
+// of CustomFlatStructure and CustomNestedMapStruct), use WithIDField to change it, e.g. to "_id".
+// When a registry is set with WithRepositoryRegistry, it's used for both encoding and decoding,
+// otherwise the registry of the collection is used.
+
+// DefaultIDField is the field used to look up documents by id
+const DefaultIDField = "id"
+
+// Repository implements CRUD operations for documents of type T
+type Repository[T any] struct {
+	coll     Collection
+	idField  string
+	registry *bsoncodec.Registry
+}
+
+// RepositoryOption configures Repository
+type RepositoryOption func(*repositoryConfig)
+
+type repositoryConfig struct {
+	idField  string
+	registry *bsoncodec.Registry
+}
+
+// WithIDField sets the field used to look up documents by id
+func WithIDField(name string) RepositoryOption {
+	return func(c *repositoryConfig) {
+		c.idField = name
+	}
+}
+
+// WithRepositoryRegistry sets the registry used to encode and decode documents
+func WithRepositoryRegistry(reg *bsoncodec.Registry) RepositoryOption {
+	return func(c *repositoryConfig) {
+		c.registry = reg
+	}
+}
+
+func NewRepository[T any](c Collection, opts ...RepositoryOption) *Repository[T] {
+	cfg := repositoryConfig{idField: DefaultIDField}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &Repository[T]{
+		coll:     c,
+		idField:  cfg.idField,
+		registry: cfg.registry,
+	}
+}
+
+// Insert inserts doc
+func (r *Repository[T]) Insert(ctx context.Context, doc T) error {
+	enc, err := r.encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = r.coll.InsertOne(ctx, enc)
+	return err
+}
+
+// FindByID returns the document with id or mongo.ErrNoDocuments
+func (r *Repository[T]) FindByID(ctx context.Context, id interface{}) (T, error) {
+	var res T
+
+	sr := r.coll.FindOne(ctx, r.byID(id))
+	if sr.Err() != nil {
+		return res, sr.Err()
+	}
+
+	err := r.decode(sr.DecodeBytes, sr.Decode, &res)
+	return res, err
+}
+
+// Find returns all documents matching filter, nil filter matches all documents
+func (r *Repository[T]) Find(ctx context.Context, filter interface{}) ([]T, error) {
+	cur, err := r.coll.Find(ctx, r.filter(filter))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var res []T
+	for cur.Next(ctx) {
+		var doc T
+		err = r.decode(
+			func() (bson.Raw, error) { return cur.Current, nil },
+			cur.Decode,
+			&doc,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, doc)
+	}
+	return res, cur.Err()
+}
+
+// Update applies update (a document with update operators, e.g. {"$set": {...}})
+// to the document with id, mongo.ErrNoDocuments is returned if there's no such document
+func (r *Repository[T]) Update(ctx context.Context, id interface{}, update interface{}) error {
+	res, err := r.coll.UpdateOne(ctx, r.byID(id), update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Upsert sets all fields of doc to the document with id, the document is created if it doesn't exist.
+// _id is immutable, so if T has an _id field it should be either omitempty or equal to the stored one
+func (r *Repository[T]) Upsert(ctx context.Context, id interface{}, doc T) error {
+	enc, err := r.encode(doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.coll.UpdateOne(
+		ctx,
+		r.byID(id),
+		bson.D{{Key: "$set", Value: enc}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// Delete deletes the document with id, mongo.ErrNoDocuments is returned if there's no such document
+func (r *Repository[T]) Delete(ctx context.Context, id interface{}) error {
+	res, err := r.coll.DeleteOne(ctx, r.byID(id))
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Count returns the number of documents matching filter, nil filter matches all documents.
+// If the collection isn't a DocumentCounter, matching documents are iterated and counted
+func (r *Repository[T]) Count(ctx context.Context, filter interface{}) (int64, error) {
+	if dc, ok := r.coll.(DocumentCounter); ok {
+		return dc.CountDocuments(ctx, r.filter(filter))
+	}
+
+	cur, err := r.coll.Find(ctx, r.filter(filter))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var cnt int64
+	for cur.Next(ctx) {
+		cnt++
+	}
+	return cnt, cur.Err()
+}
+
+func (r *Repository[T]) byID(id interface{}) bson.D {
+	return bson.D{{Key: r.idField, Value: id}}
+}
+
+func (r *Repository[T]) filter(filter interface{}) interface{} {
+	if filter == nil {
+		return bson.D{}
+	}
+	return filter
+}
+
+// encode marshals doc with the repository registry,
+// without registry doc is passed to the driver as is and encoded with the collection registry
+func (r *Repository[T]) encode(doc T) (interface{}, error) {
+	if r.registry == nil {
+		return doc, nil
+	}
+	raw, err := bson.MarshalWithRegistry(r.registry, doc)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(raw), nil
+}
+
+// decode unmarshals raw document with the repository registry,
+// without registry driverDecode is used, which applies the collection registry
+func (r *Repository[T]) decode(raw func() (bson.Raw, error), driverDecode func(interface{}) error, v *T) error {
+	if r.registry == nil {
+		return driverDecode(v)
+	}
+	b, err := raw()
+	if err != nil {
+		return err
+	}
+	return Unmarshal(r.registry, b, v)
+}
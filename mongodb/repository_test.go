@@ -0,0 +1,121 @@
+package mongodb_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestRepository(t *testing.T) {
+	for name, c := range testCollections(t, "test_repository") {
+		t.Run(
+			name,
+			func(t *testing.T) {
+				testRepository(t, c)
+			},
+		)
+	}
+}
+
+func testRepository(t *testing.T, c mongodb.Collection) {
+	ctx := context.Background()
+
+	rand.Seed(time.Now().UnixMilli())
+	id := fmt.Sprintf("repo_%v", rand.Int())
+
+	repo := mongodb.NewRepository[mongodb.CustomFlatStructure](c)
+
+	err := repo.Insert(ctx, mongodb.CustomFlatStructure{ID: id, Date: time.Now()})
+	assert.Nil(t, err)
+
+	flat, err := repo.FindByID(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, id, flat.ID)
+
+	found, err := repo.Find(ctx, bson.D{{Key: "id", Value: id}})
+	assert.Nil(t, err)
+	assert.Len(t, found, 1)
+
+	date := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = repo.Update(ctx, id, bson.D{{Key: "$set", Value: bson.D{{Key: "date", Value: date}}}})
+	assert.Nil(t, err)
+
+	flat, err = repo.FindByID(ctx, id)
+	assert.Nil(t, err)
+	assert.True(t, date.Equal(flat.Date))
+
+	err = repo.Upsert(ctx, id+"_upserted", mongodb.CustomFlatStructure{ID: id + "_upserted", Date: date})
+	assert.Nil(t, err)
+
+	cnt, err := repo.Count(ctx, bson.D{{Key: "date", Value: date}})
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, cnt, int64(2))
+
+	assert.Nil(t, repo.Delete(ctx, id))
+	assert.Nil(t, repo.Delete(ctx, id+"_upserted"))
+
+	_, err = repo.FindByID(ctx, id)
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+	assert.ErrorIs(t, repo.Delete(ctx, id), mongo.ErrNoDocuments)
+	assert.ErrorIs(t, repo.Update(ctx, id, bson.D{{Key: "$set", Value: bson.D{{Key: "date", Value: date}}}}), mongo.ErrNoDocuments)
+}
+
+func TestRepositoryCustomRegistry(t *testing.T) {
+	ctx := context.Background()
+
+	rand.Seed(time.Now().UnixMilli())
+	id := fmt.Sprintf("repo_nested_%v", rand.Int())
+
+	for name, c := range testCollections(t, "test_repository") {
+		t.Run(
+			name,
+			func(t *testing.T) {
+				repo := mongodb.NewRepository[mongodb.CustomNestedMapStruct](
+					c,
+					mongodb.WithRepositoryRegistry(mongodb.NewRegistry(mongodb.WithDateTimeAsTime())),
+				)
+
+				err := repo.Insert(ctx, mongodb.CustomNestedMapStruct{ID: id, Data: map[string]interface{}{"createdAt": time.Now()}})
+				assert.Nil(t, err)
+
+				nested, err := repo.FindByID(ctx, id)
+				assert.Nil(t, err)
+				assert.IsType(t, time.Time{}, nested.Data["createdAt"])
+
+				all, err := repo.Find(ctx, nil)
+				assert.Nil(t, err)
+				assert.NotEmpty(t, all)
+			},
+		)
+	}
+}
+
+// countlessCollection hides CountDocuments of the underlying collection
+type countlessCollection struct {
+	mongodb.Collection
+}
+
+func TestRepositoryCountFallback(t *testing.T) {
+	ctx := context.Background()
+	repo := mongodb.NewRepository[mongodb.CustomFlatStructure](countlessCollection{mongotest.NewCollection()})
+
+	for _, id := range []string{"1", "2", "3"} {
+		assert.Nil(t, repo.Insert(ctx, mongodb.CustomFlatStructure{ID: id}))
+	}
+
+	cnt, err := repo.Count(ctx, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), cnt)
+
+	cnt, err = repo.Count(ctx, bson.D{{Key: "id", Value: "2"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), cnt)
+}
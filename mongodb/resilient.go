@@ -0,0 +1,357 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Retries and circuit breaking
+//
+// Problem description:
+// InsertOne and FindOne in decoding.go fail immediately on transient errors:
+// network blips, primary stepdowns, socket timeouts.
+// The driver retries some operations once, but not when the cluster needs more time.
+//
+// NewResilientCollection wraps a Collection and retries failed operations
+// with exponential backoff and full jitter (WithoutJitter makes pauses predictable):
+//
+// c := mongodb.NewResilientCollection(client.Database(db).Collection(coll),
+// 		mongodb.WithRetries(5, 50*time.Millisecond, 2*time.Second),
+// 		mongodb.WithCircuitBreaker(10, 30*time.Second),
+// )
+// res, err := mongodb.ExecWithFlatOnCollection(ctx, c, id)
+//
+// Only errors accepted by IsRetryable are retried (duplicate keys, decoding errors, etc. are returned as is),
+// and never after the context is done: a pause which doesn't fit before the deadline isn't started.
+// The circuit breaker counts consecutive retryable failures of all operations, after the threshold
+// all operations fail with ErrCircuitOpen without calling the collection until the cooldown passes,
+// then a single trial operation decides whether the circuit closes or opens again.
+//
+// InsertOne is made idempotent: the document is encoded once (with the registry set by WithResilienceRegistry,
+// it should be the registry of the wrapped collection) and gets an ObjectID _id if it has none,
+// so every attempt writes the same _id. A duplicate _id error of a retry means that a previous attempt
+// was applied by the server, it's returned as success.
+//
+// Only the Collection interface is wrapped, so helpers use their fallbacks for
+// DocumentCounter, Aggregator and BulkWriter.
+
+// ErrCircuitOpen is returned when the circuit breaker doesn't let operations through
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// codes of server errors which are transient: stepdowns, shutdowns and network errors between nodes
+var retryableCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	262,   // ExceededTimeLimit
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// IsRetryable reports whether the operation which failed with err can succeed if it's repeated:
+// network errors, timeouts, errors labeled as RetryableWriteError or TransientTransactionError
+// and stepdown errors. Duplicate keys and context cancellation aren't retryable
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, ErrCircuitOpen),
+		mongo.IsDuplicateKeyError(err):
+		return false
+	case mongo.IsNetworkError(err), mongo.IsTimeout(err):
+		return true
+	}
+
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	if se.HasErrorLabel("RetryableWriteError") || se.HasErrorLabel("TransientTransactionError") {
+		return true
+	}
+	for _, code := range retryableCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResilienceOption configures ResilientCollection
+type ResilienceOption func(*ResilientCollection)
+
+// WithRetries sets the number of retries after the first attempt and the backoff:
+// the pause before retry n is random up to min(base * 2^n, max)
+func WithRetries(n int, base, max time.Duration) ResilienceOption {
+	return func(c *ResilientCollection) {
+		c.retries = n
+		c.baseDelay = base
+		c.maxDelay = max
+	}
+}
+
+// WithoutJitter pauses for exactly min(base * 2^n, max) before retry n
+func WithoutJitter() ResilienceOption {
+	return func(c *ResilientCollection) {
+		c.noJitter = true
+	}
+}
+
+// WithCircuitBreaker opens the circuit after threshold consecutive retryable failures for cooldown,
+// zero threshold disables the circuit breaker
+func WithCircuitBreaker(threshold int, cooldown time.Duration) ResilienceOption {
+	return func(c *ResilientCollection) {
+		c.threshold = threshold
+		c.cooldown = cooldown
+	}
+}
+
+// WithResilienceRegistry sets the registry used to encode documents of InsertOne, bson.DefaultRegistry is used by default
+func WithResilienceRegistry(reg *bsoncodec.Registry) ResilienceOption {
+	return func(c *ResilientCollection) {
+		c.registry = reg
+	}
+}
+
+// WithRetryClassifier replaces IsRetryable
+func WithRetryClassifier(f func(error) bool) ResilienceOption {
+	return func(c *ResilientCollection) {
+		c.retryable = f
+	}
+}
+
+// ResilientCollection retries operations of the wrapped collection and stops calling it when it keeps failing
+type ResilientCollection struct {
+	coll      Collection
+	retries   int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	noJitter  bool
+	threshold int
+	cooldown  time.Duration
+	retryable func(error) bool
+	registry  *bsoncodec.Registry
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+var _ Collection = (*ResilientCollection)(nil)
+
+func NewResilientCollection(c Collection, opts ...ResilienceOption) *ResilientCollection {
+	rc := &ResilientCollection{
+		coll:      c,
+		retries:   3,
+		baseDelay: 100 * time.Millisecond,
+		maxDelay:  5 * time.Second,
+		retryable: IsRetryable,
+		registry:  bson.DefaultRegistry,
+	}
+	for _, opt := range opts {
+		opt(rc)
+	}
+	return rc
+}
+
+// InsertOne inserts document with retries, all attempts insert the document with the same _id
+func (c *ResilientCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	doc, err := bson.MarshalWithRegistry(c.registry, document)
+	if err != nil {
+		return nil, err
+	}
+	withID, err := ensureID(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		res     *mongo.InsertOneResult
+		retried bool
+	)
+	err = c.do(ctx, func() (err error) {
+		res, err = c.coll.InsertOne(ctx, withID, opts...)
+		if retried && isDuplicateID(err) {
+			// the previous attempt was applied, but its response was lost
+			res, err = &mongo.InsertOneResult{InsertedID: decodeID(withID.Lookup("_id"))}, nil
+		}
+		retried = true
+		return err
+	})
+	return res, err
+}
+
+// isDuplicateID reports whether err is a duplicate key error of the _id index
+func isDuplicateID(err error) bool {
+	var we mongo.WriteException
+	if !errors.As(err, &we) {
+		return false
+	}
+	for _, e := range we.WriteErrors {
+		if e.Code == 11000 && strings.Contains(e.Message, "index: _id_ ") {
+			return true
+		}
+	}
+	return false
+}
+
+// FindOne finds a document with retries, ErrNoDocuments isn't retried
+func (c *ResilientCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	var res *mongo.SingleResult
+	err := c.do(ctx, func() error {
+		res = c.coll.FindOne(ctx, filter, opts...)
+		return res.Err()
+	})
+	if res == nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	return res
+}
+
+// Find opens a cursor with retries, errors of the cursor itself aren't retried
+func (c *ResilientCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	var res *mongo.Cursor
+	err := c.do(ctx, func() (err error) {
+		res, err = c.coll.Find(ctx, filter, opts...)
+		return err
+	})
+	return res, err
+}
+
+// UpdateOne updates a document with retries
+func (c *ResilientCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	var res *mongo.UpdateResult
+	err := c.do(ctx, func() (err error) {
+		res, err = c.coll.UpdateOne(ctx, filter, update, opts...)
+		return err
+	})
+	return res, err
+}
+
+// DeleteOne deletes a document with retries
+func (c *ResilientCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	var res *mongo.DeleteResult
+	err := c.do(ctx, func() (err error) {
+		res, err = c.coll.DeleteOne(ctx, filter, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *ResilientCollection) do(ctx context.Context, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		if err := c.allow(); err != nil {
+			return err
+		}
+
+		err := op()
+		if ctx.Err() != nil {
+			// the caller gave up, it says nothing about the collection
+			c.cancelTrial()
+			return err
+		}
+		retryable := c.retryable(err)
+		c.record(err == nil || !retryable)
+
+		if !retryable || attempt >= c.retries {
+			return err
+		}
+		if !c.wait(ctx, c.backoff(attempt)) {
+			return err
+		}
+	}
+}
+
+func (c *ResilientCollection) backoff(attempt int) time.Duration {
+	d := c.baseDelay
+	for i := 0; i < attempt && d < c.maxDelay; i++ {
+		d *= 2
+	}
+	if d > c.maxDelay {
+		d = c.maxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	if c.noJitter {
+		return d
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// wait pauses for d and reports whether the operation can be retried after it
+func (c *ResilientCollection) wait(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// allow returns ErrCircuitOpen if the operation shouldn't be started
+func (c *ResilientCollection) allow() error {
+	if c.threshold <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failures < c.threshold {
+		return nil
+	}
+	if c.trial || time.Since(c.openedAt) < c.cooldown {
+		return ErrCircuitOpen
+	}
+	c.trial = true
+	return nil
+}
+
+// record updates the circuit breaker with the result of an operation
+func (c *ResilientCollection) record(ok bool) {
+	if c.threshold <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.trial = false
+	if ok {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= c.threshold {
+		c.openedAt = time.Now()
+	}
+}
+
+// cancelTrial lets another operation be the trial if the current one didn't finish
+func (c *ResilientCollection) cancelTrial() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+}
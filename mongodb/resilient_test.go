@@ -0,0 +1,159 @@
+package mongodb_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	stepdown   = mongo.CommandError{Code: 11602, Name: "InterruptedDueToReplStateChange"}
+	networkErr = mongo.CommandError{Labels: []string{"NetworkError"}}
+)
+
+func isStepdown(err error) bool {
+	var ce mongo.CommandError
+	return errors.As(err, &ce) && ce.Code == stepdown.Code
+}
+
+func TestIsRetryable(t *testing.T) {
+	tt := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"nil", nil, false},
+		{"network", networkErr, true},
+		{"stepdown", stepdown, true},
+		{"retryable write label", mongo.CommandError{Code: 1, Labels: []string{"RetryableWriteError"}}, true},
+		{"timeout", context.DeadlineExceeded, true},
+		{"canceled", context.Canceled, false},
+		{"duplicate key", mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}}, false},
+		{"no documents", mongo.ErrNoDocuments, false},
+		{"other command error", mongo.CommandError{Code: 2}, false},
+		{"circuit open", mongodb.ErrCircuitOpen, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				assert.Equal(t, tc.retryable, mongodb.IsRetryable(tc.err))
+			},
+		)
+	}
+}
+
+func TestResilientCollectionRetries(t *testing.T) {
+	ctx := context.Background()
+	fake := mongotest.NewCollection()
+	c := mongodb.NewResilientCollection(fake, mongodb.WithRetries(2, time.Millisecond, 5*time.Millisecond))
+
+	fake.FailNext(mongotest.OpInsertOne, stepdown, networkErr)
+	fake.FailNext(mongotest.OpFindOne, networkErr)
+	res, err := mongodb.ExecWithFlatOnCollection(ctx, c, "retried")
+	assert.Nil(t, err)
+	assert.Equal(t, "flat_retried", res.ID)
+	assert.Equal(t, 3, fake.Calls(mongotest.OpInsertOne))
+	assert.Equal(t, 2, fake.Calls(mongotest.OpFindOne))
+
+	_, err = c.InsertOne(ctx, fake.Docs()[0])
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	assert.Equal(t, 4, fake.Calls(mongotest.OpInsertOne))
+
+	fake.FailNext(mongotest.OpDeleteOne, stepdown, stepdown, stepdown)
+	_, err = c.DeleteOne(ctx, bson.D{})
+	assert.True(t, isStepdown(err))
+	assert.Equal(t, 3, fake.Calls(mongotest.OpDeleteOne))
+}
+
+func TestResilientCollectionDeadline(t *testing.T) {
+	fake := mongotest.NewCollection()
+	// the pause is always 1s, it doesn't fit before the deadline
+	c := mongodb.NewResilientCollection(fake, mongodb.WithRetries(10, time.Second, time.Second), mongodb.WithoutJitter())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	fake.FailNext(mongotest.OpUpdateOne, stepdown, stepdown)
+	start := time.Now()
+	_, err := c.UpdateOne(ctx, bson.D{}, bson.D{{Key: "$set", Value: bson.D{{Key: "n", Value: 1}}}})
+	assert.True(t, isStepdown(err))
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 1, fake.Calls(mongotest.OpUpdateOne))
+}
+
+func TestResilientCollectionCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	fake := mongotest.NewCollection()
+	c := mongodb.NewResilientCollection(
+		fake,
+		mongodb.WithRetries(0, 0, 0),
+		mongodb.WithCircuitBreaker(2, 50*time.Millisecond),
+	)
+
+	fake.FailNext(mongotest.OpFindOne, networkErr, networkErr, networkErr)
+	assert.True(t, mongo.IsNetworkError(c.FindOne(ctx, bson.D{}).Err()))
+	assert.True(t, mongo.IsNetworkError(c.FindOne(ctx, bson.D{}).Err()))
+
+	assert.ErrorIs(t, c.FindOne(ctx, bson.D{}).Err(), mongodb.ErrCircuitOpen)
+	_, err := c.Find(ctx, bson.D{})
+	assert.ErrorIs(t, err, mongodb.ErrCircuitOpen)
+	assert.Equal(t, 2, fake.Calls(mongotest.OpFindOne))
+
+	// the failed trial opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, mongo.IsNetworkError(c.FindOne(ctx, bson.D{}).Err()))
+	assert.ErrorIs(t, c.FindOne(ctx, bson.D{}).Err(), mongodb.ErrCircuitOpen)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.ErrorIs(t, c.FindOne(ctx, bson.D{}).Err(), mongo.ErrNoDocuments)
+	_, err = c.Find(ctx, bson.D{})
+	assert.Nil(t, err)
+
+	calls := fake.Calls(mongotest.OpInsertOne)
+	fake.FailNext(mongotest.OpInsertOne, stepdown)
+	_, err = mongodb.NewResilientCollection(fake, mongodb.WithRetryClassifier(func(error) bool { return false })).InsertOne(ctx, bson.D{})
+	assert.True(t, isStepdown(err))
+	assert.Equal(t, calls+1, fake.Calls(mongotest.OpInsertOne))
+}
+
+// lostResponse applies the first insert and fails it as if the response was lost
+type lostResponse struct {
+	mongodb.Collection
+	lost bool
+}
+
+func (c *lostResponse) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	res, err := c.Collection.InsertOne(ctx, document, opts...)
+	if err == nil && !c.lost {
+		c.lost = true
+		return nil, networkErr
+	}
+	return res, err
+}
+
+func TestResilientCollectionInsertIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	fake := mongotest.NewCollection()
+	c := mongodb.NewResilientCollection(&lostResponse{Collection: fake}, mongodb.WithRetries(3, 0, 0))
+
+	// the document has no _id, the retry inserts the same one
+	res, err := c.InsertOne(ctx, mongodb.CustomFlatStructure{ID: "1"})
+	assert.Nil(t, err)
+	assert.Len(t, fake.Docs(), 1)
+	assert.Equal(t, fake.Docs()[0].Lookup("_id").ObjectID(), res.InsertedID)
+	assert.Equal(t, 2, fake.Calls(mongotest.OpInsertOne))
+
+	// a duplicate of the first attempt is still an error
+	_, err = c.InsertOne(ctx, fake.Docs()[0])
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+}
@@ -0,0 +1,375 @@
+package mongodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Schema inference
+//
+// CustomNestedMapStruct.Data is a free-form bag, so nobody knows which keys
+// and types are actually stored until the documents are read.
+// InferSchema (or SampleSchema for a collection) walks the documents and collects for every key:
+// the BSON types with counts, how often the key is present, whether it's ever null,
+// the schema of embedded documents and array elements.
+//
+// schema, err := mongodb.SampleSchema(ctx, c, 1000)
+// schema.WriteTable(os.Stdout)
+// src, err := schema.GoStruct("Data")
+//
+// GoStruct suggests struct definitions like CustomFlatStructure:
+// a key with a single type gets this type, int32 and int64 are merged to int64,
+// integers and doubles to float64, anything else to interface{};
+// keys which are sometimes null become pointers, keys which are sometimes missing get omitempty.
+//
+// The same is available as a command for collections and dumps: mongodb/cmd/mongo-schema
+
+// Schema is the inferred schema of a set of documents
+type Schema struct {
+	// Docs is the number of inspected documents
+	Docs   int            `json:"docs"`
+	Fields []*FieldSchema `json:"fields"`
+
+	byName map[string]*FieldSchema
+}
+
+// FieldSchema describes the values stored under a single key
+type FieldSchema struct {
+	Name string `json:"name"`
+	// Count is the number of documents with the key (the number of values for array elements)
+	Count int `json:"count"`
+	// Frequency is Count divided by the number of documents
+	Frequency float64 `json:"frequency"`
+	// Types are BSON type names with the number of values of each type
+	Types    map[string]int `json:"types"`
+	Nullable bool           `json:"nullable"`
+	// Document is the schema of embedded documents stored under the key
+	Document *Schema `json:"document,omitempty"`
+	// Elements describes elements of arrays stored under the key
+	Elements *FieldSchema `json:"elements,omitempty"`
+
+	types map[bsontype.Type]int
+}
+
+// InferSchema returns the schema of docs
+func InferSchema(docs ...bson.Raw) (*Schema, error) {
+	s := &Schema{}
+	for _, doc := range docs {
+		if err := s.Add(doc); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SampleSchema infers the schema of n documents of c.
+// If c is an Aggregator the documents are picked randomly with $sample, otherwise the first n documents are used
+func SampleSchema(ctx context.Context, c Collection, n int64) (*Schema, error) {
+	var (
+		cur *mongo.Cursor
+		err error
+	)
+	if a, ok := c.(Aggregator); ok {
+		cur, err = a.Aggregate(ctx, bson.A{bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: n}}}}})
+	} else {
+		cur, err = c.Find(ctx, bson.D{}, options.Find().SetLimit(n))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	s := &Schema{}
+	for cur.Next(ctx) {
+		if err = s.Add(cur.Current); err != nil {
+			return nil, err
+		}
+	}
+	return s, cur.Err()
+}
+
+// Add adds doc to the schema
+func (s *Schema) Add(doc bson.Raw) error {
+	elems, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+
+	if s.byName == nil {
+		s.byName = map[string]*FieldSchema{}
+		for _, f := range s.Fields {
+			s.byName[f.Name] = f
+		}
+	}
+
+	s.Docs++
+	for _, e := range elems {
+		f, ok := s.byName[e.Key()]
+		if !ok {
+			f = &FieldSchema{Name: e.Key()}
+			s.byName[f.Name] = f
+			s.Fields = append(s.Fields, f)
+		}
+		if err = f.add(e.Value()); err != nil {
+			return fmt.Errorf("can't infer schema of %v: %w", e.Key(), err)
+		}
+	}
+	for _, f := range s.Fields {
+		f.Frequency = float64(f.Count) / float64(s.Docs)
+	}
+	return nil
+}
+
+func (f *FieldSchema) add(v bson.RawValue) error {
+	if f.Types == nil {
+		f.Types = map[string]int{}
+		f.types = map[bsontype.Type]int{}
+	}
+	f.Count++
+	f.Types[v.Type.String()]++
+	f.types[v.Type]++
+
+	switch v.Type {
+	case bsontype.Null, bsontype.Undefined:
+		f.Nullable = true
+	case bsontype.EmbeddedDocument:
+		if f.Document == nil {
+			f.Document = &Schema{}
+		}
+		return f.Document.Add(v.Document())
+	case bsontype.Array:
+		values, err := v.Array().Values()
+		if err != nil {
+			return err
+		}
+		if f.Elements == nil {
+			f.Elements = &FieldSchema{}
+		}
+		for _, ev := range values {
+			if err = f.Elements.add(ev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteTable writes all fields including nested ones as a text table,
+// nested keys are joined with dots, array elements are marked with []
+func (s *Schema) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "PATH\tTYPES\tCOUNT\tFREQUENCY\tNULLABLE\n")
+	s.writeRows(tw, "")
+	return tw.Flush()
+}
+
+func (s *Schema) writeRows(w io.Writer, prefix string) {
+	for _, f := range s.Fields {
+		f.writeRows(w, prefix+f.Name)
+	}
+}
+
+func (f *FieldSchema) writeRows(w io.Writer, path string) {
+	frequency := "-" // array elements have no frequency
+	if f.Name != "" {
+		frequency = fmt.Sprintf("%.2f", f.Frequency)
+	}
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", path, f.typesString(), f.Count, frequency, f.Nullable)
+	if f.Document != nil {
+		f.Document.writeRows(w, path+".")
+	}
+	if f.Elements != nil && f.Elements.Count > 0 {
+		f.Elements.writeRows(w, path+"[]")
+	}
+}
+
+// typesString returns types sorted by count: "string(10), null(2)"
+func (f *FieldSchema) typesString() string {
+	names := make([]string, 0, len(f.Types))
+	for name := range f.Types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if f.Types[names[i]] != f.Types[names[j]] {
+			return f.Types[names[i]] > f.Types[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%v(%d)", name, f.Types[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// WriteJSON writes the schema as indented JSON
+func (s *Schema) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// GoStruct returns gofmt-ed struct definitions for the schema,
+// name is the name of the top-level struct, nested structs are named after their parents and fields
+func (s *Schema) GoStruct(name string) (string, error) {
+	g := &structGenerator{names: map[string]bool{}}
+	g.enqueue(name, s)
+	for len(g.queue) > 0 {
+		next := g.queue[0]
+		g.queue = g.queue[1:]
+		g.writeStruct(next.name, next.schema)
+	}
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("can't format generated structs: %w", err)
+	}
+	return strings.TrimRight(string(src), "\n") + "\n", nil
+}
+
+type structGenerator struct {
+	buf   bytes.Buffer
+	names map[string]bool
+	queue []namedSchema
+}
+
+type namedSchema struct {
+	name   string
+	schema *Schema
+}
+
+// enqueue schedules the struct for generation and returns its unique name
+func (g *structGenerator) enqueue(name string, s *Schema) string {
+	name = uniqueName(g.names, name)
+	g.queue = append(g.queue, namedSchema{name: name, schema: s})
+	return name
+}
+
+func (g *structGenerator) writeStruct(name string, s *Schema) {
+	fmt.Fprintf(&g.buf, "type %v struct {\n", name)
+
+	fields := map[string]bool{}
+	for _, f := range s.Fields {
+		fieldName := uniqueName(fields, goName(f.Name))
+		tag := f.Name
+		if f.Count < s.Docs {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(&g.buf, "%v %v `bson:%q`\n", fieldName, g.goType(f, name+fieldName), tag)
+	}
+
+	fmt.Fprintf(&g.buf, "}\n\n")
+}
+
+func (g *structGenerator) goType(f *FieldSchema, nestedName string) string {
+	var (
+		types             []bsontype.Type
+		integers, numbers int
+	)
+	for t := range f.types {
+		switch t {
+		case bsontype.Null, bsontype.Undefined:
+			continue
+		case bsontype.Int32, bsontype.Int64:
+			integers++
+			numbers++
+		case bsontype.Double:
+			numbers++
+		}
+		types = append(types, t)
+	}
+
+	var res string
+	switch {
+	case len(types) == 0:
+		return "interface{}"
+	case len(types) > 1 && integers == len(types):
+		res = "int64"
+	case len(types) > 1 && numbers == len(types):
+		res = "float64"
+	case len(types) > 1:
+		return "interface{}"
+	default:
+		switch types[0] {
+		case bsontype.EmbeddedDocument:
+			res = g.enqueue(nestedName, f.Document)
+		case bsontype.Array:
+			if f.Elements == nil || f.Elements.Count == 0 {
+				return "[]interface{}"
+			}
+			return "[]" + g.goType(f.Elements, nestedName+"Item")
+		default:
+			var ok bool
+			if res, ok = goTypes[types[0]]; !ok {
+				return "interface{}"
+			}
+		}
+	}
+
+	if f.Nullable {
+		return "*" + res
+	}
+	return res
+}
+
+var goTypes = map[bsontype.Type]string{
+	bsontype.Double:     "float64",
+	bsontype.String:     "string",
+	bsontype.Binary:     "[]byte",
+	bsontype.ObjectID:   "primitive.ObjectID",
+	bsontype.Boolean:    "bool",
+	bsontype.DateTime:   "time.Time",
+	bsontype.Regex:      "primitive.Regex",
+	bsontype.Int32:      "int32",
+	bsontype.Timestamp:  "primitive.Timestamp",
+	bsontype.Int64:      "int64",
+	bsontype.Decimal128: "primitive.Decimal128",
+}
+
+// goName converts a BSON key to an exported Go identifier: created_at -> CreatedAt, _id -> ID
+func goName(key string) string {
+	parts := strings.FieldsFunc(key, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var b strings.Builder
+	for _, p := range parts {
+		if strings.EqualFold(p, "id") {
+			b.WriteString("ID")
+			continue
+		}
+		r := []rune(p)
+		r[0] = unicode.ToUpper(r[0])
+		b.WriteString(string(r))
+	}
+
+	name := b.String()
+	if name == "" || !unicode.IsLetter([]rune(name)[0]) {
+		name = "F" + name
+	}
+	return name
+}
+
+// uniqueName returns name or name with a numeric suffix which isn't in used yet, and marks it as used
+func uniqueName(used map[string]bool, name string) string {
+	res := name
+	for i := 2; used[res]; i++ {
+		res = fmt.Sprintf("%v%d", name, i)
+	}
+	used[res] = true
+	return res
+}
@@ -0,0 +1,92 @@
+package mongodb_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func schemaDocs(t *testing.T) []bson.Raw {
+	now := time.Now()
+	docs := []bson.D{
+		{{Key: "id", Value: "1"}, {Key: "count", Value: int32(1)}, {Key: "score", Value: 1.5}, {Key: "data", Value: bson.D{{Key: "createdAt", Value: now}, {Key: "tags", Value: bson.A{"a", "b"}}}}},
+		{{Key: "id", Value: "2"}, {Key: "count", Value: int64(2)}, {Key: "score", Value: int32(2)}, {Key: "data", Value: bson.D{{Key: "createdAt", Value: now}}}, {Key: "deleted", Value: nil}},
+		{{Key: "id", Value: "3"}, {Key: "count", Value: int32(3)}, {Key: "score", Value: "high"}, {Key: "data", Value: bson.D{{Key: "createdAt", Value: now}, {Key: "tags", Value: bson.A{}}}}},
+		{{Key: "id", Value: "4"}, {Key: "count", Value: int32(4)}, {Key: "score", Value: 4.0}, {Key: "deleted", Value: true}},
+	}
+
+	var res []bson.Raw
+	for _, d := range docs {
+		raw, err := bson.Marshal(d)
+		assert.Nil(t, err)
+		res = append(res, raw)
+	}
+	return res
+}
+
+func TestInferSchema(t *testing.T) {
+	schema, err := mongodb.InferSchema(schemaDocs(t)...)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, schema.Docs)
+
+	fields := map[string]*mongodb.FieldSchema{}
+	for _, f := range schema.Fields {
+		fields[f.Name] = f
+	}
+
+	assert.Equal(t, map[string]int{"string": 4}, fields["id"].Types)
+	assert.Equal(t, 1.0, fields["id"].Frequency)
+	assert.Equal(t, map[string]int{"32-bit integer": 3, "64-bit integer": 1}, fields["count"].Types)
+	assert.Equal(t, 0.75, fields["data"].Frequency)
+	assert.Equal(t, 3, fields["data"].Document.Docs)
+	assert.Equal(t, 2, fields["data"].Document.Fields[1].Count)
+	assert.Equal(t, map[string]int{"string": 2}, fields["data"].Document.Fields[1].Elements.Types)
+	assert.True(t, fields["deleted"].Nullable)
+	assert.Equal(t, 0.5, fields["deleted"].Frequency)
+}
+
+func TestSchemaGoStruct(t *testing.T) {
+	schema, err := mongodb.InferSchema(schemaDocs(t)...)
+	assert.Nil(t, err)
+
+	src, err := schema.GoStruct("Document")
+	assert.Nil(t, err)
+
+	expected := "type Document struct {\n" +
+		"\tID      string       `bson:\"id\"`\n" +
+		"\tCount   int64        `bson:\"count\"`\n" +
+		"\tScore   interface{}  `bson:\"score\"`\n" +
+		"\tData    DocumentData `bson:\"data,omitempty\"`\n" +
+		"\tDeleted *bool        `bson:\"deleted,omitempty\"`\n" +
+		"}\n\n" +
+		"type DocumentData struct {\n" +
+		"\tCreatedAt time.Time `bson:\"createdAt\"`\n" +
+		"\tTags      []string  `bson:\"tags,omitempty\"`\n" +
+		"}\n"
+	assert.Equal(t, expected, src)
+}
+
+func TestSampleSchema(t *testing.T) {
+	ctx := context.Background()
+	c := mongotest.NewCollection()
+	for _, d := range schemaDocs(t) {
+		_, err := c.InsertOne(ctx, d)
+		assert.Nil(t, err)
+	}
+
+	schema, err := mongodb.SampleSchema(ctx, c, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, schema.Docs)
+	assert.Equal(t, "_id", schema.Fields[0].Name)
+
+	var buf bytes.Buffer
+	assert.Nil(t, schema.WriteTable(&buf))
+	assert.Contains(t, buf.String(), "data.createdAt")
+	assert.Contains(t, buf.String(), "data.tags[]")
+}
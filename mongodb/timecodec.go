@@ -0,0 +1,307 @@
+package mongodb
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Configurable time handling
+//
+// Problem description:
+// time.Now() written by insertFlat comes back
+// - in UTC instead of the original location
+// - without nanoseconds, BSON DateTime keeps only milliseconds
+// - zero time.Time is stored as 0001-01-01, not as null
+// so the read value isn't equal to the written one.
+//
+// Each of the options below replaces the driver codecs for time.Time and *time.Time
+// with a single codec and configures it:
+//
+// reg := mongodb.NewRegistry(
+// 		mongodb.WithTimeLocation(time.Local),
+// 		mongodb.WithTimeNanoseconds(),
+// 		mongodb.WithZeroTimeAsNull(),
+// )
+//
+// With WithTimeNanoseconds time.Time fields of structs stay DateTime (truncated to milliseconds),
+// so range queries, sorting and TTL indexes keep working, and the rest of nanoseconds
+// is written to a companion field with the _ns suffix:
+//
+// {"createdAt": ISODate("2022-11-01T07:20:30.123Z"), "createdAt_ns": 456789}
+//
+// The companion field is written only when there are sub-millisecond nanoseconds
+// and is optional when reading, so the option can be enabled on existing data.
+// Only fields of structs get the companion field, time.Time in maps, slices and interface{}
+// positions is stored as plain DateTime.
+//
+// *time.Time is encoded the same way as time.Time, nil pointer is stored as null and null is decoded as nil.
+// With WithZeroTimeAsNull a pointer to zero time is stored as null as well, so it's read back as nil.
+
+// TimeNanosecondsSuffix is the suffix of the companion fields written by WithTimeNanoseconds
+const TimeNanosecondsSuffix = "_ns"
+
+var tTimePtr = reflect.TypeOf((*time.Time)(nil))
+
+// WithTimeLocation decodes time.Time in loc instead of UTC.
+// It also applies to DateTime decoded into interface{} with WithDateTimeAsTime
+func WithTimeLocation(loc *time.Location) RegistryOption {
+	return func(c *registryConfig) {
+		c.timeCodec().loc = loc
+	}
+}
+
+// WithTimeNanoseconds keeps sub-millisecond nanoseconds of time.Time and *time.Time struct fields
+// in companion <field>_ns fields
+func WithTimeNanoseconds() RegistryOption {
+	return func(c *registryConfig) {
+		c.timeCodec()
+		sc := newTimeStructCodec()
+		c.kindEncoders[reflect.Struct] = sc
+		c.kindDecoders[reflect.Struct] = sc
+	}
+}
+
+// WithZeroTimeAsNull encodes zero time.Time as BSON null, null is decoded as zero time.Time
+func WithZeroTimeAsNull() RegistryOption {
+	return func(c *registryConfig) {
+		c.timeCodec().zeroAsNull = true
+	}
+}
+
+// timeCodec returns the time codec registered in c, registering it if it's the first time option
+func (c *registryConfig) timeCodec() *timeCodec {
+	if tc, ok := c.encoders[tTime].(*timeCodec); ok {
+		return tc
+	}
+	tc := &timeCodec{}
+	c.encoders[tTime] = tc
+	c.decoders[tTime] = tc
+	c.encoders[tTimePtr] = &timePtrCodec{tc}
+	c.decoders[tTimePtr] = &timePtrCodec{tc}
+	return tc
+}
+
+type timeCodec struct {
+	loc        *time.Location
+	zeroAsNull bool
+}
+
+func (tc *timeCodec) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tTime {
+		return bsoncodec.ValueEncoderError{Name: "TimeEncodeValue", Types: []reflect.Type{tTime}, Received: val}
+	}
+	t := val.Interface().(time.Time)
+
+	if t.IsZero() && tc.zeroAsNull {
+		return vw.WriteNull()
+	}
+
+	return vw.WriteDateTime(int64(primitive.NewDateTimeFromTime(t)))
+}
+
+func (tc *timeCodec) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tTime {
+		return bsoncodec.ValueDecoderError{Name: "TimeDecodeValue", Types: []reflect.Type{tTime}, Received: val}
+	}
+
+	// DateTime, null and all the other types supported by the driver
+	if err := bsoncodec.NewTimeCodec().DecodeValue(dc, vr, val); err != nil {
+		return err
+	}
+	t := val.Interface().(time.Time)
+
+	if tc.loc != nil && !t.IsZero() {
+		t = t.In(tc.loc)
+	}
+	val.Set(reflect.ValueOf(t))
+	return nil
+}
+
+func readInteger(vr bsonrw.ValueReader) (int64, error) {
+	switch vr.Type() {
+	case bsontype.Int32:
+		i, err := vr.ReadInt32()
+		return int64(i), err
+	case bsontype.Int64:
+		return vr.ReadInt64()
+	default:
+		return 0, fmt.Errorf("expected an integer, got %v", vr.Type())
+	}
+}
+
+// timePtrCodec applies timeCodec to *time.Time, nil is stored as null
+type timePtrCodec struct {
+	tc *timeCodec
+}
+
+func (pc *timePtrCodec) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tTimePtr {
+		return bsoncodec.ValueEncoderError{Name: "TimePointerEncodeValue", Types: []reflect.Type{tTimePtr}, Received: val}
+	}
+	if val.IsNil() {
+		return vw.WriteNull()
+	}
+	return pc.tc.EncodeValue(ec, vw, val.Elem())
+}
+
+func (pc *timePtrCodec) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tTimePtr {
+		return bsoncodec.ValueDecoderError{Name: "TimePointerDecodeValue", Types: []reflect.Type{tTimePtr}, Received: val}
+	}
+	if vr.Type() == bsontype.Null {
+		val.Set(reflect.Zero(tTimePtr))
+		return vr.ReadNull()
+	}
+
+	t := reflect.New(tTime)
+	if err := pc.tc.DecodeValue(dc, vr, t.Elem()); err != nil {
+		return err
+	}
+	val.Set(t)
+	return nil
+}
+
+// timeStructCodec encodes structs with the driver struct codec
+// and adds companion fields with nanoseconds of their time fields
+type timeStructCodec struct {
+	sc     *bsoncodec.StructCodec
+	fields sync.Map // reflect.Type -> []timeField
+}
+
+// timeField is a time.Time or *time.Time field, index is the path through inline structs
+type timeField struct {
+	index []int
+	name  string
+}
+
+func newTimeStructCodec() *timeStructCodec {
+	// the error is returned only for nil tag parser
+	sc, _ := bsoncodec.NewStructCodec(bsoncodec.DefaultStructTagParser)
+	return &timeStructCodec{sc: sc}
+}
+
+func (tsc *timeStructCodec) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Kind() != reflect.Struct {
+		return bsoncodec.ValueEncoderError{Name: "TimeStructEncodeValue", Kinds: []reflect.Kind{reflect.Struct}, Received: val}
+	}
+	fields := tsc.timeFields(val.Type())
+	if len(fields) == 0 {
+		return tsc.sc.EncodeValue(ec, vw, val)
+	}
+
+	var buf bytes.Buffer
+	bvw, err := bsonrw.NewBSONValueWriter(&buf)
+	if err != nil {
+		return err
+	}
+	if err = tsc.sc.EncodeValue(ec, bvw, val); err != nil {
+		return err
+	}
+	doc := bson.Raw(buf.Bytes())
+
+	idx, res := bsoncore.AppendDocumentStart(nil)
+	res = append(res, doc[4:len(doc)-1]...)
+	for _, f := range fields {
+		t, ok := fieldTime(val.FieldByIndex(f.index))
+		ns := t.Nanosecond() % int(time.Millisecond)
+		// omitempty and null fields don't get the companion field
+		if !ok || ns == 0 || doc.Lookup(f.name).Type != bsontype.DateTime {
+			continue
+		}
+		res = bsoncore.AppendInt32Element(res, f.name+TimeNanosecondsSuffix, int32(ns))
+	}
+	if res, err = bsoncore.AppendDocumentEnd(res, idx); err != nil {
+		return err
+	}
+	return bsonrw.Copier{}.CopyDocumentFromBytes(vw, res)
+}
+
+func (tsc *timeStructCodec) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Kind() != reflect.Struct {
+		return bsoncodec.ValueDecoderError{Name: "TimeStructDecodeValue", Kinds: []reflect.Kind{reflect.Struct}, Received: val}
+	}
+	fields := tsc.timeFields(val.Type())
+	vt := vr.Type()
+	if len(fields) == 0 || (vt != bsontype.Type(0) && vt != bsontype.EmbeddedDocument) {
+		return tsc.sc.DecodeValue(dc, vr, val)
+	}
+
+	doc, err := bsonrw.Copier{}.CopyDocumentToBytes(vr)
+	if err != nil {
+		return err
+	}
+	if err = tsc.sc.DecodeValue(dc, newDocumentReader(vt, doc), val); err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		ns, ok := bson.Raw(doc).Lookup(f.name + TimeNanosecondsSuffix).AsInt64OK()
+		if !ok || ns <= 0 || ns >= int64(time.Millisecond) {
+			continue
+		}
+		fv := val.FieldByIndex(f.index)
+		t, ok := fieldTime(fv)
+		if !ok || t.IsZero() {
+			continue
+		}
+		t = t.Add(time.Duration(ns))
+		if fv.Kind() == reflect.Ptr {
+			fv.Set(reflect.ValueOf(&t))
+		} else {
+			fv.Set(reflect.ValueOf(t))
+		}
+	}
+	return nil
+}
+
+// fieldTime returns the time of a time.Time or *time.Time field, false for nil pointers
+func fieldTime(v reflect.Value) (time.Time, bool) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return time.Time{}, false
+		}
+		v = v.Elem()
+	}
+	return v.Interface().(time.Time), true
+}
+
+func (tsc *timeStructCodec) timeFields(t reflect.Type) []timeField {
+	if fields, ok := tsc.fields.Load(t); ok {
+		return fields.([]timeField)
+	}
+	fields := collectTimeFields(t, nil)
+	tsc.fields.Store(t, fields)
+	return fields
+}
+
+func collectTimeFields(t reflect.Type, index []int) []timeField {
+	var res []timeField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tags, err := bsoncodec.DefaultStructTagParser.ParseStructTags(f)
+		if err != nil || tags.Skip {
+			continue
+		}
+		fieldIndex := append(append([]int(nil), index...), i)
+		switch {
+		case tags.Inline && f.Type.Kind() == reflect.Struct:
+			res = append(res, collectTimeFields(f.Type, fieldIndex)...)
+		case f.Type == tTime || f.Type == tTimePtr:
+			res = append(res, timeField{index: fieldIndex, name: tags.Name})
+		}
+	}
+	return res
+}
@@ -0,0 +1,148 @@
+package mongodb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+type audit struct {
+	CreatedAt time.Time  `bson:"createdAt"`
+	DeletedAt *time.Time `bson:"deletedAt"`
+}
+
+func TestTimeOptions(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	ts := time.Date(2022, 11, 1, 10, 20, 30, 123456789, loc)
+
+	tt := []struct {
+		name     string
+		opts     []mongodb.RegistryOption
+		written  audit
+		expected audit
+		bsonType bsontype.Type
+	}{
+		{
+			"driver defaults",
+			nil,
+			audit{CreatedAt: ts},
+			audit{CreatedAt: ts.Truncate(time.Millisecond).UTC()},
+			bsontype.DateTime,
+		},
+		{
+			"location",
+			[]mongodb.RegistryOption{mongodb.WithTimeLocation(loc)},
+			audit{CreatedAt: ts, DeletedAt: &ts},
+			audit{CreatedAt: ts.Truncate(time.Millisecond), DeletedAt: ptr(ts.Truncate(time.Millisecond))},
+			bsontype.DateTime,
+		},
+		{
+			"nanoseconds",
+			[]mongodb.RegistryOption{mongodb.WithTimeLocation(loc), mongodb.WithTimeNanoseconds()},
+			audit{CreatedAt: ts, DeletedAt: &ts},
+			audit{CreatedAt: ts, DeletedAt: &ts},
+			bsontype.DateTime,
+		},
+		{
+			"zero time as null",
+			[]mongodb.RegistryOption{mongodb.WithZeroTimeAsNull()},
+			audit{},
+			audit{},
+			bsontype.Null,
+		},
+		{
+			"pointer to zero time as null",
+			[]mongodb.RegistryOption{mongodb.WithZeroTimeAsNull()},
+			audit{DeletedAt: &time.Time{}},
+			audit{},
+			bsontype.Null,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				reg := mongodb.NewRegistry(tc.opts...)
+
+				raw, err := bson.MarshalWithRegistry(reg, tc.written)
+				assert.Nil(t, err)
+				assert.Equal(t, tc.bsonType, bson.Raw(raw).Lookup("createdAt").Type)
+
+				var res audit
+				err = bson.UnmarshalWithRegistry(reg, raw, &res)
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, res)
+			},
+		)
+	}
+}
+
+func TestTimeNanosecondsCompanionField(t *testing.T) {
+	ts := time.Date(2022, 11, 1, 10, 20, 30, 123456789, time.UTC)
+	reg := mongodb.NewRegistry(mongodb.WithTimeNanoseconds(), mongodb.WithDateTimeAsTime())
+
+	type inlined struct {
+		Audit audit `bson:",inline"`
+		Data  map[string]interface{}
+	}
+	raw, err := bson.MarshalWithRegistry(reg, inlined{Audit: audit{CreatedAt: ts}, Data: map[string]interface{}{"t": ts}})
+	assert.Nil(t, err)
+
+	doc := bson.Raw(raw)
+	assert.Equal(t, ts.Truncate(time.Millisecond), doc.Lookup("createdAt").Time().UTC())
+	assert.Equal(t, int32(456789), doc.Lookup("createdAt_ns").Int32())
+	// nil pointers and maps don't get the companion field
+	assert.Equal(t, bson.RawValue{}, doc.Lookup("deletedAt_ns"))
+	assert.Equal(t, bson.RawValue{}, doc.Lookup("data", "t_ns"))
+
+	var res inlined
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.Nil(t, err)
+	assert.Equal(t, ts, res.Audit.CreatedAt)
+	assert.Equal(t, ts.Truncate(time.Millisecond), res.Data["t"])
+
+	// range queries on the field keep working
+	c := mongotest.NewCollection()
+	_, err = c.InsertOne(context.Background(), doc)
+	assert.Nil(t, err)
+	n, err := c.CountDocuments(context.Background(), bson.M{"createdAt": bson.M{"$gte": ts.Add(-time.Second)}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestTimeNanosecondsReadsDateTime(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	c := mongotest.NewCollection()
+	_, err := c.InsertOne(ctx, audit{CreatedAt: now})
+	assert.Nil(t, err)
+
+	reg := mongodb.NewRegistry(mongodb.WithTimeNanoseconds())
+	var res audit
+	err = bson.UnmarshalWithRegistry(reg, c.Docs()[0], &res)
+	assert.Nil(t, err)
+	assert.True(t, now.Truncate(time.Millisecond).Equal(res.CreatedAt))
+}
+
+func TestFlatWithTimeOptions(t *testing.T) {
+	reg := mongodb.NewRegistry(mongodb.WithTimeLocation(time.Local), mongodb.WithTimeNanoseconds())
+	c := mongotest.NewCollection(mongotest.WithRegistry(reg))
+
+	before := time.Now()
+	res, err := mongodb.ExecWithFlatOnCollection(context.Background(), c, "time")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Local, res.Date.Location())
+	assert.False(t, res.Date.Before(before))
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,307 @@
+package mongodb
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Unsigned integers
+//
+// Problem description:
+// BSON has no unsigned integers, the driver stores uint64 and uint as int64
+// and fails with "overflows int64" for values above math.MaxInt64,
+// so uint64 counters and hashes can't be stored as is.
+//
+// WithUints picks how uint and uint64 are stored:
+//
+// - UintAsInt64: as int64, values above math.MaxInt64 fail with *UintOverflowError
+// - UintAsDecimal128: as Decimal128, all values fit and the field can still be compared in queries
+// - UintAsString: as decimal string
+// - UintAsKind: as {"_kind": "uint64", "value": Decimal128}, see below
+//
+// With the first three strategies uint8, uint16 and uint32 always fit into int32/int64 and are stored as by the driver.
+// The decoder is the same for all strategies: it accepts integers, integral doubles,
+// Decimal128, strings and {"value": ...} documents and checks that the value fits into the target unsigned type,
+// so the strategy can be changed without migrating the data.
+//
+// Struct fields are decoded into their own types, but interface{} positions
+// (values of map[string]interface{}) get int32, int64, Decimal128 or string back.
+// UintAsKind stores all unsigned types as documents tagged with the type name, like WithComplex does:
+//
+// {"_kind": "uint16", "value": NumberDecimal("7")}
+//
+// so they are decoded back into uint, uint8, uint16, uint32 and uint64 in interface{} positions (see KindKey).
+// The price is that the field can't be compared with numbers in queries, use "field.value" for that.
+// FidelityMap keeps the original types with any strategy as well (look at TestUintsInFidelityMap).
+
+// UintStrategy defines how uint and uint64 values are stored
+type UintStrategy int
+
+const (
+	UintAsInt64 UintStrategy = iota
+	UintAsDecimal128
+	UintAsString
+	UintAsKind
+)
+
+// uintKinds are _kind values of documents written by UintAsKind
+var uintKinds = map[reflect.Kind]string{
+	reflect.Uint:   "uint",
+	reflect.Uint8:  "uint8",
+	reflect.Uint16: "uint16",
+	reflect.Uint32: "uint32",
+	reflect.Uint64: "uint64",
+}
+
+var uintKindTypes = map[string]reflect.Type{
+	"uint":   reflect.TypeOf(uint(0)),
+	"uint8":  reflect.TypeOf(uint8(0)),
+	"uint16": reflect.TypeOf(uint16(0)),
+	"uint32": reflect.TypeOf(uint32(0)),
+	"uint64": reflect.TypeOf(uint64(0)),
+}
+
+// UintOverflowError is returned by UintAsInt64 strategy for values which don't fit into int64
+type UintOverflowError struct {
+	Value uint64
+}
+
+func (e *UintOverflowError) Error() string {
+	return fmt.Sprintf("mongodb: %d overflows int64, use UintAsDecimal128 or UintAsString to store it", e.Value)
+}
+
+// WithUints encodes uint and uint64 with strategy s
+// and decodes all unsigned integers from any numeric or string representation
+func WithUints(s UintStrategy) RegistryOption {
+	return func(c *registryConfig) {
+		uc := &uintCodec{strategy: s}
+		c.kindEncoders[reflect.Uint] = uc
+		c.kindEncoders[reflect.Uint64] = uc
+		for _, k := range []reflect.Kind{reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64} {
+			c.kindDecoders[k] = uc
+		}
+		if s == UintAsKind {
+			for k, name := range uintKinds {
+				c.kindEncoders[k] = uc
+				c.kinds[name] = uintKindTypes[name]
+			}
+		}
+	}
+}
+
+type uintCodec struct {
+	strategy UintStrategy
+}
+
+func (uc *uintCodec) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	kind, ok := uintKinds[val.Kind()]
+	if !val.IsValid() || !ok {
+		return bsoncodec.ValueEncoderError{
+			Name:     "UintEncodeValue",
+			Kinds:    []reflect.Kind{reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64},
+			Received: val,
+		}
+	}
+	u := val.Uint()
+
+	switch uc.strategy {
+	case UintAsDecimal128:
+		d, err := primitive.ParseDecimal128(strconv.FormatUint(u, 10))
+		if err != nil {
+			return err
+		}
+		return vw.WriteDecimal128(d)
+	case UintAsKind:
+		return encodeUintDocument(vw, kind, u)
+	case UintAsString:
+		return vw.WriteString(strconv.FormatUint(u, 10))
+	default:
+		if u > math.MaxInt64 {
+			return &UintOverflowError{Value: u}
+		}
+		return vw.WriteInt64(int64(u))
+	}
+}
+
+func (uc *uintCodec) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	switch val.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		val = reflect.Value{}
+	}
+	if !val.CanSet() {
+		return bsoncodec.ValueDecoderError{
+			Name:     "UintDecodeValue",
+			Kinds:    []reflect.Kind{reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64},
+			Received: val,
+		}
+	}
+
+	u, err := readUint(vr)
+	if err != nil {
+		return err
+	}
+
+	if val.OverflowUint(u) {
+		return fmt.Errorf("%d overflows %v", u, val.Type())
+	}
+	val.SetUint(u)
+	return nil
+}
+
+// readUint reads an unsigned integer from any representation written by uintCodec, null is read as 0
+func readUint(vr bsonrw.ValueReader) (u uint64, err error) {
+	switch vt := vr.Type(); vt {
+	case bsontype.Int32:
+		var i int32
+		if i, err = vr.ReadInt32(); err == nil {
+			u, err = intToUint(int64(i))
+		}
+	case bsontype.Int64:
+		var i int64
+		if i, err = vr.ReadInt64(); err == nil {
+			u, err = intToUint(i)
+		}
+	case bsontype.Double:
+		var f float64
+		if f, err = vr.ReadDouble(); err == nil {
+			u, err = floatToUint(f)
+		}
+	case bsontype.Decimal128:
+		var d primitive.Decimal128
+		if d, err = vr.ReadDecimal128(); err == nil {
+			u, err = decimalToUint(d)
+		}
+	case bsontype.String:
+		var s string
+		if s, err = vr.ReadString(); err == nil {
+			u, err = strconv.ParseUint(s, 10, 64)
+		}
+	case bsontype.EmbeddedDocument:
+		u, err = decodeUintDocument(vr)
+	case bsontype.Null:
+		err = vr.ReadNull()
+	case bsontype.Undefined:
+		err = vr.ReadUndefined()
+	default:
+		err = fmt.Errorf("cannot decode %v into an unsigned integer type", vt)
+	}
+	return u, err
+}
+
+func encodeUintDocument(vw bsonrw.ValueWriter, kind string, u uint64) error {
+	d, err := primitive.ParseDecimal128(strconv.FormatUint(u, 10))
+	if err != nil {
+		return err
+	}
+
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+	ew, err := dw.WriteDocumentElement(KindKey)
+	if err != nil {
+		return err
+	}
+	if err = ew.WriteString(kind); err != nil {
+		return err
+	}
+	if ew, err = dw.WriteDocumentElement("value"); err != nil {
+		return err
+	}
+	if err = ew.WriteDecimal128(d); err != nil {
+		return err
+	}
+	return dw.WriteDocumentEnd()
+}
+
+func decodeUintDocument(vr bsonrw.ValueReader) (uint64, error) {
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		u     uint64
+		found bool
+	)
+	for {
+		key, evr, err := dr.ReadElement()
+		if err == bsonrw.ErrEOD {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if key != "value" {
+			if err = evr.Skip(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if evr.Type() == bsontype.EmbeddedDocument {
+			return 0, fmt.Errorf("cannot decode a nested document into an unsigned integer type")
+		}
+		if u, err = readUint(evr); err != nil {
+			return 0, fmt.Errorf("can't decode unsigned integer value: %w", err)
+		}
+		found = true
+	}
+	if !found {
+		return 0, fmt.Errorf("cannot decode a document without value into an unsigned integer type")
+	}
+	return u, nil
+}
+
+func intToUint(i int64) (uint64, error) {
+	if i < 0 {
+		return 0, fmt.Errorf("%d is negative, can't be decoded into an unsigned integer type", i)
+	}
+	return uint64(i), nil
+}
+
+func floatToUint(f float64) (uint64, error) {
+	if f < 0 || f != math.Trunc(f) || f >= math.MaxUint64 {
+		return 0, fmt.Errorf("%v can't be decoded into an unsigned integer type", f)
+	}
+	return uint64(f), nil
+}
+
+func decimalToUint(d primitive.Decimal128) (uint64, error) {
+	bi, exp, err := d.BigInt()
+	if err != nil {
+		return 0, fmt.Errorf("%v can't be decoded into an unsigned integer type: %w", d, err)
+	}
+
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(absInt(exp))), nil)
+	if exp > 0 {
+		bi.Mul(bi, pow)
+	} else if exp < 0 {
+		var rem big.Int
+		bi.QuoRem(bi, pow, &rem)
+		if rem.Sign() != 0 {
+			return 0, fmt.Errorf("%v isn't an integer, can't be decoded into an unsigned integer type", d)
+		}
+	}
+
+	if bi.Sign() < 0 || !bi.IsUint64() {
+		return 0, fmt.Errorf("%v can't be decoded into an unsigned integer type", d)
+	}
+	return bi.Uint64(), nil
+}
+
+func absInt(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,167 @@
+package mongodb_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type counters struct {
+	Hits uint64 `bson:"hits"`
+	Hash uint   `bson:"hash"`
+	Tiny uint8  `bson:"tiny"`
+}
+
+func TestUintStrategies(t *testing.T) {
+	tt := []struct {
+		name     string
+		strategy mongodb.UintStrategy
+		value    uint64
+		bsonType bsontype.Type
+	}{
+		{"int64", mongodb.UintAsInt64, math.MaxInt64, bsontype.Int64},
+		{"decimal128", mongodb.UintAsDecimal128, math.MaxUint64, bsontype.Decimal128},
+		{"string", mongodb.UintAsString, math.MaxUint64, bsontype.String},
+	}
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				reg := mongodb.NewRegistry(mongodb.WithUints(tc.strategy))
+				written := counters{Hits: tc.value, Hash: uint(tc.value), Tiny: 6}
+
+				raw, err := bson.MarshalWithRegistry(reg, written)
+				assert.Nil(t, err)
+				assert.Equal(t, tc.bsonType, bson.Raw(raw).Lookup("hits").Type)
+				assert.Equal(t, bsontype.Int32, bson.Raw(raw).Lookup("tiny").Type)
+
+				var res counters
+				err = bson.UnmarshalWithRegistry(reg, raw, &res)
+				assert.Nil(t, err)
+				assert.Equal(t, written, res)
+			},
+		)
+	}
+}
+
+func TestUintOverflow(t *testing.T) {
+	reg := mongodb.NewRegistry(mongodb.WithUints(mongodb.UintAsInt64))
+
+	_, err := bson.MarshalWithRegistry(reg, counters{Hits: math.MaxUint64})
+
+	var overflow *mongodb.UintOverflowError
+	assert.True(t, errors.As(err, &overflow))
+	assert.Equal(t, uint64(math.MaxUint64), overflow.Value)
+}
+
+func TestUintDecoding(t *testing.T) {
+	maxUint, _ := primitive.ParseDecimal128("18446744073709551615")
+	scaled, _ := primitive.ParseDecimal128("1.2E+3")
+	fraction, _ := primitive.ParseDecimal128("1.5")
+
+	tt := []struct {
+		name     string
+		stored   interface{}
+		expected uint64
+		isErr    bool
+	}{
+		{"int32", int32(1), 1, false},
+		{"int64", int64(2), 2, false},
+		{"double", 3.0, 3, false},
+		{"decimal128", maxUint, math.MaxUint64, false},
+		{"decimal128 with exponent", scaled, 1200, false},
+		{"string", "18446744073709551615", math.MaxUint64, false},
+		{"negative", int64(-1), 0, true},
+		{"fraction", 1.5, 0, true},
+		{"decimal128 fraction", fraction, 0, true},
+		{"not a number", "abc", 0, true},
+		{"bool", true, 0, true},
+	}
+
+	reg := mongodb.NewRegistry(mongodb.WithUints(mongodb.UintAsDecimal128))
+
+	for _, tc := range tt {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				raw, err := bson.Marshal(bson.M{"hits": tc.stored})
+				assert.Nil(t, err)
+
+				var res counters
+				err = bson.UnmarshalWithRegistry(reg, raw, &res)
+				assert.Equal(t, tc.isErr, err != nil, err)
+				assert.Equal(t, tc.expected, res.Hits)
+			},
+		)
+	}
+}
+
+func TestUintDecodingOverflowsSmallTypes(t *testing.T) {
+	raw, err := bson.Marshal(bson.M{"tiny": 256})
+	assert.Nil(t, err)
+
+	var res counters
+	err = bson.UnmarshalWithRegistry(mongodb.NewRegistry(mongodb.WithUints(mongodb.UintAsInt64)), raw, &res)
+	assert.NotNil(t, err)
+}
+
+func TestUintsInFidelityMap(t *testing.T) {
+	data := mongodb.FidelityMap{
+		"uint8":  uint8(6),
+		"uint16": uint16(7),
+		"uint32": uint32(8),
+		"uint64": uint64(math.MaxUint64),
+		"uint":   uint(10),
+	}
+
+	for _, s := range []mongodb.UintStrategy{mongodb.UintAsDecimal128, mongodb.UintAsString} {
+		reg := mongodb.NewRegistry(mongodb.WithFidelity(), mongodb.WithUints(s))
+
+		raw, err := bson.MarshalWithRegistry(reg, mongodb.FidelityNestedMapStruct{ID: "uints", Data: data})
+		assert.Nil(t, err)
+
+		var res mongodb.FidelityNestedMapStruct
+		err = bson.UnmarshalWithRegistry(reg, raw, &res)
+		assert.Nil(t, err)
+		assert.Equal(t, data, res.Data)
+	}
+}
+
+func TestUintsAsKind(t *testing.T) {
+	data := map[string]interface{}{
+		"uint8":  uint8(6),
+		"uint16": uint16(7),
+		"uint32": uint32(8),
+		"uint64": uint64(math.MaxUint64),
+		"uint":   uint(10),
+		"int":    int64(-1),
+	}
+	reg := mongodb.NewRegistry(mongodb.WithUints(mongodb.UintAsKind))
+
+	raw, err := bson.MarshalWithRegistry(reg, bson.M{"data": data, "hits": uint64(3)})
+	assert.Nil(t, err)
+	assert.Equal(t, "uint16", bson.Raw(raw).Lookup("data", "uint16", "_kind").StringValue())
+	assert.Equal(t, bsontype.Int64, bson.Raw(raw).Lookup("data", "int").Type)
+
+	var res struct {
+		Data map[string]interface{} `bson:"data"`
+		Hits uint64                 `bson:"hits"`
+	}
+	err = bson.UnmarshalWithRegistry(reg, raw, &res)
+	assert.Nil(t, err)
+	assert.Equal(t, data, res.Data)
+	assert.Equal(t, uint64(3), res.Hits)
+
+	// documents written by UintAsKind are readable with other strategies
+	var typed counters
+	err = bson.UnmarshalWithRegistry(mongodb.NewRegistry(mongodb.WithUints(mongodb.UintAsString)), raw, &typed)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), typed.Hits)
+}
@@ -0,0 +1,346 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Change stream watcher
+//
+// Problem description:
+// *mongo.ChangeStream decodes events with the registry of the collection,
+// so fullDocument.data.createdAt of a CustomNestedMapStruct arrives as primitive.DateTime,
+// and every consumer writes the same loop with resume token handling around it.
+//
+// Watch opens a change stream, decodes full documents into T with customRegistry
+// (or the registry set with WithWatchRegistry) and delivers events over a channel:
+//
+// src := mongodb.CollectionEvents(client.Database(db).Collection(coll), mongo.Pipeline{})
+// w, err := mongodb.Watch[mongodb.CustomNestedMapStruct](ctx, src, mongodb.WithTokenStore(store, "decoding-consumer"))
+// for ev := range w.Events() {
+// 		handle(ev.OperationType, ev.FullDocument)
+// }
+// err = w.Err()
+//
+// The stream is read only when the consumer is ready to receive, so a slow consumer
+// slows down reading instead of piling up events in memory, WithEventBuffer allows to read ahead.
+// The resume token of an event is saved to the TokenStore once the consumer has taken the next one,
+// so after a restart the watcher continues with the last event which may be not processed completely:
+// events are delivered at least once.
+//
+// Cancelling ctx or calling Close stops the watcher gracefully: the stream is closed,
+// the events channel is closed and Err returns nil.
+// Any other error of the stream, decoding or the token store stops the watcher as well and is returned by Err.
+//
+// Streams are opened by an EventSource, CollectionEvents is the source for real collections,
+// mongotest.EventSource allows to test consumers without a server.
+
+// ChangeStream is the subset of *mongo.ChangeStream used by Watch
+type ChangeStream interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	ResumeToken() bson.Raw
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// EventSource opens change streams, resumeAfter is nil for a new stream
+type EventSource interface {
+	Open(ctx context.Context, resumeAfter bson.Raw) (ChangeStream, error)
+}
+
+// ChangeStreamer is implemented by collections which can open change streams
+type ChangeStreamer interface {
+	Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error)
+}
+
+var (
+	_ ChangeStream   = (*mongo.ChangeStream)(nil)
+	_ ChangeStreamer = (*mongo.Collection)(nil)
+)
+
+// CollectionEvents returns the EventSource of change streams of c.
+// Full documents of updates are looked up unless opts say otherwise
+func CollectionEvents(c ChangeStreamer, pipeline interface{}, opts ...*options.ChangeStreamOptions) EventSource {
+	return &collectionEvents{coll: c, pipeline: pipeline, opts: opts}
+}
+
+type collectionEvents struct {
+	coll     ChangeStreamer
+	pipeline interface{}
+	opts     []*options.ChangeStreamOptions
+}
+
+func (s *collectionEvents) Open(ctx context.Context, resumeAfter bson.Raw) (ChangeStream, error) {
+	opts := append([]*options.ChangeStreamOptions{options.ChangeStream().SetFullDocument(options.UpdateLookup)}, s.opts...)
+	if resumeAfter != nil {
+		opts = append(opts, options.ChangeStream().SetResumeAfter(resumeAfter))
+	}
+	return s.coll.Watch(ctx, s.pipeline, opts...)
+}
+
+// TokenStore keeps resume tokens of watchers by name
+type TokenStore interface {
+	// Load returns the saved token or nil
+	Load(ctx context.Context, name string) (bson.Raw, error)
+	Save(ctx context.Context, name string, token bson.Raw) error
+}
+
+// MemoryTokenStore keeps tokens in memory
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]bson.Raw
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: map[string]bson.Raw{}}
+}
+
+// Load returns the saved token or nil
+func (s *MemoryTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[name], nil
+}
+
+// Save saves token
+func (s *MemoryTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[name] = append(bson.Raw(nil), token...)
+	return nil
+}
+
+// CollectionTokenStore keeps tokens in a collection, one document per watcher with the name as _id
+type CollectionTokenStore struct {
+	coll Collection
+}
+
+func NewCollectionTokenStore(c Collection) *CollectionTokenStore {
+	return &CollectionTokenStore{coll: c}
+}
+
+type tokenDocument struct {
+	Token bson.Raw `bson:"token"`
+}
+
+// Load returns the saved token or nil
+func (s *CollectionTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	var doc tokenDocument
+	err := s.coll.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return doc.Token, err
+}
+
+// Save saves token
+func (s *CollectionTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	_, err := s.coll.UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: name}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "token", Value: token}}}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// ChangeEvent is a change stream event with the full document decoded into T
+type ChangeEvent[T any] struct {
+	OperationType string
+	// DocumentKey is the _id (and the shard key) of the changed document
+	DocumentKey bson.Raw
+	// FullDocument is nil for deletes and updates of already deleted documents
+	FullDocument *T
+	ClusterTime  primitive.Timestamp
+	ResumeToken  bson.Raw
+	// Raw is the whole event
+	Raw bson.Raw
+}
+
+type changeEventDocument struct {
+	ID            bson.Raw            `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	DocumentKey   bson.Raw            `bson:"documentKey"`
+	FullDocument  bson.RawValue       `bson:"fullDocument"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+}
+
+// WatchOption configures Watch
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	registry  *bsoncodec.Registry
+	store     TokenStore
+	name      string
+	bufferLen int
+}
+
+// WithWatchRegistry sets the registry used to decode full documents
+func WithWatchRegistry(reg *bsoncodec.Registry) WatchOption {
+	return func(c *watchConfig) {
+		c.registry = reg
+	}
+}
+
+// WithTokenStore saves resume tokens to store under name and resumes from the saved token
+func WithTokenStore(store TokenStore, name string) WatchOption {
+	return func(c *watchConfig) {
+		c.store = store
+		c.name = name
+	}
+}
+
+// WithEventBuffer allows to read n events ahead of the consumer
+func WithEventBuffer(n int) WatchOption {
+	return func(c *watchConfig) {
+		c.bufferLen = n
+	}
+}
+
+// Watcher delivers change events of a stream
+type Watcher[T any] struct {
+	cfg    watchConfig
+	stream ChangeStream
+	events chan ChangeEvent[T]
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Watch opens a change stream of src, resuming from the saved token if there's a TokenStore.
+// Errors of opening the stream are returned immediately, later errors are returned by Err
+func Watch[T any](ctx context.Context, src EventSource, opts ...WatchOption) (*Watcher[T], error) {
+	cfg := watchConfig{registry: customRegistry()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var token bson.Raw
+	if cfg.store != nil {
+		var err error
+		if token, err = cfg.store.Load(ctx, cfg.name); err != nil {
+			return nil, fmt.Errorf("can't load resume token of %v: %w", cfg.name, err)
+		}
+	}
+
+	stream, err := src.Open(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watcher[T]{
+		cfg:    cfg,
+		stream: stream,
+		events: make(chan ChangeEvent[T], cfg.bufferLen),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.run(ctx)
+	return w, nil
+}
+
+// Events returns the channel of events, it's closed when the watcher stops
+func (w *Watcher[T]) Events() <-chan ChangeEvent[T] {
+	return w.events
+}
+
+// Err returns the error which stopped the watcher, it should be called after Events is closed
+func (w *Watcher[T]) Err() error {
+	<-w.done
+	return w.err
+}
+
+// Close stops the watcher and waits until the stream is closed
+func (w *Watcher[T]) Close() error {
+	w.cancel()
+	return w.Err()
+}
+
+func (w *Watcher[T]) run(ctx context.Context) {
+	defer close(w.done)
+	defer close(w.events)
+	defer w.cancel()
+
+	err := w.read(ctx)
+	if closeErr := w.stream.Close(context.Background()); err == nil {
+		err = closeErr
+	}
+	if ctx.Err() != nil && (err == nil || errors.Is(err, context.Canceled)) {
+		err = nil
+	}
+	w.err = err
+}
+
+func (w *Watcher[T]) read(ctx context.Context) error {
+	// tokens of sent events which can be still unprocessed by the consumer
+	var pending []bson.Raw
+
+	for w.stream.Next(ctx) {
+		ev, err := w.decode()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case w.events <- ev:
+		case <-ctx.Done():
+			return nil
+		}
+
+		if w.cfg.store == nil {
+			continue
+		}
+		// the consumer has taken all but bufferLen sent events,
+		// so the one before them is processed
+		pending = append(pending, ev.ResumeToken)
+		if len(pending) > w.cfg.bufferLen+1 {
+			if err = w.cfg.store.Save(ctx, w.cfg.name, pending[0]); err != nil {
+				return fmt.Errorf("can't save resume token of %v: %w", w.cfg.name, err)
+			}
+			pending = pending[1:]
+		}
+	}
+	return w.stream.Err()
+}
+
+func (w *Watcher[T]) decode() (ChangeEvent[T], error) {
+	var raw bson.Raw
+	if err := w.stream.Decode(&raw); err != nil {
+		return ChangeEvent[T]{}, err
+	}
+	raw = append(bson.Raw(nil), raw...)
+
+	var doc changeEventDocument
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return ChangeEvent[T]{}, fmt.Errorf("can't decode change event: %w", err)
+	}
+
+	ev := ChangeEvent[T]{
+		OperationType: doc.OperationType,
+		DocumentKey:   doc.DocumentKey,
+		ClusterTime:   doc.ClusterTime,
+		ResumeToken:   append(bson.Raw(nil), w.stream.ResumeToken()...),
+		Raw:           raw,
+	}
+	if ev.ResumeToken == nil {
+		ev.ResumeToken = doc.ID
+	}
+
+	if full, ok := doc.FullDocument.DocumentOK(); ok {
+		ev.FullDocument = new(T)
+		if err := Unmarshal(w.cfg.registry, full, ev.FullDocument); err != nil {
+			return ChangeEvent[T]{}, fmt.Errorf("can't decode full document of %v: %w", doc.DocumentKey, err)
+		}
+	}
+	return ev, nil
+}
@@ -0,0 +1,104 @@
+package mongodb_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asstart/go-receipts/mongodb"
+	"github.com/asstart/go-receipts/mongodb/mongotest"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func nextEvent(t *testing.T, w *mongodb.Watcher[mongodb.CustomNestedMapStruct]) (mongodb.ChangeEvent[mongodb.CustomNestedMapStruct], bool) {
+	select {
+	case ev, ok := <-w.Events():
+		return ev, ok
+	case <-time.After(time.Second):
+		t.Fatal("no event in a second")
+	}
+	return mongodb.ChangeEvent[mongodb.CustomNestedMapStruct]{}, false
+}
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	src := mongotest.NewEventSource()
+	store := mongodb.NewMemoryTokenStore()
+
+	w, err := mongodb.Watch[mongodb.CustomNestedMapStruct](ctx, src, mongodb.WithTokenStore(store, "consumer"))
+	assert.Nil(t, err)
+
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	doc := mongodb.CustomNestedMapStruct{ID: "1", Data: map[string]interface{}{"createdAt": created}}
+	assert.Nil(t, src.Push("insert", "1", doc))
+	assert.Nil(t, src.Push("delete", "1", nil))
+	assert.Nil(t, src.Push("insert", "2", mongodb.CustomNestedMapStruct{ID: "2"}))
+
+	ev, ok := nextEvent(t, w)
+	assert.True(t, ok)
+	assert.Equal(t, "insert", ev.OperationType)
+	assert.Equal(t, "1", ev.FullDocument.ID)
+	assert.Equal(t, created, ev.FullDocument.Data["createdAt"].(time.Time).UTC())
+
+	ev, _ = nextEvent(t, w)
+	assert.Equal(t, "delete", ev.OperationType)
+	assert.Equal(t, "1", ev.DocumentKey.Lookup("_id").StringValue())
+	assert.Nil(t, ev.FullDocument)
+	processed := ev.ResumeToken
+
+	ev, _ = nextEvent(t, w)
+	assert.Equal(t, "2", ev.FullDocument.ID)
+
+	assert.Nil(t, w.Close())
+	_, ok = <-w.Events()
+	assert.False(t, ok)
+
+	token, err := store.Load(ctx, "consumer")
+	assert.Nil(t, err)
+	assert.Equal(t, processed, token)
+
+	// the last event is delivered again after restart
+	w, err = mongodb.Watch[mongodb.CustomNestedMapStruct](ctx, src, mongodb.WithTokenStore(store, "consumer"))
+	assert.Nil(t, err)
+	assert.Equal(t, []bson.Raw{nil, processed}, src.Opened())
+
+	ev, _ = nextEvent(t, w)
+	assert.Equal(t, "2", ev.FullDocument.ID)
+
+	failure := errors.New("stream failed")
+	src.Fail(failure)
+	_, ok = nextEvent(t, w)
+	assert.False(t, ok)
+	assert.ErrorIs(t, w.Err(), failure)
+}
+
+func TestWatchErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := mongotest.NewEventSource()
+
+	w, err := mongodb.Watch[mongodb.CustomNestedMapStruct](ctx, src, mongodb.WithEventBuffer(1))
+	assert.Nil(t, err)
+
+	assert.Nil(t, src.Push("insert", "1", bson.D{{Key: "data", Value: "not a map"}}))
+	_, ok := nextEvent(t, w)
+	assert.False(t, ok)
+	var decErr *mongodb.DecodeError
+	assert.ErrorAs(t, w.Err(), &decErr)
+	assert.Equal(t, "Data", decErr.Path)
+
+	w, err = mongodb.Watch[mongodb.CustomNestedMapStruct](ctx, src)
+	assert.Nil(t, err)
+	cancel()
+	_, ok = nextEvent(t, w)
+	assert.False(t, ok)
+	assert.Nil(t, w.Err())
+
+	unknown, err := bson.Marshal(bson.D{{Key: "_data", Value: "unknown"}})
+	assert.Nil(t, err)
+	store := mongodb.NewCollectionTokenStore(mongotest.NewCollection())
+	assert.Nil(t, store.Save(context.Background(), "consumer", unknown))
+	_, err = mongodb.Watch[mongodb.CustomNestedMapStruct](context.Background(), src, mongodb.WithTokenStore(store, "consumer"))
+	assert.ErrorIs(t, err, mongotest.ErrTokenNotFound)
+}